@@ -0,0 +1,338 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: api/flowgpt/v1/flowgpt.proto
+
+// The run control API of a flow-gpt server, the gRPC counterpart of its HTTP API.
+
+package flowgptv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	RunService_CreateRun_FullMethodName     = "/flowgpt.v1.RunService/CreateRun"
+	RunService_GetRun_FullMethodName        = "/flowgpt.v1.RunService/GetRun"
+	RunService_CancelRun_FullMethodName     = "/flowgpt.v1.RunService/CancelRun"
+	RunService_ApproveAction_FullMethodName = "/flowgpt.v1.RunService/ApproveAction"
+	RunService_InjectHint_FullMethodName    = "/flowgpt.v1.RunService/InjectHint"
+	RunService_WatchRun_FullMethodName      = "/flowgpt.v1.RunService/WatchRun"
+)
+
+// RunServiceClient is the client API for RunService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RunServiceClient interface {
+	// CreateRun starts a run of a problem.
+	CreateRun(ctx context.Context, in *CreateRunRequest, opts ...grpc.CallOption) (*Run, error)
+	// GetRun describes a run.
+	GetRun(ctx context.Context, in *GetRunRequest, opts ...grpc.CallOption) (*Run, error)
+	// CancelRun cancels a running run and returns it once it finished, or fails with DeadlineExceeded if the call
+	// times out first.
+	CancelRun(ctx context.Context, in *CancelRunRequest, opts ...grpc.CallOption) (*Run, error)
+	// ApproveAction approves or rejects the action of a run awaiting approval.
+	ApproveAction(ctx context.Context, in *ApproveActionRequest, opts ...grpc.CallOption) (*ApproveActionResponse, error)
+	// InjectHint gives the thinker of a run a hint before its next state.
+	InjectHint(ctx context.Context, in *InjectHintRequest, opts ...grpc.CallOption) (*InjectHintResponse, error)
+	// WatchRun streams the events of a run from the one after after_id, the stream ends when the run finishes.
+	WatchRun(ctx context.Context, in *WatchRunRequest, opts ...grpc.CallOption) (RunService_WatchRunClient, error)
+}
+
+type runServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRunServiceClient(cc grpc.ClientConnInterface) RunServiceClient {
+	return &runServiceClient{cc}
+}
+
+func (c *runServiceClient) CreateRun(ctx context.Context, in *CreateRunRequest, opts ...grpc.CallOption) (*Run, error) {
+	out := new(Run)
+	err := c.cc.Invoke(ctx, RunService_CreateRun_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *runServiceClient) GetRun(ctx context.Context, in *GetRunRequest, opts ...grpc.CallOption) (*Run, error) {
+	out := new(Run)
+	err := c.cc.Invoke(ctx, RunService_GetRun_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *runServiceClient) CancelRun(ctx context.Context, in *CancelRunRequest, opts ...grpc.CallOption) (*Run, error) {
+	out := new(Run)
+	err := c.cc.Invoke(ctx, RunService_CancelRun_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *runServiceClient) ApproveAction(ctx context.Context, in *ApproveActionRequest, opts ...grpc.CallOption) (*ApproveActionResponse, error) {
+	out := new(ApproveActionResponse)
+	err := c.cc.Invoke(ctx, RunService_ApproveAction_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *runServiceClient) InjectHint(ctx context.Context, in *InjectHintRequest, opts ...grpc.CallOption) (*InjectHintResponse, error) {
+	out := new(InjectHintResponse)
+	err := c.cc.Invoke(ctx, RunService_InjectHint_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *runServiceClient) WatchRun(ctx context.Context, in *WatchRunRequest, opts ...grpc.CallOption) (RunService_WatchRunClient, error) {
+	stream, err := c.cc.NewStream(ctx, &RunService_ServiceDesc.Streams[0], RunService_WatchRun_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &runServiceWatchRunClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type RunService_WatchRunClient interface {
+	Recv() (*RunEvent, error)
+	grpc.ClientStream
+}
+
+type runServiceWatchRunClient struct {
+	grpc.ClientStream
+}
+
+func (x *runServiceWatchRunClient) Recv() (*RunEvent, error) {
+	m := new(RunEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RunServiceServer is the server API for RunService service.
+// All implementations must embed UnimplementedRunServiceServer
+// for forward compatibility
+type RunServiceServer interface {
+	// CreateRun starts a run of a problem.
+	CreateRun(context.Context, *CreateRunRequest) (*Run, error)
+	// GetRun describes a run.
+	GetRun(context.Context, *GetRunRequest) (*Run, error)
+	// CancelRun cancels a running run and returns it once it finished, or fails with DeadlineExceeded if the call
+	// times out first.
+	CancelRun(context.Context, *CancelRunRequest) (*Run, error)
+	// ApproveAction approves or rejects the action of a run awaiting approval.
+	ApproveAction(context.Context, *ApproveActionRequest) (*ApproveActionResponse, error)
+	// InjectHint gives the thinker of a run a hint before its next state.
+	InjectHint(context.Context, *InjectHintRequest) (*InjectHintResponse, error)
+	// WatchRun streams the events of a run from the one after after_id, the stream ends when the run finishes.
+	WatchRun(*WatchRunRequest, RunService_WatchRunServer) error
+	mustEmbedUnimplementedRunServiceServer()
+}
+
+// UnimplementedRunServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedRunServiceServer struct {
+}
+
+func (UnimplementedRunServiceServer) CreateRun(context.Context, *CreateRunRequest) (*Run, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateRun not implemented")
+}
+func (UnimplementedRunServiceServer) GetRun(context.Context, *GetRunRequest) (*Run, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRun not implemented")
+}
+func (UnimplementedRunServiceServer) CancelRun(context.Context, *CancelRunRequest) (*Run, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelRun not implemented")
+}
+func (UnimplementedRunServiceServer) ApproveAction(context.Context, *ApproveActionRequest) (*ApproveActionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ApproveAction not implemented")
+}
+func (UnimplementedRunServiceServer) InjectHint(context.Context, *InjectHintRequest) (*InjectHintResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method InjectHint not implemented")
+}
+func (UnimplementedRunServiceServer) WatchRun(*WatchRunRequest, RunService_WatchRunServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchRun not implemented")
+}
+func (UnimplementedRunServiceServer) mustEmbedUnimplementedRunServiceServer() {}
+
+// UnsafeRunServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RunServiceServer will
+// result in compilation errors.
+type UnsafeRunServiceServer interface {
+	mustEmbedUnimplementedRunServiceServer()
+}
+
+func RegisterRunServiceServer(s grpc.ServiceRegistrar, srv RunServiceServer) {
+	s.RegisterService(&RunService_ServiceDesc, srv)
+}
+
+func _RunService_CreateRun_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateRunRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RunServiceServer).CreateRun(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RunService_CreateRun_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RunServiceServer).CreateRun(ctx, req.(*CreateRunRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RunService_GetRun_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRunRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RunServiceServer).GetRun(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RunService_GetRun_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RunServiceServer).GetRun(ctx, req.(*GetRunRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RunService_CancelRun_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelRunRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RunServiceServer).CancelRun(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RunService_CancelRun_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RunServiceServer).CancelRun(ctx, req.(*CancelRunRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RunService_ApproveAction_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ApproveActionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RunServiceServer).ApproveAction(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RunService_ApproveAction_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RunServiceServer).ApproveAction(ctx, req.(*ApproveActionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RunService_InjectHint_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InjectHintRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RunServiceServer).InjectHint(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RunService_InjectHint_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RunServiceServer).InjectHint(ctx, req.(*InjectHintRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RunService_WatchRun_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRunRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RunServiceServer).WatchRun(m, &runServiceWatchRunServer{stream})
+}
+
+type RunService_WatchRunServer interface {
+	Send(*RunEvent) error
+	grpc.ServerStream
+}
+
+type runServiceWatchRunServer struct {
+	grpc.ServerStream
+}
+
+func (x *runServiceWatchRunServer) Send(m *RunEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// RunService_ServiceDesc is the grpc.ServiceDesc for RunService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var RunService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "flowgpt.v1.RunService",
+	HandlerType: (*RunServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CreateRun",
+			Handler:    _RunService_CreateRun_Handler,
+		},
+		{
+			MethodName: "GetRun",
+			Handler:    _RunService_GetRun_Handler,
+		},
+		{
+			MethodName: "CancelRun",
+			Handler:    _RunService_CancelRun_Handler,
+		},
+		{
+			MethodName: "ApproveAction",
+			Handler:    _RunService_ApproveAction_Handler,
+		},
+		{
+			MethodName: "InjectHint",
+			Handler:    _RunService_InjectHint_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchRun",
+			Handler:       _RunService_WatchRun_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/flowgpt/v1/flowgpt.proto",
+}
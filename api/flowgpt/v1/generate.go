@@ -0,0 +1,5 @@
+// Package flowgptv1 holds the protobuf messages and the gRPC service of the run control API, generated from
+// flowgpt.proto.
+package flowgptv1
+
+//go:generate protoc -I ../../.. --go_out=../../.. --go_opt=paths=source_relative --go-grpc_out=../../.. --go-grpc_opt=paths=source_relative api/flowgpt/v1/flowgpt.proto
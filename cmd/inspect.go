@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	fsm2 "flow-gpt/internal/fsm"
+	"flow-gpt/internal/store"
+)
+
+const inspectUsage = `usage: flow-gpt inspect [-json] [-db path] CHECKPOINT|RUN_ID
+
+Prints a checkpoint file written by -checkpoint, or the transcript of a run stored in the database.`
+
+// inspectCommand prints a checkpoint or the transcript of a stored run.
+func inspectCommand(args []string) error {
+	var raw bool
+	cfg, fs, err := loadConfig("inspect", args, inspectUsage, func(fs *flag.FlagSet) {
+		fs.BoolVar(&raw, "json", false, "print JSON instead of text")
+	})
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError{fmt.Errorf("expected a checkpoint or a run id\n%s", inspectUsage)}
+	}
+
+	if b, err := os.ReadFile(fs.Arg(0)); err == nil {
+		var c fsm2.Checkpoint
+		if err = json.Unmarshal(b, &c); err != nil {
+			return fmt.Errorf("failed to parse checkpoint: %w", err)
+		}
+		if raw {
+			return printJSON(c)
+		}
+		return printCheckpoint(os.Stdout, c)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	db, err := store.Open(cfg.Storage.DB, func(o *store.Options) {
+		o.ReadOnly = true
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	run, err := db.Get(fs.Arg(0))
+	if errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("%s is neither a checkpoint file nor a stored run", fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	events, err := db.Events(run.ID)
+	if err != nil {
+		return err
+	}
+	if raw {
+		return printJSON(struct {
+			store.Run
+			Transcript []fsm2.Event `json:"transcript"`
+		}{run, events})
+	}
+	return printTranscript(os.Stdout, run, events)
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printCheckpoint(w io.Writer, c fsm2.Checkpoint) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "problem:\t%s\n", c.Problem)
+	fmt.Fprintf(tw, "state:\t%s\n", c.State)
+	fmt.Fprintf(tw, "turn:\t%d\n", c.Turn)
+	fmt.Fprintf(tw, "tokens:\t%d\n", c.TokensUsed)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if c.Plan != nil {
+		fmt.Fprintln(w, "plan:")
+		printSubgoals(w, c.Plan.Subgoals, 1)
+	}
+	return nil
+}
+
+func printSubgoals(w io.Writer, subgoals []*fsm2.Subgoal, depth int) {
+	for _, s := range subgoals {
+		fmt.Fprintf(w, "%s[%s] %s %s\n", strings.Repeat("  ", depth), s.Status, s.ID, s.Description)
+		printSubgoals(w, s.Subgoals, depth+1)
+	}
+}
+
+func printTranscript(w io.Writer, run store.Run, events []fsm2.Event) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "run:\t%s\n", run.ID)
+	fmt.Fprintf(tw, "problem:\t%s\n", run.Problem)
+	fmt.Fprintf(tw, "status:\t%s\n", run.Status)
+	if run.Error != "" {
+		fmt.Fprintf(tw, "error:\t%s\n", run.Error)
+	}
+	fmt.Fprintf(tw, "turns:\t%d\n", run.Turns)
+	fmt.Fprintf(tw, "tokens:\t%d\n", run.TokensUsed)
+	fmt.Fprintf(tw, "started:\t%s\n", run.StartedAt.Format(time.DateTime))
+	if run.FinishedAt != nil {
+		fmt.Fprintf(tw, "finished:\t%s\n", run.FinishedAt.Format(time.DateTime))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	for _, e := range events {
+		fmt.Fprintf(w, "%s turn %d %s: %s\n", e.Time.Format(time.TimeOnly), e.Turn, e.Type, describeEvent(e))
+	}
+	return nil
+}
+
+// describeEvent summarizes an event on one line.
+func describeEvent(e fsm2.Event) string {
+	var s string
+	switch e.Type {
+	case fsm2.EventTransition:
+		s = e.From + " -> " + e.State
+	case fsm2.EventChat:
+		s = fmt.Sprintf("%s %s, %d tokens in %s", e.Role, e.Model, e.Tokens, e.Duration.Round(time.Millisecond))
+	case fsm2.EventCritique:
+		s = e.Subject + " " + e.Content
+	case fsm2.EventAudit:
+		s = fmt.Sprintf("%d records", len(e.Audit))
+	case fsm2.EventRetry:
+		s = e.Role
+	case fsm2.EventFinish:
+		s = fmt.Sprintf("%d tokens", e.Tokens)
+	default:
+		s = strings.ReplaceAll(e.Content, "\n", " ")
+	}
+	if e.Error != "" {
+		s += " error: " + e.Error
+	}
+	return s
+}
@@ -1,54 +1,168 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"flag"
-	"log"
-	"net/http"
-	"os/signal"
-	"syscall"
+	"fmt"
+	"os"
+	"strings"
 
+	"flow-gpt/internal/cassette"
+	"flow-gpt/internal/config"
 	fsm2 "flow-gpt/internal/fsm"
-	"flow-gpt/internal/logger"
-	zLog "github.com/rs/zerolog/log"
 )
 
-const (
-	LogLevel = "debug"
-)
+const usage = `usage: flow-gpt COMMAND [flags] [args]
+
+commands:
+  run      solve a problem headless, printing its events to stdout as JSON lines
+  serve    serve runs over HTTP and websockets, started by POST /api/runs
+  replay   solve the problem of a recorded cassette headless
+  inspect  print a checkpoint file or the transcript of a stored run
+  tui      watch and steer a run of a server in the terminal
+  runs     list, search and show the stored runs
+  token    sign a session token accepted by the server
+  config   print the effective settings
+
+Without a command flow-gpt serves, solving the problem given by -problem.
+Run flow-gpt COMMAND -h for the flags of a command.`
+
+// usageError is returned by commands invoked wrongly, flow-gpt exits with status 2 for them.
+type usageError struct {
+	err error
+}
+
+func (e usageError) Error() string {
+	return e.err.Error()
+}
+
+func (e usageError) Unwrap() error {
+	return e.err
+}
 
 func main() {
-	problemFlag := flag.String("problem", "", "problem")
-	flag.Parse()
+	os.Exit(execute(os.Args[1:]))
+}
 
-	log.Println("starting application...")
-	err := logger.NewGlobal(LogLevel, false)
-	if err != nil {
-		log.Panicf("failed to initialize logger: %v", err)
+// execute runs the command of args and returns the exit status: 0 on success, 1 when the command failed and 2 when it
+// was invoked wrongly.
+func execute(args []string) int {
+	command, rest := "", args
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, rest = args[0], args[1:]
+	}
+	var err error
+	switch command {
+	case "":
+		err = serveCommand(rest)
+	case "run":
+		err = runCommand(rest)
+	case "serve":
+		err = serveCommand(rest)
+	case "replay":
+		err = replayCommand(rest)
+	case "inspect":
+		err = inspectCommand(rest)
+	case "tui":
+		err = tuiCommand(rest)
+	case "runs":
+		err = runsCommand(rest)
+	case "token":
+		err = tokenCommand(rest)
+	case "config":
+		err = configCommand(rest)
+	case "help":
+		fmt.Println(usage)
+	default:
+		err = usageError{fmt.Errorf("unknown command %q\n%s", command, usage)}
 	}
 
-	fsm, err := fsm2.New(*problemFlag, 0)
-	if err != nil {
-		zLog.Fatal().Err(err).Msg("failed to initialize FSM")
+	var uErr usageError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.As(err, &uErr):
+		fmt.Fprintln(os.Stderr, "flow-gpt:", err)
+		return 2
+	default:
+		fmt.Fprintln(os.Stderr, "flow-gpt:", err)
+		return 1
 	}
+}
 
-	http.HandleFunc("/ws", fsm.Handler)
-	go func() {
-		zLog.Fatal().Err(http.ListenAndServe(":8080", nil)).Msg("failed to start server")
-	}()
+// loadConfig loads the settings of a command, printing its usage line for -h. Invalid flags and settings are usage
+// errors.
+func loadConfig(name string, args []string, commandUsage string, flagFns ...func(fs *flag.FlagSet)) (config.Config, *flag.FlagSet, error) {
+	cfg, fs, err := config.Load(name, args, flagFns...)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(fs.Output(), commandUsage)
+		return cfg, fs, err
+	}
+	if err != nil {
+		return cfg, fs, usageError{err}
+	}
+	return cfg, fs, nil
+}
 
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
+// loadCassette returns the cassette the settings record to or replay from, if any.
+func loadCassette(cfg config.Config) (*cassette.Cassette, error) {
+	switch {
+	case cfg.Run.Replay != "":
+		tape, err := cassette.Load(cfg.Run.Replay)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load cassette: %w", err)
+		}
+		return tape, nil
+	case cfg.Run.Record != "":
+		return cassette.New(cfg.Run.Record), nil
+	}
+	return nil, nil
+}
 
-	go func() {
-		fsm.Process(ctx)
-	}()
+// applyConfig sets the FSM options of the settings.
+func applyConfig(o *fsm2.Options, cfg config.Config) {
+	o.Plan = cfg.Run.Plan
+	o.Candidates = cfg.Run.Candidates
+	o.BacktrackAfter = cfg.Run.Backtrack
+	o.RequireApproval = cfg.Run.Approve
+	o.ModelName = cfg.Model.Name
+	o.Temperature = cfg.Model.Temperature
+	o.ChatTimeout = cfg.Timeouts.Chat
+	o.AgentTimeout = cfg.Timeouts.Agent
+	o.NoBrowser = !cfg.Tools.Browser
+	o.NoTerminal = !cfg.Tools.Terminal
+	o.NoGit = !cfg.Tools.Git
+	o.MaxTurns = cfg.Limits.MaxTurns
+	o.MaxTokens = cfg.Limits.MaxTokens
+	o.MaxRetries = cfg.Limits.MaxRetries
+	o.MaxParallelActions = cfg.Limits.MaxParallelActions
+	if cfg.Run.SkipCritic {
+		g := fsm2.DefaultGraph()
+		g.Register(fsm2.StateName(fsm2.JudgeThought{}), fsm2.StateDef{
+			Handler:     fsm2.On(fsm2.AcceptThought),
+			Transitions: []string{fsm2.StateName(fsm2.ThoughtDecider{})},
+		})
+		g.Register(fsm2.StateName(fsm2.JudgeAction{}), fsm2.StateDef{
+			Handler:     fsm2.On(fsm2.AcceptAction),
+			Transitions: []string{fsm2.StateName(fsm2.Next{})},
+		})
+		o.Graph = g
+	}
+}
 
-	<-ctx.Done()
-	err = fsm.Browser.Close()
+// configCommand prints the effective settings.
+func configCommand(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return usageError{errors.New("usage: flow-gpt config print [-config file] [flags]")}
+	}
+	cfg, _, err := loadConfig("config print", args[1:], "usage: flow-gpt config print [-config file] [flags]")
 	if err != nil {
-		zLog.Error().Msgf("failed to close browser: %v", err)
+		return err
 	}
-
-	zLog.Info().Msg("shutting down application")
+	out, err := cfg.Redacted().YAML()
+	if err != nil {
+		return err
+	}
+	fmt.Print(out)
+	return nil
 }
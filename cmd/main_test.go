@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"flow-gpt/internal/auth"
+	"flow-gpt/internal/config"
+	fsm2 "flow-gpt/internal/fsm"
+)
+
+func TestLoadConfig(t *testing.T) {
+	discard := func(fs *flag.FlagSet) {
+		fs.SetOutput(io.Discard)
+	}
+	tests := []struct {
+		name  string
+		args  []string
+		err   string
+		usage bool
+		help  bool
+	}{
+		{name: "valid", args: []string{"-limits.maxTurns", "3", "list"}},
+		{name: "help", args: []string{"-h"}, help: true},
+		{name: "unknown flag", args: []string{"-nope"}, err: "flag provided but not defined", usage: true},
+		{name: "invalid value", args: []string{"-limits.maxTurns", "many"}, err: "invalid value", usage: true},
+		{name: "invalid setting", args: []string{"-candidates", "0"}, err: "run.candidates must be at least 1", usage: true},
+		{name: "conflicting settings", args: []string{"-record", "a.json", "-replay", "b.json"}, err: "can't be used together", usage: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, fs, err := loadConfig("test", tt.args, "usage: test", discard)
+			if tt.help {
+				if !errors.Is(err, flag.ErrHelp) {
+					t.Fatalf("expected flag.ErrHelp, got %v", err)
+				}
+				return
+			}
+			if tt.err == "" {
+				if err != nil || fs.Arg(0) != "list" {
+					t.Fatalf("unexpected error %v, arguments %v", err, fs.Args())
+				}
+				return
+			}
+			var uErr usageError
+			if err == nil || !strings.Contains(err.Error(), tt.err) || errors.As(err, &uErr) != tt.usage {
+				t.Fatalf("expected a usage error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	for path, want := range map[string]bool{
+		"/":              true,
+		"/index.html":    true,
+		"/assets/app.js": true,
+		"/api/runs":      false,
+		"/api/events":    false,
+		"/ws":            false,
+		"/metrics":       false,
+		"/runs":          false,
+		"/runs/run-1":    false,
+	} {
+		if got := isPublic(httptest.NewRequest("GET", path, nil)); got != want {
+			t.Errorf("isPublic(%s) = %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	tests := []struct {
+		name   string
+		server config.Server
+		// tokens are the tokens expected to be accepted with their permission
+		tokens  map[string]auth.Permission
+		enabled bool
+		err     string
+		usage   bool
+	}{
+		{name: "no tokens"},
+		{
+			name:    "static tokens",
+			server:  config.Server{Tokens: []string{"read:viewer-token", "control:admin:token"}},
+			tokens:  map[string]auth.Permission{"viewer-token": auth.PermissionRead, "admin:token": auth.PermissionControl},
+			enabled: true,
+		},
+		{
+			name:    "session secret",
+			server:  config.Server{TokenSecret: strings.Repeat("s", auth.MinSecretLength)},
+			enabled: true,
+		},
+		{name: "missing permission", server: config.Server{Tokens: []string{"viewer-token"}}, err: "PERMISSION:TOKEN", usage: true},
+		{name: "empty token", server: config.Server{Tokens: []string{"read:"}}, err: "PERMISSION:TOKEN", usage: true},
+		{name: "unknown permission", server: config.Server{Tokens: []string{"write:token"}}, err: "invalid server.tokens", usage: true},
+		{name: "short secret", server: config.Server{TokenSecret: "short"}, err: "the token secret must have at least"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newAuthenticator(tt.server)
+			if tt.err != "" {
+				var uErr usageError
+				if err == nil || !strings.Contains(err.Error(), tt.err) || errors.As(err, &uErr) != tt.usage {
+					t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Enabled() != tt.enabled {
+				t.Errorf("Enabled() = %v, want %v", a.Enabled(), tt.enabled)
+			}
+			for token, perm := range tt.tokens {
+				if id, err := a.Authenticate(token); err != nil || id.Permission != perm {
+					t.Errorf("token %q authenticated as %+v: %v", token, id, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNewFSMCleansUp(t *testing.T) {
+	a := &app{cfg: config.Default()}
+	a.cfg.Run.OutputDir = t.TempDir()
+	_, _, err := a.newFSM("do nothing", func(o *fsm2.Options) {
+		o.Graph = fsm2.DefaultGraph()
+		o.Graph.Remove(fsm2.StateName(fsm2.Complete{}))
+	})
+	if err == nil {
+		t.Fatal("expected an invalid graph to fail")
+	}
+	if entries, err := os.ReadDir(a.cfg.Run.OutputDir); err != nil || len(entries) != 0 {
+		t.Errorf("expected the directory of the run to be removed, got %v: %v", entries, err)
+	}
+}
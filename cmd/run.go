@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"flow-gpt/internal/cassette"
+	fsm2 "flow-gpt/internal/fsm"
+	zLog "github.com/rs/zerolog/log"
+)
+
+const runUsage = `usage: flow-gpt run [flags] [PROBLEM]
+
+Solves the problem, given as arguments or by -problem, and prints the events of the run to stdout as JSON lines.
+Exits with status 0 when the problem is solved and 1 when the run fails.`
+
+const replayUsage = `usage: flow-gpt replay [flags] CASSETTE
+
+Solves the problem of a recorded cassette again, answering model and tool calls from the recording, and prints the
+events of the run to stdout as JSON lines. -problem overrides the recorded problem.`
+
+// runCommand solves a problem headless.
+func runCommand(args []string) error {
+	cfg, fs, err := loadConfig("run", args, runUsage)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		cfg.Problem = strings.Join(fs.Args(), " ")
+	}
+	if strings.TrimSpace(cfg.Problem) == "" {
+		return usageError{fmt.Errorf("missing problem\n%s", runUsage)}
+	}
+	tape, err := loadCassette(cfg)
+	if err != nil {
+		return err
+	}
+	a, err := newApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	return a.headless(cfg.Problem, tape)
+}
+
+// replayCommand solves the problem of a cassette headless, replaying its interactions.
+func replayCommand(args []string) error {
+	cfg, fs, err := loadConfig("replay", args, replayUsage)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError{fmt.Errorf("expected a cassette\n%s", replayUsage)}
+	}
+	if cfg.Run.Record != "" {
+		return usageError{errors.New("run.record can't be used with replay")}
+	}
+	tape, err := cassette.Load(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to load cassette: %w", err)
+	}
+	problem := cfg.Problem
+	if problem == "" {
+		problem = tape.RecordedProblem()
+	}
+	if problem == "" {
+		return usageError{errors.New("the cassette doesn't record its problem, give it with -problem")}
+	}
+	cfg.Run.Replay = fs.Arg(0)
+	a, err := newApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	return a.headless(problem, tape)
+}
+
+// headless solves the problem until it is done or the process is interrupted, printing the events to stdout.
+func (a *app) headless(problem string, tape *cassette.Cassette) error {
+	if a.cfg.Run.Approve {
+		return usageError{errors.New("run.approve needs an operator, serve the run and approve its actions with flow-gpt tui")}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// observers are notified one at a time, so the lines don't interleave
+	enc := json.NewEncoder(os.Stdout)
+	printEvent := func(e fsm2.Event) {
+		if err := enc.Encode(e); err != nil {
+			zLog.Error().Err(err).Msg("failed to print event")
+		}
+	}
+	_, f, err := a.newFSM(problem, func(o *fsm2.Options) {
+		o.Cassette = tape
+		o.Observers = append(o.Observers, printEvent)
+	})
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go drain(f, done)
+	err = f.Process(ctx)
+	close(done)
+	if cErr := f.Close(); cErr != nil {
+		zLog.Error().Err(cErr).Msg("failed to close browser")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to process problem: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"flow-gpt/internal/store"
+)
+
+const runsUsage = `usage: flow-gpt runs [-db path] list
+       flow-gpt runs [-db path] search QUERY
+       flow-gpt runs [-db path] show ID`
+
+// runsCommand lists, searches and shows the runs stored in the database.
+func runsCommand(args []string) error {
+	cfg, fs, err := loadConfig("runs", args, runsUsage)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usageError{fmt.Errorf("missing runs command\n%s", runsUsage)}
+	}
+
+	db, err := store.Open(cfg.Storage.DB, func(o *store.Options) {
+		o.ReadOnly = true
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch fs.Arg(0) {
+	case "list":
+		runs, err := db.List()
+		if err != nil {
+			return err
+		}
+		return printRuns(runs)
+	case "search":
+		runs, err := db.Search(strings.Join(fs.Args()[1:], " "))
+		if err != nil {
+			return err
+		}
+		return printRuns(runs)
+	case "show":
+		if fs.NArg() < 2 {
+			return usageError{fmt.Errorf("missing run id\n%s", runsUsage)}
+		}
+		run, err := db.Get(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		events, err := db.Events(run.ID)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(run); err != nil {
+			return err
+		}
+		for _, e := range events {
+			if err = enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return usageError{fmt.Errorf("unknown runs command %q\n%s", fs.Arg(0), runsUsage)}
+	}
+}
+
+func printRuns(runs []store.Run) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTARTED\tSTATUS\tTURNS\tTOKENS\tPROBLEM")
+	for _, r := range runs {
+		problem := r.Problem
+		if len(problem) > 60 {
+			problem = problem[:57] + "..."
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n", r.ID, r.StartedAt.Format("2006-01-02 15:04:05"), r.Status, r.Turns, r.TokensUsed, problem)
+	}
+	return w.Flush()
+}
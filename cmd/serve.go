@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"flow-gpt/internal/auth"
+	"flow-gpt/internal/config"
+	fsm2 "flow-gpt/internal/fsm"
+	"flow-gpt/internal/metrics"
+	"flow-gpt/internal/server"
+	"flow-gpt/web"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	zLog "github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+const serveUsage = `usage: flow-gpt serve [flags] [PROBLEM]
+
+Serves runs until interrupted: / is the web UI, POST /api/runs starts a run, /ws streams one and /api/events streams it
+as server-sent events, /metrics exposes their metrics and /runs their stored transcripts. server.grpcAddr serves the
+RunService of api/flowgpt/v1 too. A problem given as arguments or by -problem is started at once, -record and -replay
+only apply to it.
+
+With server.tokens or server.tokenSecret set, every request but those of the web UI page needs a bearer token: read
+tokens can watch runs, control tokens can also start and steer them.`
+
+// ShutdownTimeout bounds the time the server waits for open requests when it stops.
+const ShutdownTimeout = 5 * time.Second
+
+// serveCommand serves runs over HTTP and websockets.
+func serveCommand(args []string) error {
+	cfg, fs, err := loadConfig("serve", args, serveUsage)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		cfg.Problem = strings.Join(fs.Args(), " ")
+	}
+	tape, err := loadCassette(cfg)
+	if err != nil {
+		return err
+	}
+	a, err := newApp(cfg)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	if a.cfg.Run.Checkpoint != "" {
+		zLog.Warn().Msg("run.checkpoint is ignored by serve, runs would overwrite each other's checkpoint")
+		a.cfg.Run.Checkpoint = ""
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	m := metrics.New(prometheus.DefaultRegisterer)
+	var tapeMu sync.Mutex
+	manager := server.NewManager(ctx, func(problem string, observer fsm2.Observer) (string, *fsm2.FSM, error) {
+		// the cassette belongs to the first run
+		tapeMu.Lock()
+		t := tape
+		tape = nil
+		tapeMu.Unlock()
+		return a.newFSM(problem, func(o *fsm2.Options) {
+			o.Cassette = t
+			o.Observers = append(o.Observers, m.Observe, observer)
+		})
+	})
+
+	authenticator, err := newAuthenticator(cfg.Server)
+	if err != nil {
+		return err
+	}
+	if !authenticator.Enabled() {
+		zLog.Warn().Msg("the server accepts requests without a token, set server.tokens or server.tokenSecret to require one")
+	}
+
+	mux := http.NewServeMux()
+	api := server.New(manager, func(o *server.Options) {
+		o.CheckOrigin = authenticator.CheckOrigin
+	}).Handler()
+	mux.Handle("/api/", api)
+	mux.Handle("/ws", api)
+	mux.Handle("/", web.Handler())
+	mux.Handle("/metrics", promhttp.Handler())
+	if a.db != nil {
+		mux.Handle("/runs", a.db.Handler())
+		mux.Handle("/runs/", a.db.Handler())
+	}
+	srv := &http.Server{Addr: cfg.Server.Addr, Handler: authenticator.Middleware(mux, isPublic)}
+	serveErr := make(chan error, 2)
+	go func() {
+		if cfg.Server.TLSCert != "" {
+			serveErr <- srv.ListenAndServeTLS(cfg.Server.TLSCert, cfg.Server.TLSKey)
+		} else {
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+	zLog.Info().Str("addr", cfg.Server.Addr).Bool("tls", cfg.Server.TLSCert != "").Msg("serving runs")
+
+	var grpcServer *grpc.Server
+	// abort stops the servers already running when serving fails to start
+	abort := func(err error) error {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		if sErr := srv.Shutdown(shutdownCtx); sErr != nil && !errors.Is(sErr, http.ErrServerClosed) {
+			zLog.Error().Err(sErr).Msg("failed to shut down server")
+		}
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+		return err
+	}
+	if cfg.Server.GRPCAddr != "" {
+		lis, err := net.Listen("tcp", cfg.Server.GRPCAddr)
+		if err != nil {
+			return abort(fmt.Errorf("failed to listen for gRPC: %w", err))
+		}
+		var serverOpts []grpc.ServerOption
+		if cfg.Server.TLSCert != "" {
+			creds, err := credentials.NewServerTLSFromFile(cfg.Server.TLSCert, cfg.Server.TLSKey)
+			if err != nil {
+				lis.Close()
+				return abort(fmt.Errorf("failed to load TLS certificate: %w", err))
+			}
+			serverOpts = append(serverOpts, grpc.Creds(creds))
+		}
+		grpcServer = server.NewGRPC(manager, func(o *server.GRPCOptions) {
+			o.Authenticator = authenticator
+			o.ServerOptions = serverOpts
+		})
+		go func() {
+			if err := grpcServer.Serve(lis); err != nil {
+				serveErr <- fmt.Errorf("failed to serve gRPC: %w", err)
+			}
+		}()
+		zLog.Info().Str("addr", cfg.Server.GRPCAddr).Msg("serving gRPC")
+	}
+
+	if strings.TrimSpace(cfg.Problem) != "" {
+		if _, err = manager.Start(cfg.Problem); err != nil {
+			return abort(err)
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		err = nil
+	case err = <-serveErr:
+		stop()
+	}
+	zLog.Info().Msg("shutting down application")
+	manager.Wait()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if sErr := srv.Shutdown(shutdownCtx); sErr != nil && !errors.Is(sErr, http.ErrServerClosed) {
+		zLog.Error().Err(sErr).Msg("failed to shut down server")
+	}
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			grpcServer.Stop()
+		}
+	}
+	return err
+}
+
+func newAuthenticator(s config.Server) (*auth.Authenticator, error) {
+	tokens, err := auth.ParseTokens(s.Tokens)
+	if err != nil {
+		return nil, usageError{fmt.Errorf("invalid server.tokens: %w", err)}
+	}
+	return auth.New(func(o *auth.Options) {
+		o.Tokens = tokens
+		o.Secret = []byte(s.TokenSecret)
+		o.Origins = s.Origins
+	})
+}
+
+// isPublic reports whether a request is for the page of the web UI, which asks for a token itself.
+func isPublic(r *http.Request) bool {
+	for _, prefix := range []string{"/api/", "/ws", "/metrics", "/runs"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"flow-gpt/internal/config"
+	fsm2 "flow-gpt/internal/fsm"
+	"flow-gpt/internal/logger"
+	"flow-gpt/internal/redact"
+	"flow-gpt/internal/report"
+	"flow-gpt/internal/secret"
+	"flow-gpt/internal/store"
+	"flow-gpt/internal/telemetry"
+	"flow-gpt/internal/webhook"
+	"flow-gpt/internal/workspace"
+	"github.com/google/uuid"
+	zLog "github.com/rs/zerolog/log"
+)
+
+// app holds what the runs of a command share: secrets, redaction, logging, tracing, the audit log, the database and
+// the webhooks.
+type app struct {
+	cfg      config.Config
+	vault    *secret.Vault
+	redactor *redact.Redactor
+	auditLog *os.File
+	db       *store.Store
+	notifier *webhook.Notifier
+	closers  []func()
+}
+
+// WebhookDrainTimeout bounds the time spent delivering the queued webhooks when a command ends.
+const WebhookDrainTimeout = 10 * time.Second
+
+func newApp(cfg config.Config) (*app, error) {
+	a := &app{cfg: cfg}
+	var err error
+	a.vault, err = secret.Load(func(o *secret.Options) {
+		o.File = cfg.Tools.SecretsFile
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load secrets: %w", err)
+	}
+	a.redactor, err = redact.New(func(o *redact.Options) {
+		o.Patterns = cfg.Redact.Patterns
+		o.Values = append(envValues(append([]string{"OPENAI_API_KEY"}, cfg.Redact.Env...)), a.vault.Values()...)
+		o.Values = append(o.Values, serverSecrets(cfg.Server)...)
+		o.Values = append(o.Values, cfg.Webhooks.Secret)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize redaction: %w", err)
+	}
+	err = logger.NewGlobal(cfg.Log.Level, cfg.Log.Pretty, a.redactor.Writer(os.Stderr))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize logger: %w", err)
+	}
+
+	if cfg.Trace.Exporter != "" {
+		shutdown, err := telemetry.Setup(context.Background(), func(o *telemetry.Options) {
+			o.Exporter = cfg.Trace.Exporter
+			o.File = cfg.Trace.File
+		})
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("failed to set up tracing: %w", err)
+		}
+		a.closers = append(a.closers, func() {
+			if err := shutdown(context.Background()); err != nil {
+				zLog.Error().Err(err).Msg("failed to flush traces")
+			}
+		})
+	}
+
+	if cfg.Log.AuditLog != "" {
+		a.auditLog, err = os.OpenFile(cfg.Log.AuditLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		a.closers = append(a.closers, func() { a.auditLog.Close() })
+	}
+
+	if cfg.Storage.DB != "" {
+		a.db, err = store.Open(cfg.Storage.DB)
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("failed to open database: %w", err)
+		}
+		a.closers = append(a.closers, func() { a.db.Close() })
+	}
+
+	if len(cfg.Webhooks.URLs) > 0 {
+		var log *os.File
+		if cfg.Webhooks.Log != "" {
+			log, err = os.OpenFile(cfg.Webhooks.Log, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				a.Close()
+				return nil, fmt.Errorf("failed to open webhook delivery log: %w", err)
+			}
+		}
+		a.notifier = webhook.New(func(o *webhook.Options) {
+			o.URLs = cfg.Webhooks.URLs
+			o.Secret = []byte(cfg.Webhooks.Secret)
+			o.Types = cfg.Webhooks.Events
+			o.MaxRetries = cfg.Webhooks.MaxRetries
+			if log != nil {
+				o.Log = log
+			}
+		})
+		a.closers = append(a.closers, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), WebhookDrainTimeout)
+			defer cancel()
+			a.notifier.Close(ctx)
+			if log != nil {
+				log.Close()
+			}
+		})
+	}
+	return a, nil
+}
+
+// Close releases the shared resources in reverse order.
+func (a *app) Close() {
+	for i := len(a.closers) - 1; i >= 0; i-- {
+		a.closers[i]()
+	}
+	a.closers = nil
+}
+
+// newFSM creates the FSM of a run of the problem, stored in the database if there is one. It returns the id of the
+// run, the id of the stored run if there is a database.
+func (a *app) newFSM(problem string, optFns ...func(o *fsm2.Options)) (string, *fsm2.FSM, error) {
+	id := uuid.NewString()
+	var observers []fsm2.Observer
+	if a.db != nil {
+		run, err := a.db.Create(problem, a.cfg.Map())
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to store run: %w", err)
+		}
+		id = run.ID
+		observers = append(observers, a.db.Observer(id))
+		zLog.Info().Str("run", id).Msg("storing run")
+	}
+	if a.notifier != nil {
+		observers = append(observers, a.notifier.Observer(id, problem))
+	}
+	var ws *workspace.Workspace
+	if a.cfg.Run.OutputDir != "" {
+		var err error
+		if ws, err = a.newWorkspace(id); err != nil {
+			return "", nil, err
+		}
+		observers = append(observers, ws.Observer(), report.Observer(id, ws.Root, ws))
+	}
+
+	var f *fsm2.FSM
+	if a.cfg.Run.Checkpoint != "" {
+		observers = append(observers, checkpointObserver(a.cfg.Run.Checkpoint, &f))
+	}
+	f, err := fsm2.New(problem, 0, func(o *fsm2.Options) {
+		applyConfig(o, a.cfg)
+		o.Redactor = a.redactor
+		o.Secrets = a.vault
+		if a.auditLog != nil {
+			o.AuditWriter = a.auditLog
+		}
+		if ws != nil {
+			o.Workspace, o.DiffBase = ws.Dir, ws.Base
+		}
+		o.Observers = append(o.Observers, observers...)
+		for _, fn := range optFns {
+			fn(o)
+		}
+	})
+	if err != nil {
+		if ws != nil {
+			// the run never starts, so nothing of its directory is worth keeping
+			if rmErr := os.RemoveAll(ws.Root); rmErr != nil {
+				zLog.Error().Err(rmErr).Str("run", id).Msg("failed to remove the directory of the run")
+			}
+		}
+		return "", nil, fmt.Errorf("failed to initialize FSM: %w", err)
+	}
+	return id, f, nil
+}
+
+// newWorkspace removes the outputs of the runs the retention policy doesn't keep and creates the workspace of a run
+// in the output directory.
+func (a *app) newWorkspace(id string) (*workspace.Workspace, error) {
+	root, err := filepath.Abs(a.cfg.Run.OutputDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve output directory: %w", err)
+	}
+	removed, err := workspace.Clean(root, workspace.Retention{MaxAge: a.cfg.Workspace.MaxAge, MaxRuns: a.cfg.Workspace.MaxRuns})
+	if err != nil {
+		zLog.Error().Err(err).Msg("failed to remove the outputs of old runs")
+	}
+	if len(removed) > 0 {
+		zLog.Info().Strs("runs", removed).Msg("removed the outputs of old runs")
+	}
+	ws, err := workspace.Create(context.Background(), id, filepath.Join(root, id), func(o *workspace.Options) {
+		o.Template = a.cfg.Workspace.Template
+		o.Repo = a.cfg.Workspace.Repo
+		o.Ref = a.cfg.Workspace.Ref
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace: %w", err)
+	}
+	zLog.Info().Str("run", id).Str("workspace", ws.Dir).Str("branch", ws.Branch).Msg("created workspace")
+	return ws, nil
+}
+
+// checkpointObserver writes the checkpoint of the run to path after every transition and when the run finishes.
+// Both are notified by the state loop, so the checkpoint is read while the FSM isn't changing.
+func checkpointObserver(path string, f **fsm2.FSM) fsm2.Observer {
+	return func(e fsm2.Event) {
+		if *f == nil || (e.Type != fsm2.EventTransition && e.Type != fsm2.EventFinish) {
+			return
+		}
+		b, err := json.MarshalIndent((*f).Checkpoint(), "", "  ")
+		if err == nil {
+			err = os.WriteFile(path, b, 0644)
+		}
+		if err != nil {
+			zLog.Error().Err(err).Msg("failed to write checkpoint")
+		}
+	}
+}
+
+// drain receives the messages of the run until done is closed, they are also notified as events.
+func drain(f *fsm2.FSM, done <-chan struct{}) {
+	for {
+		select {
+		case <-f.Stream():
+		case <-done:
+			return
+		}
+	}
+}
+
+// envValues returns the values of the set environment variables.
+func envValues(names []string) []string {
+	var values []string
+	for _, n := range names {
+		if v := os.Getenv(n); n != "" && v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// serverSecrets returns the tokens and the token secret of the server, which must not show up in logs.
+func serverSecrets(s config.Server) []string {
+	values := []string{s.TokenSecret}
+	for _, t := range s.Tokens {
+		if _, token, ok := strings.Cut(t, ":"); ok {
+			values = append(values, token)
+		}
+	}
+	return values
+}
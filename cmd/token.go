@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"flow-gpt/internal/auth"
+)
+
+const tokenUsage = `usage: flow-gpt token [-permission read|control] [-ttl DURATION] [-subject NAME]
+
+Prints a session token signed with server.tokenSecret, which the server accepts until it expires.`
+
+// tokenCommand mints a session token of the server.
+func tokenCommand(args []string) error {
+	var permission, subject string
+	var ttl time.Duration
+	cfg, fs, err := loadConfig("token", args, tokenUsage, func(fs *flag.FlagSet) {
+		fs.StringVar(&permission, "permission", string(auth.PermissionRead), "permission of the token, read or control")
+		fs.DurationVar(&ttl, "ttl", 24*time.Hour, "time until the token expires, 0 never expires")
+		fs.StringVar(&subject, "subject", "operator", "who the token is issued to, logged when it is denied")
+	})
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError{fmt.Errorf("unexpected arguments\n%s", tokenUsage)}
+	}
+	perm, err := auth.ParsePermission(permission)
+	if err != nil {
+		return usageError{err}
+	}
+	if cfg.Server.TokenSecret == "" {
+		return usageError{errors.New("server.tokenSecret must be set to sign tokens")}
+	}
+	authenticator, err := newAuthenticator(cfg.Server)
+	if err != nil {
+		return err
+	}
+	token, err := authenticator.Sign(subject, perm, ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
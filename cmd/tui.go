@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"flow-gpt/internal/config"
+	"flow-gpt/internal/tui"
+)
+
+const tuiUsage = `usage: flow-gpt tui [-url URL] [-token TOKEN] [RUN_ID]
+
+Shows a run of a flow-gpt server, the latest one if no id is given, grouped by turn. Keys: p pauses or resumes the
+run, a approves the action awaiting approval (see -approve), x rejects it, h gives the thinker a hint, l expands the
+audit logs, ↑/↓ scroll and q quits.`
+
+// TokenEnv is the token of the server when the -token flag isn't given.
+const TokenEnv = config.EnvPrefix + "TOKEN"
+
+// tuiCommand shows a run of a server in the terminal.
+func tuiCommand(args []string) error {
+	var serverURL, token string
+	cfg, fs, err := loadConfig("tui", args, tuiUsage, func(fs *flag.FlagSet) {
+		fs.StringVar(&serverURL, "url", "", "url of the server, defaults to the one listening on server.addr")
+		fs.StringVar(&token, "token", os.Getenv(TokenEnv), "token of the server, a control token is needed to steer the run")
+	})
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return usageError{fmt.Errorf("expected at most one run id\n%s", tuiUsage)}
+	}
+	if serverURL == "" {
+		scheme := "http://"
+		if cfg.Server.TLSCert != "" {
+			scheme = "https://"
+		}
+		serverURL = scheme + cfg.Server.Addr
+		if strings.HasPrefix(cfg.Server.Addr, ":") {
+			serverURL = scheme + "localhost" + cfg.Server.Addr
+		}
+	}
+	client, err := tui.NewClient(serverURL, func(o *tui.ClientOptions) {
+		o.Token = token
+	})
+	if err != nil {
+		return usageError{err}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM)
+	defer stop()
+	return tui.Run(ctx, client, fs.Arg(0))
+}
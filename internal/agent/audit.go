@@ -3,27 +3,126 @@ package agent
 import (
 	"context"
 	"fmt"
-	"strings"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/hupe1980/golc/schema"
 )
 
+type RecordKind string
+
+const (
+	RecordAgentAction RecordKind = "agent_action"
+	RecordAgentFinish RecordKind = "agent_finish"
+	RecordToolStart   RecordKind = "tool_start"
+	RecordToolEnd     RecordKind = "tool_end"
+	RecordToolError   RecordKind = "tool_error"
+	RecordLLMStart    RecordKind = "llm_start"
+	RecordLLMEnd      RecordKind = "llm_end"
+	RecordLLMError    RecordKind = "llm_error"
+	RecordText        RecordKind = "text"
+)
+
+type TokenUsage struct {
+	Prompt     int `json:"prompt"`
+	Completion int `json:"completion"`
+	Total      int `json:"total"`
+}
+
+// Record is a typed entry of the audit log. End and error records carry the duration since the matching start.
+//
+// Records form a tree of spans: an agent step is a child of the agent run, a tool call is a child of the agent step
+// which invoked it and a model call is a child of the agent run. Start, end and error records of a call share its span.
+type Record struct {
+	Seq      int           `json:"seq"`
+	Kind     RecordKind    `json:"kind"`
+	Time     time.Time     `json:"time"`
+	SpanID   string        `json:"spanId"`
+	ParentID string        `json:"parentId,omitempty"`
+	RunID    string        `json:"runId,omitempty"`
+	Tool     string        `json:"tool,omitempty"`
+	Model    string        `json:"model,omitempty"`
+	Input    string        `json:"input,omitempty"`
+	Output   string        `json:"output,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Log      string        `json:"log,omitempty"`
+	Tokens   *TokenUsage   `json:"tokens,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// Sink receives each record as it is captured. Sinks are called in record order while the audit log is locked, so
+// they must not call back into it.
+type Sink func(record Record)
+
+type start struct {
+	time   time.Time
+	name   string
+	parent string
+}
+
+// CallbackAuditLog captures the callbacks of an agent run as records. It is safe for concurrent use.
 type CallbackAuditLog struct {
-	audit []string
+	mu      sync.Mutex
+	records []Record
+	starts  map[string]start
+	sinks   []Sink
+	root    string
+	step    string
 }
 
-func NewCallbackAuditLog() *CallbackAuditLog {
+func NewCallbackAuditLog(sinks ...Sink) *CallbackAuditLog {
 	return &CallbackAuditLog{
-		audit: []string{},
+		records: []Record{},
+		starts:  map[string]start{},
+		sinks:   sinks,
 	}
 }
 
+// Subscribe adds a sink which receives every record captured from now on.
+func (mc *CallbackAuditLog) Subscribe(sink Sink) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.sinks = append(mc.sinks, sink)
+}
+
+// Records returns a copy of the records captured so far.
+func (mc *CallbackAuditLog) Records() []Record {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return append([]Record(nil), mc.records...)
+}
+
+// AuditLog renders the records as the text given to the critic.
 func (mc *CallbackAuditLog) AuditLog() string {
-	for i, str := range mc.audit {
-		mc.audit[i] = fmt.Sprintf("[LOG-%d] %s", i, str)
+	return PromptText(mc.Records())
+}
+
+// append stores the record and hands it to the sinks, mc.mu must be held.
+func (mc *CallbackAuditLog) append(r Record) {
+	r.Seq = len(mc.records)
+	if r.Time.IsZero() {
+		r.Time = time.Now()
 	}
+	mc.records = append(mc.records, r)
+	for _, sink := range mc.sinks {
+		sink(r)
+	}
+}
 
-	return strings.Join(mc.audit, "\n")
+// begin remembers the start of a call, mc.mu must be held.
+func (mc *CallbackAuditLog) begin(runID, name, parent string) {
+	mc.starts[runID] = start{time: time.Now(), name: name, parent: parent}
+}
+
+// end returns the start of a call, mc.mu must be held.
+func (mc *CallbackAuditLog) end(runID string) (start, time.Duration) {
+	s, ok := mc.starts[runID]
+	if !ok {
+		return start{parent: mc.root}, 0
+	}
+	delete(mc.starts, runID)
+	return s, time.Since(s.time)
 }
 
 func (mc *CallbackAuditLog) AlwaysVerbose() bool {
@@ -35,10 +134,18 @@ func (mc *CallbackAuditLog) RaiseError() bool {
 }
 
 func (mc *CallbackAuditLog) OnLLMStart(ctx context.Context, input *schema.LLMStartInput) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.begin(input.RunID, input.LLMType, mc.root)
+	mc.append(Record{Kind: RecordLLMStart, SpanID: input.RunID, ParentID: mc.root, RunID: input.RunID, Model: input.LLMType})
 	return nil
 }
 
 func (mc *CallbackAuditLog) OnChatModelStart(ctx context.Context, input *schema.ChatModelStartInput) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.begin(input.RunID, input.ChatModelType, mc.root)
+	mc.append(Record{Kind: RecordLLMStart, SpanID: input.RunID, ParentID: mc.root, RunID: input.RunID, Model: input.ChatModelType})
 	return nil
 }
 
@@ -47,14 +154,40 @@ func (mc *CallbackAuditLog) OnModelNewToken(ctx context.Context, input *schema.M
 }
 
 func (mc *CallbackAuditLog) OnModelEnd(ctx context.Context, input *schema.ModelEndInput) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	s, d := mc.end(input.RunID)
+	r := Record{Kind: RecordLLMEnd, SpanID: input.RunID, ParentID: s.parent, RunID: input.RunID, Model: s.name, Duration: d}
+	if input.Result != nil {
+		if m, ok := input.Result.LLMOutput["ModelName"].(string); ok {
+			r.Model = m
+		}
+		if usage, ok := input.Result.LLMOutput["TokenUsage"].(map[string]int); ok {
+			r.Tokens = &TokenUsage{
+				Prompt:     usage["PromptTokens"],
+				Completion: usage["CompletionTokens"],
+				Total:      usage["TotalTokens"],
+			}
+		}
+	}
+	mc.append(r)
 	return nil
 }
 
 func (mc *CallbackAuditLog) OnModelError(ctx context.Context, input *schema.ModelErrorInput) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	s, d := mc.end(input.RunID)
+	mc.append(Record{Kind: RecordLLMError, SpanID: input.RunID, ParentID: s.parent, RunID: input.RunID, Model: s.name, Error: fmt.Sprint(input.Error), Duration: d})
 	return nil
 }
 
 func (mc *CallbackAuditLog) OnChainStart(ctx context.Context, input *schema.ChainStartInput) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.root == "" {
+		mc.root = input.RunID
+	}
 	return nil
 }
 
@@ -67,31 +200,64 @@ func (mc *CallbackAuditLog) OnChainError(ctx context.Context, input *schema.Chai
 }
 
 func (mc *CallbackAuditLog) OnAgentAction(ctx context.Context, input *schema.AgentActionInput) error {
-	mc.audit = append(mc.audit, fmt.Sprintf("[AGENT] log_entry=[%v]", input.Action.Log))
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.step = uuid.NewString()
+	r := Record{Kind: RecordAgentAction, SpanID: mc.step, ParentID: mc.root, RunID: input.RunID, Log: input.Action.Log, Tool: input.Action.Tool}
+	if input.Action.ToolInput != nil {
+		r.Input = input.Action.ToolInput.String()
+	}
+	mc.append(r)
 	return nil
 }
 
 func (mc *CallbackAuditLog) OnAgentFinish(ctx context.Context, input *schema.AgentFinishInput) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.append(Record{Kind: RecordAgentFinish, SpanID: uuid.NewString(), ParentID: mc.root, RunID: input.RunID, Log: input.Finish.Log})
 	return nil
 }
 
 func (mc *CallbackAuditLog) OnToolStart(ctx context.Context, input *schema.ToolStartInput) error {
-	mc.audit = append(mc.audit, fmt.Sprintf("[TOOL] name=[%s] input=[%s]", input.ToolName, input.Input))
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	parent := mc.step
+	if parent == "" {
+		parent = mc.root
+	}
+	mc.begin(input.RunID, input.ToolName, parent)
+	r := Record{Kind: RecordToolStart, SpanID: input.RunID, ParentID: parent, RunID: input.RunID, Tool: input.ToolName}
+	if input.Input != nil {
+		r.Input = input.Input.String()
+	}
+	mc.append(r)
 	return nil
 }
 
 func (mc *CallbackAuditLog) OnToolEnd(ctx context.Context, input *schema.ToolEndInput) error {
-	mc.audit = append(mc.audit, fmt.Sprintf("[TOOL] output=[%s]", input.Output))
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	s, d := mc.end(input.RunID)
+	mc.append(Record{Kind: RecordToolEnd, SpanID: input.RunID, ParentID: s.parent, RunID: input.RunID, Tool: s.name, Output: input.Output, Duration: d})
 	return nil
 }
 
 func (mc *CallbackAuditLog) OnToolError(ctx context.Context, input *schema.ToolErrorInput) error {
-	mc.audit = append(mc.audit, fmt.Sprintf("[TOOL] error=[%s]", input.Error))
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	s, d := mc.end(input.RunID)
+	mc.append(Record{Kind: RecordToolError, SpanID: input.RunID, ParentID: s.parent, RunID: input.RunID, Tool: s.name, Error: fmt.Sprint(input.Error), Duration: d})
 	return nil
 }
 
 func (mc *CallbackAuditLog) OnText(ctx context.Context, input *schema.TextInput) error {
-	mc.audit = append(mc.audit, fmt.Sprintf("[TEXT] log_entry=[%s]", input.Text))
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	parent := mc.step
+	if parent == "" {
+		parent = mc.root
+	}
+	mc.append(Record{Kind: RecordText, SpanID: uuid.NewString(), ParentID: parent, RunID: input.RunID, Log: input.Text})
 	return nil
 }
 
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/hupe1980/golc/schema"
+)
+
+func TestCallbackAuditLogSpans(t *testing.T) {
+	ctx := context.Background()
+	var streamed []Record
+	aLog := NewCallbackAuditLog(func(r Record) {
+		streamed = append(streamed, r)
+	})
+
+	_ = aLog.OnChainStart(ctx, &schema.ChainStartInput{ChainStartManagerInput: &schema.ChainStartManagerInput{}, RunID: "chain"})
+	_ = aLog.OnAgentAction(ctx, &schema.AgentActionInput{AgentActionManagerInput: &schema.AgentActionManagerInput{
+		Action: &schema.AgentAction{Tool: "Terminal", ToolInput: schema.NewToolInputFromArguments(`{"__arg1":"ls"}`)},
+	}, RunID: "chain"})
+	_ = aLog.OnToolStart(ctx, &schema.ToolStartInput{ToolStartManagerInput: &schema.ToolStartManagerInput{
+		ToolName: "Terminal",
+		Input:    schema.NewToolInputFromArguments(`{"__arg1":"ls"}`),
+	}, RunID: "tool"})
+	_ = aLog.OnToolEnd(ctx, &schema.ToolEndInput{ToolEndManagerInput: &schema.ToolEndManagerInput{Output: "main.go"}, RunID: "tool"})
+
+	records := aLog.Records()
+	if len(records) != 3 || len(streamed) != 3 {
+		t.Fatalf("expected 3 records and 3 streamed records, got %d and %d", len(records), len(streamed))
+	}
+	action, toolStart, toolEnd := records[0], records[1], records[2]
+	if action.ParentID != "chain" {
+		t.Errorf("agent step parent = %q, want chain", action.ParentID)
+	}
+	if toolStart.ParentID != action.SpanID || toolEnd.ParentID != action.SpanID {
+		t.Errorf("tool parents = %q and %q, want the agent step %q", toolStart.ParentID, toolEnd.ParentID, action.SpanID)
+	}
+	if toolStart.SpanID != toolEnd.SpanID || toolEnd.Tool != "Terminal" {
+		t.Errorf("tool end doesn't match its start: %+v", toolEnd)
+	}
+
+	want := "[LOG-0] [AGENT] log_entry=[]\n[LOG-1] [TOOL] name=[Terminal] input=[{\"__arg1\":\"ls\"}]\n[LOG-2] [TOOL] name=[Terminal] output=[main.go]"
+	for i := 0; i < 2; i++ {
+		if got := aLog.AuditLog(); got != want {
+			t.Errorf("call %d: AuditLog() = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestCallbackAuditLogConcurrent(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	var seqs []int
+	aLog := NewCallbackAuditLog()
+	aLog.Subscribe(func(r Record) {
+		mu.Lock()
+		defer mu.Unlock()
+		seqs = append(seqs, r.Seq)
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			runID := fmt.Sprintf("tool-%d", i)
+			_ = aLog.OnToolStart(ctx, &schema.ToolStartInput{ToolStartManagerInput: &schema.ToolStartManagerInput{ToolName: "Sleep"}, RunID: runID})
+			_ = aLog.OnToolEnd(ctx, &schema.ToolEndInput{ToolEndManagerInput: &schema.ToolEndManagerInput{Output: "ok"}, RunID: runID})
+		}(i)
+	}
+	wg.Wait()
+
+	records := aLog.Records()
+	if len(records) != 100 {
+		t.Fatalf("expected 100 records, got %d", len(records))
+	}
+	started := map[string]bool{}
+	for i, r := range records {
+		if seqs[i] != i || r.Seq != i {
+			t.Fatalf("records delivered out of order at %d", i)
+		}
+		switch r.Kind {
+		case RecordToolStart:
+			started[r.SpanID] = true
+		case RecordToolEnd:
+			if !started[r.SpanID] {
+				t.Errorf("tool end of span %s before its start", r.SpanID)
+			}
+		}
+	}
+}
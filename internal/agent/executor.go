@@ -0,0 +1,34 @@
+package agent
+
+import (
+	"github.com/hupe1980/golc/agent"
+	"github.com/hupe1980/golc/schema"
+)
+
+// NewExecutor creates an OpenAI functions agent whose model and tools report to the callbacks. The golc executor only
+// passes its callbacks to the agent steps, the model and tool runs only see their own callbacks.
+func NewExecutor(model schema.ChatModel, tools []schema.Tool, callbacks ...schema.Callback) (*agent.Executor, error) {
+	wrapped := make([]schema.Tool, len(tools))
+	for i, t := range tools {
+		wrapped[i] = &callbackTool{Tool: t, callbacks: callbacks}
+	}
+	return agent.NewOpenAIFunctions(&callbackModel{ChatModel: model, callbacks: callbacks}, wrapped)
+}
+
+type callbackTool struct {
+	schema.Tool
+	callbacks []schema.Callback
+}
+
+func (t *callbackTool) Callbacks() []schema.Callback {
+	return append(append([]schema.Callback{}, t.Tool.Callbacks()...), t.callbacks...)
+}
+
+type callbackModel struct {
+	schema.ChatModel
+	callbacks []schema.Callback
+}
+
+func (m *callbackModel) Callbacks() []schema.Callback {
+	return append(append([]schema.Callback{}, m.ChatModel.Callbacks()...), m.callbacks...)
+}
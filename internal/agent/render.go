@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// PromptText renders the records the critic needs to verify an action, LLM records are left out.
+func PromptText(records []Record) string {
+	var lines []string
+	for _, r := range records {
+		var line string
+		switch r.Kind {
+		case RecordAgentAction:
+			line = fmt.Sprintf("[AGENT] log_entry=[%v]", r.Log)
+		case RecordToolStart:
+			line = fmt.Sprintf("[TOOL] name=[%s] input=[%s]", r.Tool, r.Input)
+		case RecordToolEnd:
+			line = fmt.Sprintf("[TOOL] name=[%s] output=[%s]", r.Tool, r.Output)
+		case RecordToolError:
+			line = fmt.Sprintf("[TOOL] name=[%s] error=[%s]", r.Tool, r.Error)
+		case RecordText:
+			line = fmt.Sprintf("[TEXT] log_entry=[%s]", r.Log)
+		default:
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("[LOG-%d] %s", len(lines), line))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// WriteJSONLines writes each record as a line of JSON.
+func WriteJSONLines(w io.Writer, records []Record) error {
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HumanReadable renders the records with their timestamps and durations for people reading the log.
+func HumanReadable(records []Record) string {
+	var b strings.Builder
+	for _, r := range records {
+		fmt.Fprintf(&b, "%s %-12s", r.Time.Format("15:04:05.000"), r.Kind)
+		if r.Tool != "" {
+			fmt.Fprintf(&b, " tool=%s", r.Tool)
+		}
+		if r.Model != "" {
+			fmt.Fprintf(&b, " model=%s", r.Model)
+		}
+		if r.Duration > 0 {
+			fmt.Fprintf(&b, " took=%s", r.Duration)
+		}
+		if r.Tokens != nil {
+			fmt.Fprintf(&b, " tokens=%d", r.Tokens.Total)
+		}
+		if r.Input != "" {
+			fmt.Fprintf(&b, " input=%q", r.Input)
+		}
+		if r.Output != "" {
+			fmt.Fprintf(&b, " output=%q", r.Output)
+		}
+		if r.Error != "" {
+			fmt.Fprintf(&b, " error=%q", r.Error)
+		}
+		if r.Log != "" {
+			fmt.Fprintf(&b, " log=%q", strings.TrimSpace(r.Log))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,261 @@
+// Package auth authenticates the requests of the server with static or HMAC signed session tokens, and checks the
+// origin of websocket connections.
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	zLog "github.com/rs/zerolog/log"
+)
+
+// Permission is what a token allows, control includes read.
+type Permission string
+
+const (
+	// PermissionRead allows watching runs.
+	PermissionRead Permission = "read"
+	// PermissionControl allows starting runs and steering them, e.g. pausing a run or approving its actions.
+	PermissionControl Permission = "control"
+)
+
+// MinSecretLength is the minimum length of the secret signing session tokens.
+const MinSecretLength = 16
+
+// sessionPrefix versions the format of session tokens.
+const sessionPrefix = "v1."
+
+var (
+	ErrNoToken      = errors.New("auth: no token")
+	ErrInvalidToken = errors.New("auth: invalid token")
+	ErrExpiredToken = errors.New("auth: expired token")
+)
+
+// Allows reports whether the permission includes other.
+func (p Permission) Allows(other Permission) bool {
+	return p == PermissionControl || p == other
+}
+
+// ParsePermission parses read or control.
+func ParsePermission(s string) (Permission, error) {
+	switch p := Permission(s); p {
+	case PermissionRead, PermissionControl:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown permission %q, expected %q or %q", s, PermissionRead, PermissionControl)
+}
+
+// ParseTokens parses static tokens given as PERMISSION:TOKEN.
+func ParseTokens(specs []string) (map[string]Permission, error) {
+	tokens := map[string]Permission{}
+	for _, spec := range specs {
+		perm, token, ok := strings.Cut(spec, ":")
+		if !ok || token == "" {
+			return nil, errors.New("tokens must be given as PERMISSION:TOKEN")
+		}
+		p, err := ParsePermission(perm)
+		if err != nil {
+			return nil, err
+		}
+		tokens[token] = p
+	}
+	return tokens, nil
+}
+
+// Identity is who a token was issued to.
+type Identity struct {
+	Subject    string     `json:"sub"`
+	Permission Permission `json:"perm"`
+	Expires    int64      `json:"exp"`
+}
+
+type Options struct {
+	// Tokens are static tokens and their permission.
+	Tokens map[string]Permission
+	// Secret signs and verifies session tokens, they aren't accepted without it.
+	Secret []byte
+	// Origins are the origins allowed to open websockets besides the origin of the server, "*" allows any.
+	Origins []string
+}
+
+// Authenticator checks the tokens and origins of requests. Without tokens and secret every request is allowed.
+type Authenticator struct {
+	opts Options
+}
+
+func New(optFns ...func(o *Options)) (*Authenticator, error) {
+	opts := Options{}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	if len(opts.Secret) > 0 && len(opts.Secret) < MinSecretLength {
+		return nil, fmt.Errorf("the token secret must have at least %d bytes", MinSecretLength)
+	}
+	return &Authenticator{opts: opts}, nil
+}
+
+// Enabled reports whether requests need a token.
+func (a *Authenticator) Enabled() bool {
+	return len(a.opts.Tokens) > 0 || len(a.opts.Secret) > 0
+}
+
+// Authenticate returns the identity of a static or session token.
+func (a *Authenticator) Authenticate(token string) (Identity, error) {
+	if token == "" {
+		return Identity{}, ErrNoToken
+	}
+	// compare with every static token, so the time taken doesn't tell which one is closest
+	var found Identity
+	for t, p := range a.opts.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = Identity{Subject: "static token", Permission: p}
+		}
+	}
+	if found.Permission != "" {
+		return found, nil
+	}
+	if len(a.opts.Secret) == 0 || !strings.HasPrefix(token, sessionPrefix) {
+		return Identity{}, ErrInvalidToken
+	}
+	payload, sig, ok := strings.Cut(strings.TrimPrefix(token, sessionPrefix), ".")
+	if !ok {
+		return Identity{}, ErrInvalidToken
+	}
+	want := a.sign(payload)
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(want)) != 1 {
+		return Identity{}, ErrInvalidToken
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return Identity{}, ErrInvalidToken
+	}
+	var id Identity
+	if err = json.Unmarshal(b, &id); err != nil {
+		return Identity{}, ErrInvalidToken
+	}
+	if _, err = ParsePermission(string(id.Permission)); err != nil {
+		return Identity{}, ErrInvalidToken
+	}
+	if id.Expires != 0 && time.Now().Unix() >= id.Expires {
+		return Identity{}, ErrExpiredToken
+	}
+	return id, nil
+}
+
+// Sign issues a session token to the subject which expires after ttl, 0 never expires.
+func (a *Authenticator) Sign(subject string, perm Permission, ttl time.Duration) (string, error) {
+	if len(a.opts.Secret) == 0 {
+		return "", errors.New("a token secret is needed to sign session tokens")
+	}
+	id := Identity{Subject: subject, Permission: perm}
+	if ttl > 0 {
+		id.Expires = time.Now().Add(ttl).Unix()
+	}
+	b, err := json.Marshal(id)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return sessionPrefix + payload + "." + a.sign(payload), nil
+}
+
+func (a *Authenticator) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.opts.Secret)
+	mac.Write([]byte(sessionPrefix + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// TokenFrom returns the bearer token of the request. Browsers can't set headers on websockets, so GET requests may
+// give the token as the token query parameter instead.
+func TokenFrom(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		return BearerToken(h)
+	}
+	if r.Method == http.MethodGet {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
+
+// BearerToken returns the token of an authorization header value, empty unless it has the Bearer scheme.
+func BearerToken(authorization string) string {
+	scheme, token, _ := strings.Cut(authorization, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// Required returns the permission a request needs: read for safe methods, control for the others.
+func Required(r *http.Request) Permission {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return PermissionRead
+	}
+	return PermissionControl
+}
+
+type identityKey struct{}
+
+// IdentityFrom returns the identity of an authenticated request.
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+// Middleware lets requests through to next if their token has the permission they need, see Required. Requests for
+// which public returns true need no token.
+func (a *Authenticator) Middleware(next http.Handler, public func(r *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() || (public != nil && public(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, err := a.Authenticate(TokenFrom(r))
+		if err != nil {
+			zLog.Warn().Err(err).Str("path", r.URL.Path).Str("remote", r.RemoteAddr).Msg("unauthenticated request")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="flow-gpt"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if need := Required(r); !id.Permission.Allows(need) {
+			zLog.Warn().Str("subject", id.Subject).Str("path", r.URL.Path).Msgf("request needs the %s permission", need)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// CheckOrigin allows websockets of clients which aren't browsers, of the origin of the server and of the allowed
+// origins. It is a websocket.Upgrader CheckOrigin.
+func (a *Authenticator) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range a.opts.Origins {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	zLog.Warn().Str("origin", origin).Msg("websocket origin not allowed")
+	return false
+}
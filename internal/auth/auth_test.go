@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const secret = "0123456789abcdef0123"
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	t.Helper()
+	tokens, err := ParseTokens([]string{"read:viewer-token", "control:operator-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(func(o *Options) {
+		o.Tokens = tokens
+		o.Secret = []byte(secret)
+		o.Origins = []string{"https://ui.example.com/"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := newTestAuthenticator(t)
+	session, err := a.Sign("alice", PermissionControl, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(Identity{Subject: "bob", Permission: PermissionRead, Expires: time.Now().Add(-time.Minute).Unix()})
+	expiredPayload := base64.RawURLEncoding.EncodeToString(b)
+	expired := sessionPrefix + expiredPayload + "." + a.sign(expiredPayload)
+	other, _ := New(func(o *Options) { o.Secret = []byte("another secret of the tests") })
+	forged, _ := other.Sign("mallory", PermissionControl, 0)
+	payload, sig, _ := strings.Cut(strings.TrimPrefix(session, sessionPrefix), ".")
+	tampered := sessionPrefix + payload + "x." + sig
+
+	tests := []struct {
+		token   string
+		subject string
+		perm    Permission
+		err     error
+	}{
+		{"viewer-token", "static token", PermissionRead, nil},
+		{"operator-token", "static token", PermissionControl, nil},
+		{session, "alice", PermissionControl, nil},
+		{"", "", "", ErrNoToken},
+		{"operator", "", "", ErrInvalidToken},
+		{forged, "", "", ErrInvalidToken},
+		{tampered, "", "", ErrInvalidToken},
+		{expired, "", "", ErrExpiredToken},
+	}
+	for _, tt := range tests {
+		id, err := a.Authenticate(tt.token)
+		if !errors.Is(err, tt.err) || id.Subject != tt.subject || id.Permission != tt.perm {
+			t.Errorf("Authenticate(%q) = %+v, %v, want %s %s %v", tt.token, id, err, tt.subject, tt.perm, tt.err)
+		}
+	}
+	if _, err = New(func(o *Options) { o.Secret = []byte("short") }); err == nil {
+		t.Error("expected an error for a short secret")
+	}
+	if _, err = ParseTokens([]string{"admin:x"}); err == nil {
+		t.Error("expected an error for an unknown permission")
+	}
+	if _, err = ParseTokens([]string{"control"}); err == nil {
+		t.Error("expected an error for a token without permission")
+	}
+	if disabled, _ := New(); disabled.Enabled() {
+		t.Error("authenticator without tokens is enabled")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	a := newTestAuthenticator(t)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := IdentityFrom(r.Context()); !ok && r.URL.Path != "/" {
+			t.Errorf("no identity for %s", r.URL)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	h := a.Middleware(next, func(r *http.Request) bool { return r.URL.Path == "/" })
+
+	tests := []struct {
+		method, target, token string
+		want                  int
+	}{
+		{http.MethodGet, "/", "", http.StatusNoContent},
+		{http.MethodGet, "/api/runs", "", http.StatusUnauthorized},
+		{http.MethodGet, "/api/runs", "wrong", http.StatusUnauthorized},
+		{http.MethodGet, "/api/runs", "viewer-token", http.StatusNoContent},
+		{http.MethodGet, "/ws?token=viewer-token", "", http.StatusNoContent},
+		{http.MethodPost, "/api/runs/1/pause", "viewer-token", http.StatusForbidden},
+		{http.MethodPost, "/api/runs/1/pause?token=operator-token", "", http.StatusUnauthorized},
+		{http.MethodPost, "/api/runs/1/pause", "operator-token", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s %s with %q = %d, want %d", tt.method, tt.target, tt.token, w.Code, tt.want)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	a := newTestAuthenticator(t)
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://localhost:8080", true},
+		{"https://ui.example.com", true},
+		{"https://evil.example.com", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "http://localhost:8080/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := a.CheckOrigin(r); got != tt.want {
+			t.Errorf("CheckOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+		}
+	}
+	wildcard, _ := New(func(o *Options) { o.Origins = []string{"*"} })
+	r := httptest.NewRequest(http.MethodGet, "http://localhost:8080/ws", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	if !wildcard.CheckOrigin(r) {
+		t.Error("* doesn't allow every origin")
+	}
+}
@@ -0,0 +1,236 @@
+// Package cassette records the model and tool interactions of a run to a file and replays them deterministically.
+package cassette
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"flow-gpt/internal/integration"
+)
+
+type Mode string
+
+const (
+	ModeRecord Mode = "record"
+	ModeReplay Mode = "replay"
+)
+
+const (
+	KindModel = "model"
+	KindTool  = "tool"
+)
+
+const (
+	SourceChat  = "chat"
+	SourceAgent = "agent"
+)
+
+var ErrNoInteraction = errors.New("cassette: no recorded interaction matches the request")
+
+// Message is a recorded chat message.
+type Message struct {
+	Type         string        `json:"type"`
+	Content      string        `json:"content"`
+	FunctionCall *FunctionCall `json:"functionCall,omitempty"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// Error is a recorded error, bash errors are kept apart so they can be told apart on replay.
+type Error struct {
+	Message string     `json:"message"`
+	Bash    *BashError `json:"bash,omitempty"`
+}
+
+type BashError struct {
+	Output       string `json:"output"`
+	ProcessState string `json:"processState"`
+	Err          string `json:"err"`
+}
+
+// Interaction is a recorded request and its response.
+type Interaction struct {
+	ID     int    `json:"id"`
+	Kind   string `json:"kind"`
+	Source string `json:"source,omitempty"`
+	Key    string `json:"key"`
+	// Messages is the prompt of a model interaction.
+	Messages []Message `json:"messages,omitempty"`
+	// Tool and Input are the request of a tool interaction.
+	Tool  string          `json:"tool,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+	// Output is the content of the model response or the output of the tool.
+	Output       string         `json:"output,omitempty"`
+	FunctionCall *FunctionCall  `json:"functionCall,omitempty"`
+	TokenUsage   map[string]int `json:"tokenUsage,omitempty"`
+	Error        *Error         `json:"error,omitempty"`
+}
+
+// ToolDef describes a recorded tool so it can be stood in for on replay.
+type ToolDef struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	StringArgs  bool   `json:"stringArgs"`
+}
+
+// Cassette holds the interactions of a run. It is safe for concurrent use.
+type Cassette struct {
+	mu           sync.Mutex
+	path         string
+	mode         Mode
+	used         map[int]bool
+	Problem      string         `json:"problem,omitempty"`
+	Tools        []ToolDef      `json:"tools"`
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// New creates a cassette recording to path, the file is rewritten after every interaction.
+func New(path string) *Cassette {
+	return &Cassette{
+		path: path,
+		mode: ModeRecord,
+		used: map[int]bool{},
+	}
+}
+
+// Load reads a recorded cassette from path for replay.
+func Load(path string) (*Cassette, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cassette{
+		path: path,
+		mode: ModeReplay,
+		used: map[int]bool{},
+	}
+	err = json.Unmarshal(b, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cassette: %w", err)
+	}
+	return c, nil
+}
+
+func (c *Cassette) Mode() Mode {
+	return c.mode
+}
+
+// SetProblem records the problem of the run, so the run can be replayed without restating it.
+func (c *Cassette) SetProblem(problem string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Problem = problem
+}
+
+// RecordedProblem returns the problem of the recorded run, empty for cassettes recorded before it was kept.
+func (c *Cassette) RecordedProblem() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Problem
+}
+
+// Save writes the cassette to its file.
+func (c *Cassette) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.save()
+}
+
+func (c *Cassette) save() error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, b, 0644)
+}
+
+func (c *Cassette) record(i *Interaction) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i.ID = len(c.Interactions)
+	c.Interactions = append(c.Interactions, i)
+	return c.save()
+}
+
+// next returns the first interaction not replayed yet with the same kind and key. Matching by key rather than by
+// position keeps replay deterministic when independent tasks ran concurrently.
+func (c *Cassette) next(kind, key string) (*Interaction, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, i := range c.Interactions {
+		if i.Kind == kind && i.Key == key && !c.used[i.ID] {
+			c.used[i.ID] = true
+			return i, nil
+		}
+	}
+	return nil, ErrNoInteraction
+}
+
+// Remaining returns the number of interactions not replayed yet.
+func (c *Cassette) Remaining() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.Interactions) - len(c.used)
+}
+
+type sourceKey struct{}
+
+// WithSource tags model calls made with the context with the caller, e.g. SourceChat or SourceAgent.
+func WithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+func sourceFrom(ctx context.Context) string {
+	s, _ := ctx.Value(sourceKey{}).(string)
+	return s
+}
+
+func key(v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func newError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	e := &Error{Message: err.Error()}
+	var bashErr integration.BashProcessError
+	if errors.As(err, &bashErr) {
+		e.Bash = &BashError{
+			Output:       bashErr.Output,
+			ProcessState: bashErr.ProcessState,
+		}
+		if bashErr.Err != nil {
+			e.Bash.Err = bashErr.Err.Error()
+		}
+	}
+	return e
+}
+
+func (e *Error) err() error {
+	if e == nil {
+		return nil
+	}
+	if e.Bash != nil {
+		return fmt.Errorf("%s: %w", e.Message, integration.BashProcessError{
+			Output:       e.Bash.Output,
+			ProcessState: e.Bash.ProcessState,
+			Err:          errors.New(e.Bash.Err),
+		})
+	}
+	return errors.New(e.Message)
+}
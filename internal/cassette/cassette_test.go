@@ -0,0 +1,127 @@
+package cassette
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"flow-gpt/internal/fake"
+	"flow-gpt/internal/integration"
+	"github.com/hupe1980/golc/schema"
+)
+
+func TestRecordReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	ctx := context.Background()
+	prompt := schema.ChatMessages{schema.NewHumanChatMessage("list the files")}
+	followUp := append(append(schema.ChatMessages{}, prompt...),
+		schema.NewAIChatMessage("", func(o *schema.ChatMessageExtension) {
+			o.FunctionCall = fake.ToolCall("Terminal", "ls")
+		}),
+		schema.NewHumanChatMessage("main.go"),
+	)
+	bashErr := integration.BashProcessError{Output: "no such file", ProcessState: "exit status 1", Err: errors.New("exit status 1")}
+
+	rec := New(path)
+	rec.SetProblem("list the files")
+	model := rec.ChatModel(fake.NewChatModel(
+		fake.Response{Match: []string{"list the files"}, FunctionCall: fake.ToolCall("Terminal", "ls")},
+		fake.Response{Match: []string{"main.go"}, Content: "The only file is main.go."},
+	))
+	tools := rec.WrapTools([]schema.Tool{fake.NewTool("Terminal",
+		fake.ToolResult{Match: "ls", Output: "main.go"},
+		fake.ToolResult{Match: "cat", Err: bashErr},
+	)})
+	if _, err := model.Generate(WithSource(ctx, SourceChat), prompt); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := tools[0].Run(ctx, "ls"); err != nil || out != "main.go" {
+		t.Fatalf("unexpected tool output %q: %v", out, err)
+	}
+	if _, err := tools[0].Run(ctx, "cat missing"); err == nil {
+		t.Fatal("expected the tool to fail")
+	}
+	if _, err := model.Generate(WithSource(ctx, SourceAgent), followUp); err != nil {
+		t.Fatal(err)
+	}
+	sources := []string{SourceChat, "", "", SourceAgent}
+	if len(rec.Interactions) != len(sources) {
+		t.Fatalf("expected %d recorded interactions, got %d", len(sources), len(rec.Interactions))
+	}
+	for i, want := range sources {
+		if got := rec.Interactions[i]; got.ID != i || got.Source != want {
+			t.Errorf("interaction %d has id %d and source %q, want %q", i, got.ID, got.Source, want)
+		}
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Mode() != ModeReplay || c.RecordedProblem() != "list the files" || c.Remaining() != len(sources) {
+		t.Fatalf("unexpected cassette %+v", c)
+	}
+	// the tools and the model are stood in for, and interactions are matched by their request rather than in order
+	model = c.ChatModel(nil)
+	tools = c.WrapTools(nil)
+	if len(tools) != 1 || tools[0].Name() != "Terminal" || tools[0].ArgsType().Kind() != reflect.String {
+		t.Fatalf("unexpected replayed tools %v", tools)
+	}
+	res, err := model.Generate(ctx, followUp)
+	if err != nil || res.Generations[0].Text != "The only file is main.go." {
+		t.Fatalf("unexpected replayed response %+v: %v", res, err)
+	}
+	var replayedErr integration.BashProcessError
+	if _, err = tools[0].Run(ctx, "cat missing"); !errors.As(err, &replayedErr) || replayedErr.Output != bashErr.Output {
+		t.Errorf("expected the bash error to be replayed, got %v", err)
+	}
+	if out, err := tools[0].Run(ctx, "ls"); err != nil || out != "main.go" {
+		t.Errorf("unexpected replayed tool output %q: %v", out, err)
+	}
+	res, err = model.Generate(ctx, prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ai, ok := res.Generations[0].Message.(*schema.AIChatMessage)
+	if !ok || ai.Extension().FunctionCall == nil || ai.Extension().FunctionCall.Name != "Terminal" {
+		t.Errorf("expected the function call to be replayed, got %+v", res.Generations[0].Message)
+	}
+	if usage, ok := res.LLMOutput["TokenUsage"].(map[string]int); !ok || usage["TotalTokens"] != 2 {
+		t.Errorf("expected the token usage to be replayed, got %v", res.LLMOutput)
+	}
+	if c.Remaining() != 0 {
+		t.Errorf("expected every interaction to be replayed, %d remain", c.Remaining())
+	}
+}
+
+func TestReplayMiss(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	ctx := context.Background()
+	rec := New(path)
+	tools := rec.WrapTools([]schema.Tool{fake.NewTool("Terminal", fake.ToolResult{Match: "ls", Output: "main.go"})})
+	if _, err := tools[0].Run(ctx, "ls"); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := c.ChatModel(nil)
+	tools = c.WrapTools(nil)
+	if _, err = model.Generate(ctx, schema.ChatMessages{schema.NewHumanChatMessage("list the files")}); !errors.Is(err, ErrNoInteraction) {
+		t.Errorf("expected an unrecorded prompt to miss, got %v", err)
+	}
+	if _, err = tools[0].Run(ctx, "ls -a"); !errors.Is(err, ErrNoInteraction) {
+		t.Errorf("expected an unrecorded input to miss, got %v", err)
+	}
+	if _, err = tools[0].Run(ctx, "ls"); err != nil {
+		t.Fatal(err)
+	}
+	// each interaction is replayed once
+	if _, err = tools[0].Run(ctx, "ls"); !errors.Is(err, ErrNoInteraction) {
+		t.Errorf("expected a replayed interaction to miss, got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package cassette
+
+import (
+	"context"
+
+	"github.com/hupe1980/golc/schema"
+)
+
+var _ schema.ChatModel = (*ChatModel)(nil)
+
+// ChatModel records the calls to the wrapped model, or serves them from the cassette on replay.
+type ChatModel struct {
+	schema.ChatModel
+	cassette *Cassette
+}
+
+// ChatModel wraps a model with the cassette. The model may be nil on replay.
+func (c *Cassette) ChatModel(model schema.ChatModel) *ChatModel {
+	return &ChatModel{
+		ChatModel: model,
+		cassette:  c,
+	}
+}
+
+func (cm *ChatModel) Generate(ctx context.Context, messages schema.ChatMessages, optFns ...func(o *schema.GenerateOptions)) (*schema.ModelResult, error) {
+	recorded := make([]Message, len(messages))
+	for i, m := range messages {
+		recorded[i] = Message{
+			Type:    string(m.Type()),
+			Content: m.Content(),
+		}
+		if ai, ok := m.(*schema.AIChatMessage); ok {
+			recorded[i].FunctionCall = newFunctionCall(ai.Extension().FunctionCall)
+		}
+	}
+	k := key(recorded)
+
+	if cm.cassette.mode == ModeReplay {
+		i, err := cm.cassette.next(KindModel, k)
+		if err != nil {
+			return nil, err
+		}
+		if i.Error != nil {
+			return nil, i.Error.err()
+		}
+		return modelResult(i), nil
+	}
+
+	res, err := cm.ChatModel.Generate(ctx, messages, optFns...)
+	i := &Interaction{
+		Kind:     KindModel,
+		Source:   sourceFrom(ctx),
+		Key:      k,
+		Messages: recorded,
+		Error:    newError(err),
+	}
+	if err == nil && len(res.Generations) > 0 {
+		i.Output = res.Generations[0].Text
+		if ai, ok := res.Generations[0].Message.(*schema.AIChatMessage); ok {
+			i.Output = ai.Content()
+			i.FunctionCall = newFunctionCall(ai.Extension().FunctionCall)
+		}
+		if usage, ok := res.LLMOutput["TokenUsage"].(map[string]int); ok {
+			i.TokenUsage = usage
+		}
+	}
+	if recErr := cm.cassette.record(i); recErr != nil {
+		return nil, recErr
+	}
+	return res, err
+}
+
+func modelResult(i *Interaction) *schema.ModelResult {
+	msg := schema.NewAIChatMessage(i.Output, func(o *schema.ChatMessageExtension) {
+		if i.FunctionCall != nil {
+			o.FunctionCall = &schema.FunctionCall{
+				Name:      i.FunctionCall.Name,
+				Arguments: i.FunctionCall.Arguments,
+			}
+		}
+	})
+	usage := i.TokenUsage
+	if usage == nil {
+		usage = map[string]int{}
+	}
+	return &schema.ModelResult{
+		Generations: []schema.Generation{{Text: i.Output, Message: msg}},
+		LLMOutput: map[string]any{
+			"ModelName":  "cassette",
+			"TokenUsage": usage,
+		},
+	}
+}
+
+func newFunctionCall(fc *schema.FunctionCall) *FunctionCall {
+	if fc == nil {
+		return nil
+	}
+	return &FunctionCall{
+		Name:      fc.Name,
+		Arguments: fc.Arguments,
+	}
+}
+
+// Type reports the wrapped model's type, on replay it pretends to be OpenAI as the functions agent requires it.
+func (cm *ChatModel) Type() string {
+	if cm.ChatModel == nil {
+		return "chatmodel.OpenAI"
+	}
+	return cm.ChatModel.Type()
+}
+
+func (cm *ChatModel) Verbose() bool {
+	if cm.ChatModel == nil {
+		return false
+	}
+	return cm.ChatModel.Verbose()
+}
+
+func (cm *ChatModel) Callbacks() []schema.Callback {
+	if cm.ChatModel == nil {
+		return nil
+	}
+	return cm.ChatModel.Callbacks()
+}
+
+func (cm *ChatModel) InvocationParams() map[string]any {
+	if cm.ChatModel == nil {
+		return map[string]any{"model_name": "cassette"}
+	}
+	return cm.ChatModel.InvocationParams()
+}
+
+func (cm *ChatModel) GetTokenIDs(text string) ([]uint, error) {
+	if cm.ChatModel == nil {
+		return nil, nil
+	}
+	return cm.ChatModel.GetTokenIDs(text)
+}
+
+func (cm *ChatModel) GetNumTokens(text string) (uint, error) {
+	if cm.ChatModel == nil {
+		return 0, nil
+	}
+	return cm.ChatModel.GetNumTokens(text)
+}
+
+func (cm *ChatModel) GetNumTokensFromMessage(messages schema.ChatMessages) (uint, error) {
+	if cm.ChatModel == nil {
+		return 0, nil
+	}
+	return cm.ChatModel.GetNumTokensFromMessage(messages)
+}
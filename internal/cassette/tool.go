@@ -0,0 +1,125 @@
+package cassette
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/hupe1980/golc/schema"
+)
+
+var _ schema.Tool = (*Tool)(nil)
+
+// Tool records the runs of the wrapped tool, or serves them from the cassette on replay.
+type Tool struct {
+	def      ToolDef
+	tool     schema.Tool
+	cassette *Cassette
+}
+
+// WrapTools wraps the tools with the cassette. On record the tool definitions are kept in the cassette, on replay the
+// recorded definitions are used and the given tools are ignored so no browser or shell is needed.
+func (c *Cassette) WrapTools(tools []schema.Tool) []schema.Tool {
+	if c.mode == ModeReplay {
+		wrapped := make([]schema.Tool, len(c.Tools))
+		for i, def := range c.Tools {
+			wrapped[i] = &Tool{def: def, cassette: c}
+		}
+		return wrapped
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wrapped := make([]schema.Tool, len(tools))
+	for i, t := range tools {
+		def := ToolDef{
+			Name:        t.Name(),
+			Description: t.Description(),
+			StringArgs:  t.ArgsType().Kind() == reflect.String,
+		}
+		c.Tools = append(c.Tools, def)
+		wrapped[i] = &Tool{def: def, tool: t, cassette: c}
+	}
+	return wrapped
+}
+
+func (t *Tool) Name() string {
+	return t.def.Name
+}
+
+func (t *Tool) Description() string {
+	return t.def.Description
+}
+
+func (t *Tool) ArgsType() reflect.Type {
+	if t.tool != nil {
+		return t.tool.ArgsType()
+	}
+	if t.def.StringArgs {
+		return reflect.TypeOf("")
+	}
+	return reflect.TypeOf(map[string]any{})
+}
+
+func (t *Tool) Run(ctx context.Context, input any) (string, error) {
+	in, err := canonical(input)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal tool input: %w", err)
+	}
+	k := key(map[string]any{"tool": t.def.Name, "input": in})
+
+	if t.cassette.mode == ModeReplay {
+		i, err := t.cassette.next(KindTool, k)
+		if err != nil {
+			return "", fmt.Errorf("%w: tool=[%s] input=[%s]", err, t.def.Name, in)
+		}
+		if i.Error != nil {
+			return "", i.Error.err()
+		}
+		return i.Output, nil
+	}
+
+	output, err := t.tool.Run(ctx, input)
+	if recErr := t.cassette.record(&Interaction{
+		Kind:   KindTool,
+		Key:    k,
+		Tool:   t.def.Name,
+		Input:  in,
+		Output: output,
+		Error:  newError(err),
+	}); recErr != nil {
+		return "", errors.Join(err, recErr)
+	}
+	return output, err
+}
+
+func (t *Tool) Verbose() bool {
+	if t.tool == nil {
+		return false
+	}
+	return t.tool.Verbose()
+}
+
+func (t *Tool) Callbacks() []schema.Callback {
+	if t.tool == nil {
+		return nil
+	}
+	return t.tool.Callbacks()
+}
+
+// canonical marshals a tool input with sorted keys, so a struct input on record and the map standing in for it on
+// replay produce the same key.
+func canonical(input any) (json.RawMessage, error) {
+	b, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	var v any
+	err = json.Unmarshal(b, &v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
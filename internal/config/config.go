@@ -0,0 +1,298 @@
+// Package config layers the settings of the CLI: defaults, a YAML file, FLOWGPT_* environment variables and flags,
+// each overriding the previous one.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+
+	"flow-gpt/internal/auth"
+	"flow-gpt/internal/fsm"
+	"flow-gpt/internal/telemetry"
+	"flow-gpt/internal/webhook"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes the environment variable of each setting, log.level is FLOWGPT_LOG_LEVEL.
+const EnvPrefix = "FLOWGPT_"
+
+// ConfigEnv names the config file when the -config flag isn't given.
+const ConfigEnv = EnvPrefix + "CONFIG"
+
+// Config holds every setting. Fields are named by their yaml path, which is also the name of their flag unless the
+// flag tag says otherwise.
+type Config struct {
+	Problem   string    `yaml:"problem" usage:"problem to solve"`
+	Run       Run       `yaml:"run"`
+	Model     Model     `yaml:"model"`
+	Timeouts  Timeouts  `yaml:"timeouts"`
+	Tools     Tools     `yaml:"tools"`
+	Workspace Workspace `yaml:"workspace"`
+	Limits    Limits    `yaml:"limits"`
+	Server    Server    `yaml:"server"`
+	Webhooks  Webhooks  `yaml:"webhooks"`
+	Log       Log       `yaml:"log"`
+	Storage   Storage   `yaml:"storage"`
+	Trace     Trace     `yaml:"trace"`
+	Redact    Redact    `yaml:"redact"`
+}
+
+type Run struct {
+	Plan       bool   `yaml:"plan" flag:"plan" usage:"decompose the problem into a plan of subgoals before starting"`
+	Candidates int    `yaml:"candidates" flag:"candidates" usage:"number of candidate thoughts scored by the critic each turn"`
+	SkipCritic bool   `yaml:"skipCritic" flag:"skip-critic" usage:"accept every thought and action without asking the critic"`
+	Backtrack  int    `yaml:"backtrack" flag:"backtrack" usage:"consecutive failed actions before backtracking to an earlier candidate, 0 disables"`
+	Record     string `yaml:"record" flag:"record" usage:"record model and tool interactions to a cassette file"`
+	Replay     string `yaml:"replay" flag:"replay" usage:"replay model and tool interactions from a cassette file"`
+	Checkpoint string `yaml:"checkpoint" flag:"checkpoint" usage:"write a checkpoint of the run to this file after every transition"`
+	Approve    bool   `yaml:"approve" flag:"approve" usage:"hold every action until the operator approves it, e.g. from flow-gpt tui"`
+	OutputDir  string `yaml:"outputDir" flag:"output-dir" usage:"directory of the outputs of runs, a directory named by the id of a run holds its workspace, manifest and report, empty disables"`
+}
+
+type Model struct {
+	Name        string  `yaml:"name" usage:"OpenAI chat model, the API key is read from OPENAI_API_KEY"`
+	Temperature float32 `yaml:"temperature" usage:"sampling temperature of the model"`
+}
+
+type Timeouts struct {
+	Chat  time.Duration `yaml:"chat" usage:"timeout of a call of the thinker or the critic"`
+	Agent time.Duration `yaml:"agent" usage:"timeout of an agent call with its tools"`
+}
+
+type Tools struct {
+	Browser     bool   `yaml:"browser" usage:"give the agent a headless browser"`
+	Terminal    bool   `yaml:"terminal" usage:"give the agent a bash terminal"`
+	Git         bool   `yaml:"git" usage:"give the agent git when the workspace is a git repository, commits are only made on flow-gpt/ branches"`
+	SecretsFile string `yaml:"secretsFile" flag:"secrets-file" usage:"env file of secrets available to terminal commands as {{secret:NAME}}, in addition to FLOWGPT_SECRET_NAME variables"`
+}
+
+type Workspace struct {
+	Template string        `yaml:"template" flag:"workspace-template" usage:"directory copied into the workspace of every run"`
+	Repo     string        `yaml:"repo" flag:"workspace-repo" usage:"git repository cloned into the workspace of every run"`
+	Ref      string        `yaml:"ref" flag:"workspace-ref" usage:"branch, tag or commit of workspace.repo checked out, its default branch if empty"`
+	MaxAge   time.Duration `yaml:"maxAge" flag:"workspace-max-age" usage:"remove the outputs of runs not updated for longer, 0 keeps them"`
+	MaxRuns  int           `yaml:"maxRuns" flag:"workspace-max-runs" usage:"keep the outputs of this many finished runs, removing older ones, 0 keeps them all"`
+}
+
+type Limits struct {
+	MaxTurns           int    `yaml:"maxTurns" usage:"stop the run after this many turns, 0 is unlimited"`
+	MaxTokens          int    `yaml:"maxTokens" usage:"stop the run after this many tokens, 0 is unlimited"`
+	MaxRetries         uint64 `yaml:"maxRetries" usage:"retries of a failed model or agent call, 0 retries forever"`
+	MaxParallelActions int    `yaml:"maxParallelActions" flag:"parallel" usage:"maximum number of agent tasks run at the same time"`
+}
+
+type Server struct {
+	Addr        string   `yaml:"addr" usage:"address of the websocket and HTTP server"`
+	GRPCAddr    string   `yaml:"grpcAddr" flag:"grpc-addr" usage:"address of the gRPC server, empty disables it"`
+	Tokens      []string `yaml:"tokens" flag:"auth-token" secret:"true" usage:"token accepted by the server as PERMISSION:TOKEN, PERMISSION is read or control, can be repeated"`
+	TokenSecret string   `yaml:"tokenSecret" flag:"auth-secret" secret:"true" usage:"secret of at least 16 bytes signing the session tokens accepted by the server, see flow-gpt token"`
+	Origins     []string `yaml:"origins" flag:"origin" usage:"origin allowed to open websockets besides the server's own, * allows any, can be repeated"`
+	TLSCert     string   `yaml:"tlsCert" flag:"tls-cert" usage:"certificate file to serve HTTPS with, needs server.tlsKey"`
+	TLSKey      string   `yaml:"tlsKey" flag:"tls-key" usage:"private key file of server.tlsCert"`
+}
+
+type Webhooks struct {
+	URLs       []string `yaml:"urls" flag:"webhook" usage:"url notified of the lifecycle of runs with JSON payloads, can be repeated"`
+	Secret     string   `yaml:"secret" flag:"webhook-secret" secret:"true" usage:"secret signing the webhook payloads with HMAC-SHA256 in the X-FlowGPT-Signature header"`
+	Events     []string `yaml:"events" flag:"webhook-event" usage:"notified events: run.completed, run.failed, run.budget_exhausted or run.awaiting_approval, all if empty, can be repeated"`
+	MaxRetries uint64   `yaml:"maxRetries" usage:"retries of a failed webhook delivery, with an exponential backoff"`
+	Log        string   `yaml:"log" flag:"webhook-log" usage:"delivery log of the webhooks as JSON Lines, empty disables"`
+}
+
+type Log struct {
+	Level    string `yaml:"level" usage:"log level: trace, debug, info, warn or error"`
+	Pretty   bool   `yaml:"pretty" usage:"log human readable lines instead of JSON"`
+	AuditLog string `yaml:"auditLog" flag:"audit-log" usage:"export the audit log of every agent call to a JSON Lines file"`
+}
+
+type Storage struct {
+	DB string `yaml:"db" flag:"db" usage:"database storing the transcripts of runs, shared by the processes using it, empty disables"`
+}
+
+type Trace struct {
+	Exporter string `yaml:"exporter" flag:"trace" usage:"export traces of the run to \"otlp\" or \"file\", empty disables"`
+	File     string `yaml:"file" flag:"trace-file" usage:"file the traces are written to by the file exporter"`
+}
+
+type Redact struct {
+	Patterns []string `yaml:"patterns" flag:"redact" usage:"regular expression of secrets to redact, can be repeated"`
+	Env      []string `yaml:"env" flag:"redact-env" usage:"environment variables whose values are redacted, OPENAI_API_KEY always is"`
+}
+
+// Default returns the default settings.
+func Default() Config {
+	return Config{
+		Run: Run{
+			Candidates: 1,
+			OutputDir:  "runs",
+		},
+		Model: Model{
+			Name:        fsm.ModelName,
+			Temperature: fsm.Temperature,
+		},
+		Timeouts: Timeouts{
+			Chat:  fsm.ChatTimeout,
+			Agent: fsm.AgentTimeout,
+		},
+		Tools: Tools{
+			Browser:  true,
+			Terminal: true,
+			Git:      true,
+		},
+		Limits: Limits{
+			MaxParallelActions: fsm.DefaultMaxParallelActions,
+		},
+		Server: Server{
+			Addr: ":8080",
+		},
+		Webhooks: Webhooks{
+			MaxRetries: webhook.MaxRetries,
+		},
+		Log: Log{
+			Level: "debug",
+		},
+		Storage: Storage{
+			DB: "flow-gpt.db",
+		},
+		Trace: Trace{
+			File: "trace.jsonl",
+		},
+	}
+}
+
+// Load parses the flags of args and returns the effective settings. The config file is named by the -config flag or
+// the FLOWGPT_CONFIG variable. flagFns register the flags of a command that aren't settings.
+func Load(name string, args []string, flagFns ...func(fs *flag.FlagSet)) (Config, *flag.FlagSet, error) {
+	cfg := Default()
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFlag := fs.String("config", os.Getenv(ConfigEnv), "YAML config file, overridden by "+EnvPrefix+"* variables and flags")
+	set := registerFlags(fs, &cfg)
+	for _, fn := range flagFns {
+		fn(fs)
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, fs, err
+	}
+
+	if *configFlag != "" {
+		b, err := os.ReadFile(*configFlag)
+		if err != nil {
+			return cfg, fs, fmt.Errorf("failed to read config: %w", err)
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err = dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return cfg, fs, fmt.Errorf("failed to parse config %s: %w", *configFlag, err)
+		}
+	}
+	for _, f := range fields(&cfg) {
+		if v, ok := os.LookupEnv(f.env); ok {
+			if err := f.set(v); err != nil {
+				return cfg, fs, fmt.Errorf("invalid %s: %w", f.env, err)
+			}
+		}
+	}
+	if err := set(); err != nil {
+		return cfg, fs, err
+	}
+	return cfg, fs, cfg.Validate()
+}
+
+// Validate checks the settings, reporting every invalid one.
+func (c Config) Validate() error {
+	var errs []error
+	if _, err := zerolog.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	if c.Run.Candidates < 1 {
+		errs = append(errs, errors.New("run.candidates must be at least 1"))
+	}
+	if c.Run.Backtrack < 0 {
+		errs = append(errs, errors.New("run.backtrack must not be negative"))
+	}
+	if c.Run.Record != "" && c.Run.Replay != "" {
+		errs = append(errs, errors.New("run.record and run.replay can't be used together"))
+	}
+	if c.Workspace.Template != "" && c.Workspace.Repo != "" {
+		errs = append(errs, errors.New("workspace.template and workspace.repo can't be used together"))
+	}
+	if c.Workspace.Ref != "" && c.Workspace.Repo == "" {
+		errs = append(errs, errors.New("workspace.ref needs workspace.repo"))
+	}
+	if c.Workspace.MaxAge < 0 || c.Workspace.MaxRuns < 0 {
+		errs = append(errs, errors.New("workspace.maxAge and workspace.maxRuns must not be negative"))
+	}
+	if c.Run.OutputDir == "" && (c.Workspace.Template != "" || c.Workspace.Repo != "") {
+		errs = append(errs, errors.New("the workspace of runs needs run.outputDir"))
+	}
+	if c.Model.Name == "" {
+		errs = append(errs, errors.New("model.name must be set"))
+	}
+	if c.Model.Temperature < 0 || c.Model.Temperature > 2 {
+		errs = append(errs, errors.New("model.temperature must be between 0 and 2"))
+	}
+	if c.Timeouts.Chat <= 0 || c.Timeouts.Agent <= 0 {
+		errs = append(errs, errors.New("timeouts must be positive"))
+	}
+	if c.Limits.MaxTurns < 0 || c.Limits.MaxTokens < 0 {
+		errs = append(errs, errors.New("limits must not be negative"))
+	}
+	if c.Limits.MaxParallelActions < 1 {
+		errs = append(errs, errors.New("limits.maxParallelActions must be at least 1"))
+	}
+	if c.Server.Addr == "" {
+		errs = append(errs, errors.New("server.addr must be set"))
+	}
+	if _, err := auth.ParseTokens(c.Server.Tokens); err != nil {
+		errs = append(errs, fmt.Errorf("server.tokens: %w", err))
+	}
+	if n := len(c.Server.TokenSecret); n > 0 && n < auth.MinSecretLength {
+		errs = append(errs, fmt.Errorf("server.tokenSecret must have at least %d bytes", auth.MinSecretLength))
+	}
+	if (c.Server.TLSCert == "") != (c.Server.TLSKey == "") {
+		errs = append(errs, errors.New("server.tlsCert and server.tlsKey must be set together"))
+	}
+	for _, u := range c.Webhooks.URLs {
+		if parsed, err := url.Parse(u); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			errs = append(errs, fmt.Errorf("webhooks.urls: %q is not an http or https url", u))
+		}
+	}
+	for _, e := range c.Webhooks.Events {
+		known := false
+		for _, t := range webhook.Types {
+			known = known || e == t
+		}
+		if !known {
+			errs = append(errs, fmt.Errorf("webhooks.events: unknown event %q", e))
+		}
+	}
+	switch c.Trace.Exporter {
+	case "", telemetry.ExporterOTLP, telemetry.ExporterFile:
+	default:
+		errs = append(errs, fmt.Errorf("trace.exporter must be %q or %q", telemetry.ExporterOTLP, telemetry.ExporterFile))
+	}
+	return errors.Join(errs...)
+}
+
+// Redacted returns the settings with the values of secrets masked.
+func (c Config) Redacted() Config {
+	for _, f := range fields(&c) {
+		if f.secret {
+			f.mask()
+		}
+	}
+	return c
+}
+
+// YAML renders the settings as a config file.
+func (c Config) YAML() (string, error) {
+	b, err := yaml.Marshal(c)
+	return string(b), err
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "flow-gpt.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadListsKeepCommas(t *testing.T) {
+	const pattern = `sk-[a-z]{20,}`
+	want := []string{pattern, `ghp_[0-9a-zA-Z]{36}`}
+	for _, tt := range []struct {
+		name string
+		file string
+		env  string
+		args []string
+	}{
+		{name: "flag", args: []string{"-redact", pattern, "-redact", `ghp_[0-9a-zA-Z]{36}`}},
+		{name: "environment", env: `["sk-[a-z]{20,}", "ghp_[0-9a-zA-Z]{36}"]`},
+		{name: "file", file: "redact:\n  patterns:\n    - 'sk-[a-z]{20,}'\n    - 'ghp_[0-9a-zA-Z]{36}'\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfig(t, tt.file)}, args...)
+			}
+			if tt.env != "" {
+				t.Setenv("FLOWGPT_REDACT_PATTERNS", tt.env)
+			}
+			cfg, _, err := Load("test", args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cfg.Redact.Patterns, want) {
+				t.Errorf("unexpected patterns %q", cfg.Redact.Patterns)
+			}
+		})
+	}
+
+	t.Setenv("FLOWGPT_REDACT_PATTERNS", pattern)
+	cfg, _, err := Load("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Redact.Patterns, []string{pattern}) {
+		t.Errorf("a single value isn't kept whole: %q", cfg.Redact.Patterns)
+	}
+	t.Setenv("FLOWGPT_REDACT_PATTERNS", `["unterminated`)
+	if _, _, err = Load("test", nil); err == nil {
+		t.Error("expected an error for an invalid JSON array")
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+problem: from file
+model:
+  name: gpt-4
+timeouts:
+  chat: 1m
+limits:
+  maxTurns: 10
+  maxTokens: 5000
+server:
+  addr: :9090
+`)
+	t.Setenv("FLOWGPT_LIMITS_MAX_TURNS", "20")
+	t.Setenv("FLOWGPT_SERVER_ADDR", ":9191")
+	t.Setenv("FLOWGPT_REDACT_ENV", `["DB_PASSWORD", "API_TOKEN"]`)
+
+	cfg, fs, err := Load("test", []string{"-config", path, "-server.addr", ":9292", "-parallel", "2", "-skip-critic", "-redact", "a", "-redact", "b", "list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Problem != "from file" || cfg.Model.Name != "gpt-4" || cfg.Timeouts.Chat != time.Minute || cfg.Limits.MaxTokens != 5000 {
+		t.Errorf("file settings not applied: %+v", cfg)
+	}
+	if cfg.Timeouts.Agent != 30*time.Second || cfg.Model.Temperature != 0.05 {
+		t.Errorf("defaults not kept: %+v", cfg)
+	}
+	if cfg.Limits.MaxTurns != 20 || !reflect.DeepEqual(cfg.Redact.Env, []string{"DB_PASSWORD", "API_TOKEN"}) {
+		t.Errorf("environment not applied: %+v", cfg)
+	}
+	if cfg.Server.Addr != ":9292" || cfg.Limits.MaxParallelActions != 2 || !cfg.Run.SkipCritic {
+		t.Errorf("flags not applied: %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.Redact.Patterns, []string{"a", "b"}) {
+		t.Errorf("repeated flag not collected: %v", cfg.Redact.Patterns)
+	}
+	if fs.Arg(0) != "list" {
+		t.Errorf("arguments not kept: %v", fs.Args())
+	}
+	if m := cfg.Map(); m["redact.patterns"] != `["a","b"]` {
+		t.Errorf("unexpected list in map: %v", m["redact.patterns"])
+	}
+	if m := cfg.Map(); m["limits.maxTurns"] != "20" || m["timeouts.chat"] != "1m0s" {
+		t.Errorf("unexpected map: %v", m)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{"unknown field", []string{"-config", writeConfig(t, "limits:\n  maxTurnz: 3\n")}, "field maxTurnz not found"},
+		{"bad flag value", []string{"-limits.maxTurns", "many"}, `invalid value "many" for flag -limits.maxTurns`},
+		{"validation", []string{"-log.level", "loud", "-candidates", "0", "-record", "a", "-replay", "b"}, "log.level"},
+		{"all validation errors", []string{"-candidates", "0", "-trace", "zipkin"}, "run.candidates must be at least 1\ntrace.exporter"},
+		{"token permission", []string{"-auth-token", "admin:abc"}, "server.tokens"},
+		{"short token secret", []string{"-auth-secret", "short"}, "server.tokenSecret"},
+		{"tls key", []string{"-tls-cert", "cert.pem"}, "server.tlsCert and server.tlsKey"},
+		{"webhook url", []string{"-webhook", "ftp://example.com"}, "webhooks.urls"},
+		{"webhook event", []string{"-webhook-event", "run.started"}, "webhooks.events"},
+		{"workspace seed", []string{"-workspace-template", "tmpl", "-workspace-repo", "https://example.com/repo.git"}, "workspace.template and workspace.repo"},
+		{"workspace output", []string{"-workspace-template", "tmpl", "-output-dir", ""}, "needs run.outputDir"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Load("test", tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg, _, err := Load("test", []string{"-auth-token", "read:viewer-token", "-auth-token", "control:operator-token", "-auth-secret", "0123456789abcdef"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := cfg.Redacted().YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := cfg.Map()
+	for _, s := range []string{out, m["server.tokens"], m["server.tokenSecret"]} {
+		for _, secret := range []string{"viewer-token", "operator-token", "0123456789abcdef"} {
+			if strings.Contains(s, secret) {
+				t.Errorf("%s not masked: %s", secret, s)
+			}
+		}
+	}
+	if m["server.tokenSecret"] != "[REDACTED]" {
+		t.Errorf("unexpected masked secret %q", m["server.tokenSecret"])
+	}
+	if len(cfg.Server.Tokens) != 2 || cfg.Server.Tokens[0] != "read:viewer-token" {
+		t.Errorf("Redacted changed the settings: %v", cfg.Server.Tokens)
+	}
+}
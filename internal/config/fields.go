@@ -0,0 +1,231 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"flow-gpt/internal/redact"
+)
+
+// field is a setting found by walking the Config struct.
+type field struct {
+	path  string
+	flag  string
+	env   string
+	usage string
+	// secret is set by the secret tag, the value is masked when the settings are shown or stored.
+	secret bool
+	value  reflect.Value
+}
+
+func fields(cfg *Config) []field {
+	var fs []field
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			path := prefix + sf.Tag.Get("yaml")
+			if sf.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), path+".")
+				continue
+			}
+			name := sf.Tag.Get("flag")
+			if name == "" {
+				name = path
+			}
+			fs = append(fs, field{
+				path:   path,
+				flag:   name,
+				env:    EnvPrefix + strings.ToUpper(strings.ReplaceAll(toSnake(path), ".", "_")),
+				usage:  sf.Tag.Get("usage"),
+				secret: sf.Tag.Get("secret") == "true",
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(cfg).Elem(), "")
+	return fs
+}
+
+// toSnake turns maxTurns into max_turns.
+func toSnake(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 && s[i-1] != '.' {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// set parses s into the field. A list is a JSON array, any other value is a list of one item: lists are never split
+// on commas, which would cut regular expressions such as a{2,}.
+func (f field) set(s string) error {
+	v := f.value
+	switch v.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	case []string:
+		list := []string{s}
+		if strings.HasPrefix(strings.TrimSpace(s), "[") {
+			if err := json.Unmarshal([]byte(s), &list); err != nil {
+				return fmt.Errorf("invalid JSON array: %w", err)
+			}
+		}
+		f.setList(list)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32:
+		n, err := strconv.ParseFloat(s, 32)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// setList sets a list field, empty items are dropped.
+func (f field) setList(items []string) {
+	var list []string
+	for _, item := range items {
+		if strings.TrimSpace(item) != "" {
+			list = append(list, item)
+		}
+	}
+	f.value.Set(reflect.ValueOf(list))
+}
+
+// flagValue keeps the values given to a flag, so they can be applied after the file and the environment.
+type flagValue struct {
+	field  field
+	def    string
+	values []string
+}
+
+func (fv *flagValue) String() string {
+	if fv == nil {
+		return ""
+	}
+	return fv.def
+}
+
+func (fv *flagValue) Set(s string) error {
+	fv.values = append(fv.values, s)
+	return nil
+}
+
+func (fv *flagValue) IsBoolFlag() bool {
+	return fv.field.value.Kind() == reflect.Bool
+}
+
+// registerFlags adds a flag for every setting. The returned function applies the flags which were given, every value of
+// a repeated list flag is an item of the list as given.
+func registerFlags(fs *flag.FlagSet, cfg *Config) func() error {
+	var values []*flagValue
+	for _, f := range fields(cfg) {
+		fv := &flagValue{field: f, def: format(f.value)}
+		fs.Var(fv, f.flag, f.usage)
+		values = append(values, fv)
+	}
+	return func() error {
+		for _, fv := range values {
+			if len(fv.values) == 0 {
+				continue
+			}
+			if _, ok := fv.field.value.Interface().([]string); ok {
+				fv.field.setList(fv.values)
+				continue
+			}
+			s := fv.values[len(fv.values)-1]
+			if err := fv.field.set(s); err != nil {
+				return fmt.Errorf("invalid value %q for flag -%s: %w", s, fv.field.flag, err)
+			}
+		}
+		return nil
+	}
+}
+
+// format renders the value of a setting, lists as JSON arrays so they read back as they were.
+func format(v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case []string:
+		if len(x) == 0 {
+			return ""
+		}
+		b, _ := json.Marshal(x)
+		return string(b)
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// mask replaces the value of the field, or of every item of a list, by redact.Mask.
+func (f field) mask() {
+	switch x := f.value.Interface().(type) {
+	case string:
+		if x != "" {
+			f.value.SetString(redact.Mask)
+		}
+	case []string:
+		masked := make([]string, len(x))
+		for i := range masked {
+			masked[i] = redact.Mask
+		}
+		if x != nil {
+			f.value.Set(reflect.ValueOf(masked))
+		}
+	}
+}
+
+// Map returns the settings by path, to be stored next to a run. Secrets are masked.
+func (c Config) Map() map[string]string {
+	m := map[string]string{}
+	for _, f := range fields(&c) {
+		if f.secret {
+			f.mask()
+		}
+		if f.path != "problem" {
+			m[f.path] = format(f.value)
+		}
+	}
+	return m
+}
@@ -0,0 +1,168 @@
+// Package fake provides scripted stand-ins for the chat model and tools so runs can be driven deterministically.
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hupe1980/golc/schema"
+)
+
+var _ schema.ChatModel = (*ChatModel)(nil)
+
+// Response is a canned reply served by the ChatModel when every Match string is found in the last message of the
+// prompt.
+type Response struct {
+	Match        []string
+	Content      string
+	FunctionCall *schema.FunctionCall
+	// Times is how often the response can be served, 0 means once.
+	Times int
+	used  int
+}
+
+// Call records a prompt received by the ChatModel and the response it was served.
+type Call struct {
+	Messages schema.ChatMessages
+	Response *Response
+}
+
+// ChatModel serves scripted responses in order, the first response which matches the prompt and hasn't been used up
+// is returned.
+type ChatModel struct {
+	mu        sync.Mutex
+	responses []*Response
+	calls     []Call
+}
+
+func NewChatModel(responses ...Response) *ChatModel {
+	cm := &ChatModel{}
+	for i := range responses {
+		cm.responses = append(cm.responses, &responses[i])
+	}
+	return cm
+}
+
+// ToolCall returns a function call invoking the tool with a plain string input.
+func ToolCall(name, input string) *schema.FunctionCall {
+	args, err := json.Marshal(map[string]string{"__arg1": input})
+	if err != nil {
+		panic(err)
+	}
+	return &schema.FunctionCall{Name: name, Arguments: string(args)}
+}
+
+func (cm *ChatModel) Generate(ctx context.Context, messages schema.ChatMessages, optFns ...func(o *schema.GenerateOptions)) (*schema.ModelResult, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	last := ""
+	if len(messages) > 0 {
+		last = messages[len(messages)-1].Content()
+	}
+	r := cm.match(last)
+	if r == nil {
+		return nil, fmt.Errorf("fake: no response matches prompt=[%s]", last)
+	}
+	r.used++
+	cm.calls = append(cm.calls, Call{Messages: messages, Response: r})
+
+	msg := schema.NewAIChatMessage(r.Content, func(o *schema.ChatMessageExtension) {
+		o.FunctionCall = r.FunctionCall
+	})
+	return &schema.ModelResult{
+		Generations: []schema.Generation{{Text: r.Content, Message: msg}},
+		LLMOutput: map[string]any{
+			"ModelName": "fake",
+			"TokenUsage": map[string]int{
+				"PromptTokens":     len(messages),
+				"CompletionTokens": 1,
+				"TotalTokens":      len(messages) + 1,
+			},
+		},
+	}, nil
+}
+
+func (cm *ChatModel) match(prompt string) *Response {
+	for _, r := range cm.responses {
+		times := r.Times
+		if times == 0 {
+			times = 1
+		}
+		if r.used >= times {
+			continue
+		}
+		matched := true
+		for _, m := range r.Match {
+			if !strings.Contains(prompt, m) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return r
+		}
+	}
+	return nil
+}
+
+// Calls returns the prompts received so far.
+func (cm *ChatModel) Calls() []Call {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return append([]Call(nil), cm.calls...)
+}
+
+// Unused returns the responses which were never served.
+func (cm *ChatModel) Unused() []Response {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	var unused []Response
+	for _, r := range cm.responses {
+		if r.used == 0 {
+			unused = append(unused, *r)
+		}
+	}
+	return unused
+}
+
+// Type pretends to be an OpenAI model, the OpenAI functions agent refuses any other model.
+func (cm *ChatModel) Type() string {
+	return "chatmodel.OpenAI"
+}
+
+func (cm *ChatModel) Verbose() bool {
+	return false
+}
+
+func (cm *ChatModel) Callbacks() []schema.Callback {
+	return nil
+}
+
+func (cm *ChatModel) InvocationParams() map[string]any {
+	return map[string]any{"model_name": "fake"}
+}
+
+func (cm *ChatModel) GetTokenIDs(text string) ([]uint, error) {
+	ids := make([]uint, len(strings.Fields(text)))
+	for i := range ids {
+		ids[i] = uint(i)
+	}
+	return ids, nil
+}
+
+func (cm *ChatModel) GetNumTokens(text string) (uint, error) {
+	return uint(len(strings.Fields(text))), nil
+}
+
+func (cm *ChatModel) GetNumTokensFromMessage(messages schema.ChatMessages) (uint, error) {
+	var n uint
+	for _, m := range messages {
+		c, _ := cm.GetNumTokens(m.Content())
+		n += c
+	}
+	return n, nil
+}
@@ -0,0 +1,75 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/hupe1980/golc/schema"
+)
+
+var _ schema.Tool = (*Tool)(nil)
+
+// ToolResult is a canned result served by the Tool when its input contains Match.
+type ToolResult struct {
+	Match  string
+	Output string
+	Err    error
+}
+
+// Tool is a tool taking a plain string input which serves scripted results and records its inputs.
+type Tool struct {
+	mu      sync.Mutex
+	name    string
+	results []ToolResult
+	inputs  []string
+}
+
+func NewTool(name string, results ...ToolResult) *Tool {
+	return &Tool{
+		name:    name,
+		results: results,
+	}
+}
+
+func (t *Tool) Name() string {
+	return t.name
+}
+
+func (t *Tool) Description() string {
+	return fmt.Sprintf("Fake %s tool.", t.name)
+}
+
+func (t *Tool) ArgsType() reflect.Type {
+	return reflect.TypeOf("") // string
+}
+
+func (t *Tool) Run(ctx context.Context, input any) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	in := input.(string)
+	t.inputs = append(t.inputs, in)
+	for _, r := range t.results {
+		if strings.Contains(in, r.Match) {
+			return r.Output, r.Err
+		}
+	}
+	return "", fmt.Errorf("fake: no result matches input=[%s]", in)
+}
+
+// Inputs returns the inputs the tool was run with.
+func (t *Tool) Inputs() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.inputs...)
+}
+
+func (t *Tool) Verbose() bool {
+	return false
+}
+
+func (t *Tool) Callbacks() []schema.Callback {
+	return nil
+}
@@ -0,0 +1,174 @@
+package fsm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hupe1980/golc/prompt"
+	"github.com/hupe1980/golc/schema"
+	zLog "github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	DefaultMinScore = 6
+)
+
+// candidate is a sampled thought together with the critique that scored it.
+type candidate struct {
+	Thought  string  `json:"thought"`
+	Critique string  `json:"critique"`
+	Score    float64 `json:"score"`
+}
+
+// branch records the point in the think chat where a candidate was picked, along with the remaining candidates to
+// backtrack to.
+type branch struct {
+	turn         int
+	messages     int
+	chosen       candidate
+	alternatives []candidate
+}
+
+// HandleCandidateThoughts samples several candidate thoughts for the turn, each asked to take a different approach
+// from the ones before it.
+func (fsm *FSM) HandleCandidateThoughts(ctx context.Context, p schema.ChatMessage) (State, error) {
+	var thoughts []string
+	for i := 0; i < fsm.opts.Candidates; i++ {
+		// copied, so the candidates never share the backing array of the think chat
+		messages := append(append(schema.ChatMessages{}, fsm.thinkMessages...), p)
+		if len(thoughts) > 0 {
+			f := prompt.NewSystemMessageTemplate(alternativeCandidatePrompt)
+			a, err := f.Format(map[string]any{
+				"candidates": thoughts,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to render prompt: %w", err)
+			}
+			messages = append(messages, a)
+		}
+		res, err := fsm.ChatGenerate(ctx, messages)
+		if err != nil {
+			return nil, fmt.Errorf("failed to call chain: %w", err)
+		}
+		thoughts = append(thoughts, res.Content())
+	}
+
+	b, err := json.Marshal(map[string]any{
+		"type":       "candidates",
+		"candidates": thoughts,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal candidates: %w", err)
+	}
+	fsm.Emit(string(b))
+	return JudgeCandidates{Candidates: thoughts}, nil
+}
+
+func (fsm *FSM) HandleJudgeCandidatesState(ctx context.Context, state JudgeCandidates) (State, error) {
+	zLog.Debug().Msgf("state content: %v", state)
+	var candidates []candidate
+	for _, thought := range state.Candidates {
+		f := prompt.NewSystemMessageTemplate(scoreCritiquePrompt)
+		p, err := f.Format(map[string]any{
+			"problem": fsm.problem,
+			"think":   thought,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to render prompt: %w", err)
+		}
+
+		ctx, cancel := context.WithTimeout(withRole(ctx, RoleCritic), fsm.opts.ChatTimeout)
+		res, err := fsm.ChatGenerate(ctx, schema.ChatMessages{p})
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("failed to call chain: %w", err)
+		}
+		fsm.Emit(res.Content())
+		candidates = append(candidates, candidate{
+			Thought:  thought,
+			Critique: res.Content(),
+			Score:    gjson.Get(res.Content(), "score").Float(),
+		})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Score > candidates[j].Score
+	})
+
+	fsm.branches = append(fsm.branches, branch{
+		turn:         fsm.turn,
+		messages:     len(fsm.thinkMessages),
+		chosen:       candidates[0],
+		alternatives: candidates[1:],
+	})
+	return fsm.acceptCandidate(candidates[0])
+}
+
+// backtrack abandons the most recent branch which still has untried candidates and continues from its next best
+// candidate. It returns a nil state if there is nothing left to backtrack to.
+func (fsm *FSM) backtrack() (State, error) {
+	for len(fsm.branches) > 0 {
+		b := &fsm.branches[len(fsm.branches)-1]
+		if len(b.alternatives) == 0 {
+			fsm.branches = fsm.branches[:len(fsm.branches)-1]
+			continue
+		}
+		failed := b.chosen
+		b.chosen, b.alternatives = b.alternatives[0], b.alternatives[1:]
+		fsm.thinkMessages = fsm.thinkMessages[:b.messages]
+
+		f := prompt.NewSystemMessageTemplate(backtrackPrompt)
+		p, err := f.Format(map[string]any{
+			"turn":    b.turn,
+			"thought": failed.Thought,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to render prompt: %w", err)
+		}
+		bt, err := json.Marshal(map[string]any{
+			"type":    "backtrack",
+			"turn":    b.turn,
+			"thought": b.chosen.Thought,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal backtrack: %w", err)
+		}
+		fsm.Emit(string(bt))
+		fsm.appendThinkChat(p)
+		fsm.actionFailures = 0
+		return fsm.acceptCandidate(b.chosen)
+	}
+	return nil, nil
+}
+
+func (fsm *FSM) acceptCandidate(c candidate) (State, error) {
+	status := "bad"
+	if c.Score >= fsm.minScore() {
+		status = "good"
+	}
+	judge, err := json.Marshal(map[string]any{
+		"type":   "critique",
+		"status": status,
+		"score":  c.Score,
+		"reason": gjson.Get(c.Critique, "reason").String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal critique: %w", err)
+	}
+	tPrompt, err := nextTurnPrompt(fsm.turn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render turn prompt: %w", err)
+	}
+	fsm.Emit(c.Thought)
+	fsm.appendThinkChat(tPrompt, schema.NewAIChatMessage(c.Thought), schema.NewAIChatMessage(string(judge)))
+	return ThoughtDecider{Thought: c.Thought, JudgeMessage: string(judge)}, nil
+}
+
+func (fsm *FSM) minScore() float64 {
+	if fsm.opts.MinScore <= 0 {
+		return DefaultMinScore
+	}
+	return fsm.opts.MinScore
+}
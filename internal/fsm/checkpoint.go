@@ -0,0 +1,24 @@
+package fsm
+
+import (
+	"fmt"
+)
+
+// Checkpoint is a serializable snapshot of the progress of a run.
+type Checkpoint struct {
+	Problem    string    `json:"problem"`
+	Turn       int       `json:"turn"`
+	TokensUsed int       `json:"tokensUsed"`
+	State      string    `json:"state"`
+	Plan       *PlanTree `json:"plan,omitempty"`
+}
+
+func (fsm *FSM) Checkpoint() Checkpoint {
+	return Checkpoint{
+		Problem:    fsm.problem,
+		Turn:       fsm.turn,
+		TokensUsed: fsm.TokensUsed(),
+		State:      fmt.Sprintf("%T", fsm.state),
+		Plan:       fsm.plan,
+	}
+}
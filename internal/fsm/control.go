@@ -0,0 +1,175 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hupe1980/golc/prompt"
+	zLog "github.com/rs/zerolog/log"
+)
+
+var ErrNoApproval = errors.New("no action awaits approval")
+
+// Decisions of the operator on an action awaiting approval, the content of EventDecision.
+const (
+	DecisionApproved = "approved"
+	DecisionRejected = "rejected"
+)
+
+// AwaitApproval holds an accepted action until the operator approves or rejects it, see Options.RequireApproval.
+type AwaitApproval struct {
+	Action Action
+}
+
+type decision struct {
+	approved bool
+	reason   string
+}
+
+// control holds the requests of the operator until the state loop picks them up. Events are only notified by the
+// state loop, so they carry the turn and state the request took effect in.
+type control struct {
+	mu       sync.Mutex
+	paused   bool
+	resume   chan struct{}
+	hints    []string
+	approval chan decision
+}
+
+// Pause stops the run before its next state until Resume is called. The state being handled finishes first.
+func (fsm *FSM) Pause() {
+	fsm.control.mu.Lock()
+	defer fsm.control.mu.Unlock()
+	if !fsm.control.paused {
+		fsm.control.paused = true
+		fsm.control.resume = make(chan struct{})
+	}
+}
+
+// Resume continues a paused run.
+func (fsm *FSM) Resume() {
+	fsm.control.mu.Lock()
+	defer fsm.control.mu.Unlock()
+	if fsm.control.paused {
+		fsm.control.paused = false
+		close(fsm.control.resume)
+	}
+}
+
+// Paused reports whether the run is paused or about to pause.
+func (fsm *FSM) Paused() bool {
+	fsm.control.mu.Lock()
+	defer fsm.control.mu.Unlock()
+	return fsm.control.paused
+}
+
+// Hint adds a hint of the operator to the think chat before the next state, so the thinker sees it on its next call.
+func (fsm *FSM) Hint(hint string) {
+	fsm.control.mu.Lock()
+	defer fsm.control.mu.Unlock()
+	fsm.control.hints = append(fsm.control.hints, hint)
+}
+
+// Approve lets the action awaiting approval run.
+func (fsm *FSM) Approve() error {
+	return fsm.decide(decision{approved: true})
+}
+
+// Reject drops the action awaiting approval, the thinker is told the reason and asked for another thought.
+func (fsm *FSM) Reject(reason string) error {
+	return fsm.decide(decision{reason: reason})
+}
+
+func (fsm *FSM) decide(d decision) error {
+	fsm.control.mu.Lock()
+	defer fsm.control.mu.Unlock()
+	if fsm.control.approval == nil {
+		return ErrNoApproval
+	}
+	fsm.control.approval <- d
+	fsm.control.approval = nil
+	return nil
+}
+
+// applyControl blocks while the run is paused and then adds the pending hints to the think chat.
+func (fsm *FSM) applyControl(ctx context.Context) error {
+	fsm.control.mu.Lock()
+	paused, resume := fsm.control.paused, fsm.control.resume
+	fsm.control.mu.Unlock()
+	if paused {
+		zLog.Info().Msg("run paused")
+		fsm.notify(Event{Type: EventPause})
+		select {
+		case <-resume:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		zLog.Info().Msg("run resumed")
+		fsm.notify(Event{Type: EventResume})
+	}
+
+	fsm.control.mu.Lock()
+	hints := fsm.control.hints
+	fsm.control.hints = nil
+	fsm.control.mu.Unlock()
+	for _, hint := range hints {
+		f := prompt.NewSystemMessageTemplate(hintPrompt)
+		p, err := f.Format(map[string]any{
+			"hint": hint,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to render prompt: %w", err)
+		}
+		fsm.appendThinkChat(p)
+		fsm.notify(Event{Type: EventHint, Content: hint})
+	}
+	return nil
+}
+
+func (fsm *FSM) HandleAwaitApprovalState(ctx context.Context, state AwaitApproval) (State, error) {
+	zLog.Debug().Msgf("state content: %v", state)
+	approval := make(chan decision, 1)
+	fsm.control.mu.Lock()
+	fsm.control.approval = approval
+	fsm.control.mu.Unlock()
+	defer func() {
+		fsm.control.mu.Lock()
+		fsm.control.approval = nil
+		fsm.control.mu.Unlock()
+	}()
+
+	fsm.notify(Event{Type: EventApproval, Content: state.Action.describe()})
+	var d decision
+	select {
+	case d = <-approval:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if d.approved {
+		fsm.notify(Event{Type: EventDecision, Content: DecisionApproved})
+		return state.Action, nil
+	}
+
+	fsm.notify(Event{Type: EventDecision, Content: DecisionRejected, Error: d.reason})
+	f := prompt.NewSystemMessageTemplate(rejectedActionPrompt)
+	p, err := f.Format(map[string]any{
+		"action": state.Action.describe(),
+		"reason": d.reason,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render prompt: %w", err)
+	}
+	fsm.appendThinkChat(p)
+	return Next{}, nil
+}
+
+// describe returns the output of the action, or its tasks if it runs several.
+func (a Action) describe() string {
+	if len(a.Actions) == 0 {
+		return a.Output
+	}
+	return "- " + strings.Join(a.Actions, "\n- ")
+}
@@ -0,0 +1,162 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	customAgent "flow-gpt/internal/agent"
+	"flow-gpt/internal/redact"
+	"github.com/hupe1980/golc/schema"
+)
+
+type EventType string
+
+const (
+	// EventStart is sent once when Process starts.
+	EventStart EventType = "start"
+	// EventMessage is sent for every message emitted to the stream of the run.
+	EventMessage EventType = "message"
+	// EventTransition is sent each time the FSM moves to another state.
+	EventTransition EventType = "transition"
+	// EventAudit is sent for each audit record of an agent call as it is captured.
+	EventAudit EventType = "audit"
+	// EventChat is sent for each model call of the thinker and the critic with its prompt and response.
+	EventChat EventType = "chat"
+	// EventCritique is sent with the verdict of the critic on a thought or an action, the status is the content.
+	EventCritique EventType = "critique"
+	// EventRetry is sent each time a failed model or agent call is retried.
+	EventRetry EventType = "retry"
+	// EventFinish is sent once when Process returns, with the error if the run failed.
+	EventFinish EventType = "finish"
+	// EventPause and EventResume are sent when a run paused by the operator stops and continues.
+	EventPause  EventType = "pause"
+	EventResume EventType = "resume"
+	// EventHint is sent with a hint of the operator once it is added to the think chat.
+	EventHint EventType = "hint"
+	// EventApproval is sent with the output of an action which waits for the operator to approve it.
+	EventApproval EventType = "approval"
+	// EventDecision is sent with the decision of the operator on the action, the reason of a rejection is the error.
+	EventDecision EventType = "decision"
+	// EventDiff is sent once before EventFinish with the changes of the run to the git repository of its workspace,
+	// see Options.DiffBase.
+	EventDiff EventType = "diff"
+)
+
+// Reason tells why a run finished.
+type Reason string
+
+const (
+	ReasonCompleted Reason = "completed"
+	ReasonFailed    Reason = "failed"
+	// ReasonCancelled is the reason of a run whose context was cancelled.
+	ReasonCancelled Reason = "cancelled"
+	// ReasonBudgetExhausted is the reason of a run which reached MaxTurns or MaxTokens.
+	ReasonBudgetExhausted Reason = "budget_exhausted"
+)
+
+// reason classifies the error returned by a run.
+func reason(err error) Reason {
+	switch {
+	case err == nil:
+		return ReasonCompleted
+	case errors.Is(err, context.Canceled):
+		return ReasonCancelled
+	case errors.Is(err, ErrMaxTurns), errors.Is(err, ErrMaxTokens):
+		return ReasonBudgetExhausted
+	}
+	return ReasonFailed
+}
+
+// Event describes the progress of a run to observers.
+type Event struct {
+	Type    EventType            `json:"type"`
+	Turn    int                  `json:"turn"`
+	State   string               `json:"state"`
+	From    string               `json:"from,omitempty"`
+	Content string               `json:"content,omitempty"`
+	Prompt  []ChatMessage        `json:"prompt,omitempty"`
+	Audit   []customAgent.Record `json:"audit,omitempty"`
+	// Role is the role of the model of a chat or retry event.
+	Role  string `json:"role,omitempty"`
+	Model string `json:"model,omitempty"`
+	// Subject is what a critique judged, a thought or an action.
+	Subject string `json:"subject,omitempty"`
+	Tokens  int    `json:"tokens,omitempty"`
+	// PromptTokens and CompletionTokens are the parts of the tokens of a chat event.
+	PromptTokens     int           `json:"promptTokens,omitempty"`
+	CompletionTokens int           `json:"completionTokens,omitempty"`
+	Duration         time.Duration `json:"duration,omitempty"`
+	Error            string        `json:"error,omitempty"`
+	// Reason is why the run finished, set on the finish event.
+	Reason Reason    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+const (
+	RoleThinker = "thinker"
+	RoleCritic  = "critic"
+	RoleAgent   = "agent"
+)
+
+const (
+	SubjectThought = "thought"
+	SubjectAction  = "action"
+)
+
+type roleKey struct{}
+
+// withRole tells ChatGenerate which role the model plays for the call, calls default to RoleThinker.
+func withRole(ctx context.Context, role string) context.Context {
+	return context.WithValue(ctx, roleKey{}, role)
+}
+
+func roleFrom(ctx context.Context) string {
+	if role, ok := ctx.Value(roleKey{}).(string); ok {
+		return role
+	}
+	return RoleThinker
+}
+
+// ChatMessage is a message of a model prompt.
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// Observer is called synchronously for each event of a run, one event at a time.
+type Observer func(event Event)
+
+func redactRecord(r *redact.Redactor, record customAgent.Record) customAgent.Record {
+	record.Input = r.String(record.Input)
+	record.Output = r.String(record.Output)
+	record.Error = r.String(record.Error)
+	record.Log = r.String(record.Log)
+	return record
+}
+
+func chatEvent(ctx context.Context, messages []schema.ChatMessage, result schema.AIChatMessage) Event {
+	prompt := make([]ChatMessage, len(messages))
+	for i, m := range messages {
+		prompt[i] = ChatMessage{Role: string(m.Type()), Content: m.Content()}
+	}
+	return Event{Type: EventChat, Role: roleFrom(ctx), Prompt: prompt, Content: result.Content()}
+}
+
+func (fsm *FSM) notify(event Event) {
+	fsm.notifyMu.Lock()
+	defer fsm.notifyMu.Unlock()
+	event.Turn = fsm.turn
+	if event.State == "" {
+		event.State = StateName(fsm.state)
+	}
+	event.Time = time.Now()
+	event.Content = fsm.opts.Redactor.String(event.Content)
+	event.Error = fsm.opts.Redactor.String(event.Error)
+	for i := range event.Prompt {
+		event.Prompt[i].Content = fsm.opts.Redactor.String(event.Prompt[i].Content)
+	}
+	for _, o := range fsm.opts.Observers {
+		o(event)
+	}
+}
@@ -5,18 +5,20 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"net/http"
+	"io"
 	"os"
+	"sync"
 	"time"
 
 	customAgent "flow-gpt/internal/agent"
+	"flow-gpt/internal/cassette"
 	customIntegration "flow-gpt/internal/integration"
+	"flow-gpt/internal/redact"
+	"flow-gpt/internal/secret"
+	"flow-gpt/internal/telemetry"
 	customTool "flow-gpt/internal/tool"
 	"github.com/cenkalti/backoff"
-	"github.com/gorilla/websocket"
 	"github.com/hupe1980/golc"
-	"github.com/hupe1980/golc/agent"
 	"github.com/hupe1980/golc/model"
 	"github.com/hupe1980/golc/model/chatmodel"
 	"github.com/hupe1980/golc/prompt"
@@ -26,161 +28,427 @@ import (
 	"github.com/playwright-community/playwright-go"
 	zLog "github.com/rs/zerolog/log"
 	"github.com/tidwall/gjson"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Defaults of the options.
 const (
 	AgentTimeout = 30 * time.Second
 	ChatTimeout  = 30 * time.Second
+	ModelName    = "gpt-3.5-turbo-16k"
+	Temperature  = 0.05
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
+// GitTimeout bounds the git commands diffing the workspace, and MaxDiffLength the diff of the diff event.
+const (
+	GitTimeout    = 30 * time.Second
+	MaxDiffLength = 64 << 10
+)
+
+var (
+	ErrMaxTurns  = errors.New("turn limit reached")
+	ErrMaxTokens = errors.New("token limit reached")
+)
+
+const TracerName = "flow-gpt/internal/fsm"
 
 type State interface{}
 
+type Options struct {
+	// Plan enables the Plan state which decomposes the problem into a tree of subgoals after Init.
+	Plan bool
+	// MaxParallelActions bounds how many independent tasks of an Action run at once.
+	MaxParallelActions int
+	// Candidates is the number of candidate thoughts sampled and scored by the critic each turn, values below 2
+	// disable speculative branching.
+	Candidates int
+	// MinScore is the critic score a candidate thought needs to be accepted.
+	MinScore float64
+	// BacktrackAfter is the number of consecutive bad action critiques after which the FSM backtracks to the next
+	// best candidate of an earlier branch, 0 disables backtracking.
+	BacktrackAfter int
+	// Graph is the state graph to run, defaults to DefaultGraph.
+	Graph *Graph
+	// ChatModel is used by the thinker, the critic and the agent, defaults to OpenAI.
+	ChatModel schema.ChatModel
+	// ModelName and Temperature configure the default OpenAI model.
+	ModelName   string
+	Temperature float32
+	// ChatTimeout bounds a call of the thinker or the critic, AgentTimeout an agent call with its tools.
+	ChatTimeout  time.Duration
+	AgentTimeout time.Duration
+	// MaxTurns and MaxTokens stop the run once it has taken that many turns or used that many tokens of the thinker,
+	// the critic and the agent, 0 is unlimited.
+	MaxTurns  int
+	MaxTokens int
+	// Tools are the tools available to the agent, defaults to a headless browser, sleep and a terminal.
+	Tools []schema.Tool
+	// NoBrowser, NoTerminal and NoGit leave the browser, the terminal and git out of the default tools.
+	NoBrowser  bool
+	NoTerminal bool
+	NoGit      bool
+	// Workspace is the directory the default tools work in: the terminal runs its commands there, screenshots and
+	// downloads of the browser are saved there. Defaults to the working directory of the process. The default tools
+	// include git when it is a git repository.
+	Workspace string
+	// DiffBase is the commit of the workspace repository the run started from, the changes since are sent as a diff
+	// event when the run finishes.
+	DiffBase string
+	// MaxRetries bounds the retries of a failed model or agent call, 0 retries forever.
+	MaxRetries uint64
+	// Observers are notified of every event of the run.
+	Observers []Observer
+	// Cassette records the model and tool interactions of the run, or replays them without calling the model or
+	// running the tools.
+	Cassette *cassette.Cassette
+	// AuditWriter receives the audit records of every agent call as JSON Lines.
+	AuditWriter io.Writer
+	// TracerProvider traces the turns, states, model calls and tool invocations of the run, defaults to the global
+	// tracer provider.
+	TracerProvider trace.TracerProvider
+	// Secrets are substituted into the terminal commands of the default tools, the thinker and the agent only see
+	// their names.
+	Secrets *secret.Vault
+	// Redactor masks secrets in tool outputs, events and the audit log, defaults to the builtin patterns.
+	Redactor *redact.Redactor
+	// RequireApproval holds every accepted action in the AwaitApproval state until the operator approves or rejects
+	// it, see Approve and Reject.
+	RequireApproval bool
+}
+
 type FSM struct {
-	openaiChat    *chatmodel.OpenAI
-	actionAgent   *agent.Executor
-	Browser       playwright.Browser
-	thinkMessages schema.ChatMessages
-	problem       string
-	turn          int
-	tokensUsed    int
-	state         State
-	stream        chan string
-}
-
-func New(problem string, turn int) (*FSM, error) {
-	pw, err := playwright.Run()
-	if err != nil {
-		return nil, err
+	openaiChat     schema.ChatModel
+	tools          []schema.Tool
+	Browser        playwright.Browser
+	thinkMessages  schema.ChatMessages
+	problem        string
+	turn           int
+	tokensUsed     int
+	agentTokens    int
+	state          State
+	stream         chan string
+	plan           *PlanTree
+	branches       []branch
+	actionFailures int
+	graph          *Graph
+	tracer         trace.Tracer
+	// auditMu guards the token counters and the audit log
+	auditMu  sync.Mutex
+	notifyMu sync.Mutex
+	control  control
+	opts     Options
+}
+
+func New(problem string, turn int, optFns ...func(o *Options)) (*FSM, error) {
+	opts := Options{
+		ModelName:    ModelName,
+		Temperature:  Temperature,
+		ChatTimeout:  ChatTimeout,
+		AgentTimeout: AgentTimeout,
+	}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	if opts.Graph == nil {
+		opts.Graph = DefaultGraph()
+	}
+	if err := opts.Graph.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid state graph: %w", err)
 	}
 
-	browser, err := pw.Chromium.Launch()
-	if err != nil {
-		return nil, err
+	var browser playwright.Browser
+	tools := opts.Tools
+	replay := opts.Cassette != nil && opts.Cassette.Mode() == cassette.ModeReplay
+	if tools == nil && !replay {
+		if !opts.NoBrowser {
+			pw, err := playwright.Run()
+			if err != nil {
+				return nil, err
+			}
+
+			browser, err = pw.Chromium.Launch()
+			if err != nil {
+				return nil, err
+			}
+			// the browser tools use the first context, created here to save its downloads
+			bc, err := browser.NewContext(playwright.BrowserNewContextOptions{AcceptDownloads: playwright.Bool(true)})
+			if err != nil {
+				return nil, err
+			}
+			customTool.SaveDownloads(bc, opts.Workspace)
+
+			browserKit, err := toolkit.NewBrowser(browser)
+			if err != nil {
+				return nil, err
+			}
+			tools = append(tools, browserKit.Tools()...)
+			tools = append(tools, customTool.NewScreenshot(browser, opts.Workspace))
+		}
+
+		tools = append(tools, tool.NewSleep())
+		if !opts.NoTerminal {
+			tools = append(tools, customTool.NewTerminal(customIntegration.NewBashProcess(func(o *customIntegration.BashProcessOptions) {
+				o.Secrets = opts.Secrets
+				o.Dir = opts.Workspace
+			})))
+		}
+		if !opts.NoGit && opts.Workspace != "" && customIntegration.IsGitRepo(opts.Workspace) {
+			tools = append(tools, customTool.NewGit(customIntegration.NewGit(opts.Workspace)))
+		}
 	}
 
-	browserKit, err := toolkit.NewBrowser(browser)
-	if err != nil {
-		return nil, err
+	if opts.Redactor == nil {
+		var err error
+		opts.Redactor, err = redact.New()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// redact before recording, so cassettes hold no secrets either
+	tools = opts.Redactor.WrapTools(tools)
+	if opts.Cassette != nil {
+		tools = opts.Cassette.WrapTools(tools)
 	}
 
-	var tools []schema.Tool
-	tools = append(tools, browserKit.Tools()...)
-	tools = append(tools, tool.NewSleep())
-	tools = append(tools, customTool.NewTerminal(customIntegration.NewBashProcess()))
+	openaiChat := opts.ChatModel
+	if openaiChat == nil && !replay {
+		var err error
+		openaiChat, err = chatmodel.NewOpenAI(os.Getenv("OPENAI_API_KEY"), func(o *chatmodel.OpenAIOptions) {
+			o.ModelName = opts.ModelName
+			o.Temperature = opts.Temperature
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opts.Cassette != nil {
+		openaiChat = opts.Cassette.ChatModel(openaiChat)
+		if !replay {
+			opts.Cassette.SetProblem(problem)
+		}
+	}
 
-	openaiChat, err := chatmodel.NewOpenAI(os.Getenv("OPENAI_API_KEY"), func(o *chatmodel.OpenAIOptions) {
-		o.ModelName = "gpt-3.5-turbo-16k"
-		o.Temperature = 0.05
-	})
-	if err != nil {
+	// fail early if the agent can't be built, an executor is created for each agent call
+	if _, err := customAgent.NewExecutor(openaiChat, tools); err != nil {
 		return nil, err
 	}
 
-	actionAgent, err := agent.NewOpenAIFunctions(openaiChat, tools)
-	if err != nil {
-		return nil, err
+	tp := opts.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
 	}
 
 	stream := make(chan string, 1)
 	stream <- "Problem: " + problem
 	return &FSM{
 		openaiChat:    openaiChat,
-		actionAgent:   actionAgent,
+		tools:         tools,
 		Browser:       browser,
 		thinkMessages: schema.ChatMessages{},
 		problem:       problem,
 		turn:          turn,
 		state:         Init{},
 		stream:        stream,
+		graph:         opts.Graph,
+		tracer:        tp.Tracer(TracerName),
+		opts:          opts,
 	}, nil
 }
 
-func (fsm *FSM) Process(ctx context.Context) {
+// Process runs the state graph until a terminal state is handled, a handler fails or the context is done.
+func (fsm *FSM) Process(ctx context.Context) error {
+	fsm.notify(Event{Type: EventStart, Content: fsm.problem})
+	err := fsm.process(ctx)
+	if fsm.opts.DiffBase != "" && fsm.opts.Workspace != "" {
+		fsm.notifyDiff()
+	}
+	finish := Event{Type: EventFinish, Tokens: fsm.TokensUsed(), Reason: reason(err)}
+	if err != nil {
+		finish.Error = err.Error()
+	}
+	fsm.notify(finish)
+	return err
+}
+
+// notifyDiff sends the changes to the workspace repository since DiffBase, also when the run was cancelled.
+func (fsm *FSM) notifyDiff() {
+	ctx, cancel := context.WithTimeout(context.Background(), GitTimeout)
+	defer cancel()
+	event := Event{Type: EventDiff}
+	diff, err := customIntegration.NewGit(fsm.opts.Workspace).Diff(ctx, fsm.opts.DiffBase)
+	if err != nil {
+		zLog.Error().Err(err).Msg("failed to diff the workspace")
+		event.Error = err.Error()
+	}
+	if len(diff) > MaxDiffLength {
+		diff = diff[:MaxDiffLength] + fmt.Sprintf("\n... diff cut at %d bytes", MaxDiffLength)
+	}
+	event.Content = diff
+	fsm.notify(event)
+}
+
+func (fsm *FSM) process(ctx context.Context) (err error) {
+	ctx, span := fsm.tracer.Start(ctx, "run", trace.WithAttributes(attribute.String("problem", fsm.problem)))
+	defer func() { endSpan(span, err) }()
+	turnCtx, turnSpan := fsm.startTurn(ctx)
+	defer func() { endSpan(turnSpan, err) }()
 	for {
 		zLog.Info().Msg("turn: " + fmt.Sprint(fsm.turn))
 		select {
 		case <-ctx.Done():
 			zLog.Info().Msg("shutting down state loop")
-			return
+			return ctx.Err()
 		default:
-			var err error
+			if err := fsm.applyControl(ctx); err != nil {
+				return err
+			}
 			zLog.Info().Msgf("state: %v", fsm.state)
-			switch msg := fsm.state.(type) {
-			case Action:
-				err = fsm.HandleActionState(msg)
-			case Next:
-				err = fsm.HandleNextThought(msg)
-				fsm.turn++
-			case Complete:
-				err = fsm.HandleCompleteState(msg)
-				return
-			case Init:
-				err = fsm.HandleInitState(msg)
-				fsm.turn++
-			case JudgeAction:
-				err = fsm.HandleJudgeActionState(msg)
-			case JudgeThought:
-				err = fsm.HandleJudgeThoughtState(msg)
-			case ThoughtDecider:
-				err = fsm.HandleThoughtDeciderState(msg)
-				fsm.turn++
-			default:
-				zLog.Fatal().Msg("unknown message")
+			name := StateName(fsm.state)
+			def, err := fsm.graph.lookup(fsm.state)
+			if err != nil {
+				return err
 			}
+			stateCtx, stateSpan := fsm.tracer.Start(turnCtx, "state "+name, trace.WithAttributes(attribute.String("state", name)))
+			next, err := def.Handler(stateCtx, fsm, fsm.state)
+			endSpan(stateSpan, err)
 			if err != nil {
-				zLog.Error().Msgf("failed to handle state: %v", err)
-				return
+				return fmt.Errorf("failed to handle state %s: %w", name, err)
+			}
+			if def.Turn {
+				fsm.turn++
+				turnSpan.End()
+				turnCtx, turnSpan = fsm.startTurn(ctx)
+			}
+			if def.Terminal {
+				return nil
+			}
+			if err = fsm.checkBudget(); err != nil {
+				return err
 			}
+			if err = fsm.graph.checkTransition(name, next); err != nil {
+				return err
+			}
+			fsm.SetState(next)
+			fsm.notify(Event{Type: EventTransition, From: name})
 		}
 	}
 }
 
+// checkBudget fails once the run has reached its turn or token limit.
+func (fsm *FSM) checkBudget() error {
+	if fsm.opts.MaxTurns > 0 && fsm.turn >= fsm.opts.MaxTurns {
+		return fmt.Errorf("%w: %d turns", ErrMaxTurns, fsm.turn)
+	}
+	if used := fsm.TokensUsed(); fsm.opts.MaxTokens > 0 && used >= fsm.opts.MaxTokens {
+		return fmt.Errorf("%w: %d tokens", ErrMaxTokens, used)
+	}
+	return nil
+}
+
+// TokensUsed returns the tokens used by the thinker, the critic and the agent so far.
+func (fsm *FSM) TokensUsed() int {
+	fsm.auditMu.Lock()
+	defer fsm.auditMu.Unlock()
+	return fsm.tokensUsed + fsm.agentTokens
+}
+
+func (fsm *FSM) startTurn(ctx context.Context) (context.Context, trace.Span) {
+	return fsm.tracer.Start(ctx, "turn", trace.WithAttributes(attribute.Int("turn", fsm.turn)))
+}
+
+// endSpan ends the span, marking it as failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
 func (fsm *FSM) SetState(state State) {
 	fsm.state = state
 }
 
-func (fsm *FSM) HandleNextThought(state Next) error {
+// Emit sends a message to the stream of the run.
+func (fsm *FSM) Emit(msg string) {
+	msg = fsm.opts.Redactor.String(msg)
+	fsm.notify(Event{Type: EventMessage, Content: msg})
+	fsm.stream <- msg
+}
+
+// Stream returns the messages emitted by the run, Emit blocks until they are received.
+func (fsm *FSM) Stream() <-chan string {
+	return fsm.stream
+}
+
+// Close releases the browser launched for the default tools.
+func (fsm *FSM) Close() error {
+	if fsm.Browser == nil {
+		return nil
+	}
+	return fsm.Browser.Close()
+}
+
+// Graph returns the state graph of the run.
+func (fsm *FSM) Graph() *Graph {
+	return fsm.graph
+}
+
+func (fsm *FSM) Problem() string {
+	return fsm.problem
+}
+
+func (fsm *FSM) Turn() int {
+	return fsm.turn
+}
+
+func (fsm *FSM) HandleNextThought(ctx context.Context, state Next) (State, error) {
 	zLog.Debug().Msgf("state content: %v", state)
 	f := prompt.NewSystemMessageTemplate(nextPrompt)
 	p, err := f.Format(map[string]any{
 		"turn":    fsm.turn,
 		"problem": fsm.problem,
+		"subgoal": fsm.currentSubgoal(),
+		"plan":    fsm.plan,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to render prompt: %w", err)
+		return nil, fmt.Errorf("failed to render prompt: %w", err)
+	}
+	if fsm.opts.Candidates > 1 {
+		return fsm.HandleCandidateThoughts(ctx, p)
 	}
 	tPrompt, err := nextTurnPrompt(fsm.turn)
 	if err != nil {
-		return fmt.Errorf("failed to render turn prompt: %w", err)
+		return nil, fmt.Errorf("failed to render turn prompt: %w", err)
 	}
-	res, err := fsm.ChatGenerate(context.Background(), append(fsm.thinkMessages, schema.ChatMessages{p}...))
+	res, err := fsm.ChatGenerate(ctx, append(fsm.thinkMessages, schema.ChatMessages{p}...))
 	if err != nil {
-		return fmt.Errorf("failed to call chain: %w", err)
+		return nil, fmt.Errorf("failed to call chain: %w", err)
 	}
-	fsm.stream <- res.Content()
+	fsm.Emit(res.Content())
 	fsm.appendThinkChat(tPrompt, res)
-	fsm.SetState(JudgeThought{Message: res.Content()})
-	return nil
+	return JudgeThought{Message: res.Content()}, nil
 }
 
-func (fsm *FSM) HandleActionState(state Action) error {
+func (fsm *FSM) HandleActionState(ctx context.Context, state Action) (State, error) {
 	zLog.Debug().Msgf("state content: %v", state)
+	if len(state.Actions) > 0 {
+		return fsm.HandleParallelActions(ctx, state)
+	}
 	f := prompt.NewFormatter(agentPrompt)
 	p, err := f.Render(map[string]any{
 		"problem":   state.Output,
 		"resources": state.Resources,
+		"secrets":   fsm.opts.Secrets.Names(),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to render prompt: %w", err)
+		return nil, fmt.Errorf("failed to render prompt: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), AgentTimeout)
+	ctx, cancel := context.WithTimeout(ctx, fsm.opts.AgentTimeout)
 	defer cancel()
 	res, auditLog, err := fsm.AgentGenerate(ctx, p)
 	if err != nil {
@@ -192,14 +460,13 @@ func (fsm *FSM) HandleActionState(state Action) error {
 				"auditLog": auditLog,
 			})
 			if err != nil {
-				return fmt.Errorf("failed to render prompt: %w", err)
+				return nil, fmt.Errorf("failed to render prompt: %w", err)
 			}
-			fsm.stream <- actionRes.Content()
+			fsm.Emit(actionRes.Content())
 			fsm.appendThinkChat(actionRes)
-			fsm.SetState(JudgeAction{Problem: state.Output, Message: agentFailure + bashErr.Error(), AuditLog: auditLog})
-			return nil
+			return JudgeAction{Problem: state.Output, Message: agentFailure + bashErr.Error(), AuditLog: auditLog}, nil
 		} else {
-			return fmt.Errorf("failed to call agent: %w", err)
+			return nil, fmt.Errorf("failed to call agent: %w", err)
 		}
 	}
 	resF := prompt.NewSystemMessageTemplate(actionOutputPrompt)
@@ -208,69 +475,119 @@ func (fsm *FSM) HandleActionState(state Action) error {
 		"auditLog": escape(auditLog),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to render prompt: %w", err)
+		return nil, fmt.Errorf("failed to render prompt: %w", err)
 	}
-	fsm.stream <- actionRes.Content()
+	fsm.Emit(actionRes.Content())
 	fsm.appendThinkChat(actionRes)
-	fsm.SetState(JudgeAction{Problem: state.Output, Message: res, AuditLog: auditLog})
-	return nil
+	return JudgeAction{Problem: state.Output, Message: res, AuditLog: auditLog}, nil
 }
 
-func (fsm *FSM) HandleCompleteState(state Complete) error {
+func (fsm *FSM) HandleCompleteState(ctx context.Context, state Complete) (State, error) {
 	zLog.Debug().Msgf("state content: %v", state)
-	fsm.stream <- fmt.Sprintf("Completed! Tokens used: %d", fsm.tokensUsed)
-	return nil
+	fsm.Emit(fmt.Sprintf("Completed! Tokens used: %d", fsm.TokensUsed()))
+	return nil, nil
 }
 
-func (fsm *FSM) HandleInitState(state Init) error {
+func (fsm *FSM) HandleInitState(ctx context.Context, state Init) (State, error) {
 	zLog.Debug().Msgf("state content: %v", state)
+	rTemplate := prompt.NewSystemMessageTemplate(rulesPrompt)
+	rFormat, err := rTemplate.Format(map[string]any{
+		"secrets": fsm.opts.Secrets.Names(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render rules prompt: %w", err)
+	}
+	if fsm.opts.Plan {
+		fsm.appendThinkChat(rFormat)
+		return Plan{}, nil
+	}
 	f := prompt.NewSystemMessageTemplate(entryPrompt)
 	p, err := f.Format(map[string]any{
 		"problem": fsm.problem,
+		"secrets": fsm.opts.Secrets.Names(),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to render prompt: %w", err)
+		return nil, fmt.Errorf("failed to render prompt: %w", err)
 	}
-	rTemplate := prompt.NewSystemMessageTemplate(rulesPrompt)
-	rFormat, err := rTemplate.Format(map[string]any{})
-	if err != nil {
-		return fmt.Errorf("failed to render rules prompt: %w", err)
-	}
-	res, err := fsm.ChatGenerate(context.Background(), schema.ChatMessages{p})
+	res, err := fsm.ChatGenerate(ctx, schema.ChatMessages{p})
 	if err != nil {
-		return fmt.Errorf("failed to call chain: %w", err)
+		return nil, fmt.Errorf("failed to call chain: %w", err)
 	}
-	fsm.stream <- res.Content()
+	fsm.Emit(res.Content())
 	fsm.appendThinkChat(rFormat, res)
-	fsm.SetState(JudgeThought{Message: res.Content()})
-	return nil
+	return JudgeThought{Message: res.Content()}, nil
 }
 
-func (fsm *FSM) HandleJudgeActionState(state JudgeAction) error {
+func (fsm *FSM) HandleJudgeActionState(ctx context.Context, state JudgeAction) (State, error) {
 	zLog.Debug().Msgf("state content: %v", state)
 	f := prompt.NewSystemMessageTemplate(analyseActionPrompt)
 	p, err := f.Format(map[string]any{
 		"problem":  state.Problem,
 		"output":   state.Message,
 		"auditLog": state.AuditLog,
+		"subgoal":  fsm.currentSubgoal(),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to render prompt: %w", err)
+		return nil, fmt.Errorf("failed to render prompt: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), ChatTimeout)
+	ctx, cancel := context.WithTimeout(withRole(ctx, RoleCritic), fsm.opts.ChatTimeout)
 	defer cancel()
 	res, err := fsm.ChatGenerate(ctx, schema.ChatMessages{p}) // todo wait for gpt-35-turbo-instruct, till then pass 1 message
 	if err != nil {
-		return fmt.Errorf("failed to call chain: %w", err)
+		return nil, fmt.Errorf("failed to call chain: %w", err)
 	}
-	fsm.stream <- res.Content()
+	fsm.Emit(res.Content())
 	fsm.appendThinkChat(res)
-	fsm.SetState(Next{})
-	return nil
+	fsm.notify(Event{Type: EventCritique, Subject: SubjectAction, Content: gjson.Get(res.Content(), "status").String()})
+	if fsm.plan != nil && gjson.Get(res.Content(), "status").String() == "good" && gjson.Get(res.Content(), "subgoalDone").Bool() {
+		fsm.plan.CompleteCurrent()
+		fsm.Emit(planEvent(fsm.plan))
+	}
+	if gjson.Get(res.Content(), "status").String() == "bad" {
+		fsm.actionFailures++
+	} else {
+		fsm.actionFailures = 0
+	}
+	if fsm.opts.BacktrackAfter > 0 && fsm.actionFailures >= fsm.opts.BacktrackAfter {
+		next, err := fsm.backtrack()
+		if err != nil {
+			return nil, fmt.Errorf("failed to backtrack: %w", err)
+		}
+		if next != nil {
+			return next, nil
+		}
+	}
+	return Next{}, nil
+}
+
+func (fsm *FSM) HandlePlanState(ctx context.Context, state Plan) (State, error) {
+	zLog.Debug().Msgf("state content: %v", state)
+	f := prompt.NewSystemMessageTemplate(planPrompt)
+	p, err := f.Format(map[string]any{
+		"problem": fsm.problem,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render prompt: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fsm.opts.ChatTimeout)
+	defer cancel()
+	res, err := fsm.ChatGenerate(ctx, schema.ChatMessages{p})
+	if err != nil {
+		return nil, fmt.Errorf("failed to call chain: %w", err)
+	}
+	plan, err := parsePlan(res.Content())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse plan: %w", err)
+	}
+	fsm.plan = plan
+	fsm.Emit(planEvent(plan))
+	fsm.appendThinkChat(res)
+	return Next{}, nil
 }
 
-func (fsm *FSM) HandleJudgeThoughtState(state JudgeThought) error {
+func (fsm *FSM) HandleJudgeThoughtState(ctx context.Context, state JudgeThought) (State, error) {
 	zLog.Debug().Msgf("state content: %v", state)
 	f := prompt.NewSystemMessageTemplate(thinkCritiquePrompt)
 	p, err := f.Format(map[string]any{
@@ -278,100 +595,135 @@ func (fsm *FSM) HandleJudgeThoughtState(state JudgeThought) error {
 		"think":   state.Message,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to render prompt: %w", err)
+		return nil, fmt.Errorf("failed to render prompt: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), ChatTimeout)
+	ctx, cancel := context.WithTimeout(withRole(ctx, RoleCritic), fsm.opts.ChatTimeout)
 	defer cancel()
 	res, err := fsm.ChatGenerate(ctx, schema.ChatMessages{p}) // todo wait for gpt-35-turbo-instruct, till then pass 1 message
 	if err != nil {
-		return fmt.Errorf("failed to call chain: %w", err)
+		return nil, fmt.Errorf("failed to call chain: %w", err)
 	}
-	fsm.stream <- res.Content()
+	fsm.Emit(res.Content())
 	fsm.appendThinkChat(res)
-	fsm.SetState(ThoughtDecider{Thought: state.Message, JudgeMessage: res.Content()})
-	return nil
+	return ThoughtDecider{Thought: state.Message, JudgeMessage: res.Content()}, nil
 }
 
-func (fsm *FSM) HandleThoughtDeciderState(state ThoughtDecider) error {
+func (fsm *FSM) HandleThoughtDeciderState(ctx context.Context, state ThoughtDecider) (State, error) {
 	zLog.Debug().Msgf("state content: %v", state)
+	fsm.notify(Event{Type: EventCritique, Subject: SubjectThought, Content: gjson.Get(state.JudgeMessage, "status").String()})
 	if gjson.Get(state.JudgeMessage, "status").String() == "good" {
 		if gjson.Get(state.Thought, "type").String() == "complete" {
-			fsm.SetState(Complete{})
-			return nil
+			return Complete{}, nil
 		} else if gjson.Get(state.Thought, "type").String() == "agent" {
 			aMsg, err := unmarshalAction(state.Thought)
 			if err != nil {
-				return fmt.Errorf("failed to unmarshal action message: %w", err)
+				return nil, fmt.Errorf("failed to unmarshal action message: %w", err)
+			}
+			if fsm.opts.RequireApproval {
+				return AwaitApproval{Action: aMsg}, nil
 			}
-			fsm.SetState(aMsg)
+			return aMsg, nil
 		} else {
-			return errors.New("unknown thought type")
+			return nil, errors.New("unknown thought type")
 		}
 	} else if gjson.Get(state.JudgeMessage, "status").String() == "bad" {
 		f := prompt.NewSystemMessageTemplate(badCritiqueReceivedPrompt)
 		p, err := f.Format(map[string]any{
-			"turn": fsm.turn,
+			"turn":    fsm.turn,
+			"subgoal": fsm.currentSubgoal(),
 		})
 		if err != nil {
-			return fmt.Errorf("failed to render prompt: %w", err)
+			return nil, fmt.Errorf("failed to render prompt: %w", err)
 		}
 		tPrompt, err := nextTurnPrompt(fsm.turn)
 		if err != nil {
-			return fmt.Errorf("failed to render turn prompt: %w", err)
+			return nil, fmt.Errorf("failed to render turn prompt: %w", err)
 		}
-		res, err := fsm.ChatGenerate(context.Background(), append(fsm.thinkMessages, schema.ChatMessages{p}...))
+		res, err := fsm.ChatGenerate(ctx, append(fsm.thinkMessages, schema.ChatMessages{p}...))
 		if err != nil {
-			return fmt.Errorf("failed to call chain: %w", err)
+			return nil, fmt.Errorf("failed to call chain: %w", err)
 		}
-		fsm.stream <- res.Content()
+		fsm.Emit(res.Content())
 		fsm.appendThinkChat(tPrompt, res)
-		fsm.SetState(JudgeThought{Message: res.Content()})
+		return JudgeThought{Message: res.Content()}, nil
 	} else {
-		return fmt.Errorf("not implemented message: %v", state)
+		return nil, fmt.Errorf("not implemented message: %v", state)
 	}
-	return nil
 }
 
 func (fsm *FSM) ChatGenerate(ctx context.Context, messages []schema.ChatMessage) (schema.AIChatMessage, error) {
 	var result schema.AIChatMessage
 	var err error
-	operation := func() error {
+	ctx = cassette.WithSource(ctx, cassette.SourceChat)
+	ctx, span := fsm.tracer.Start(ctx, "chat.generate")
+	operation := fsm.attempts(ctx, func(ctx context.Context) error {
+		start := time.Now()
 		r, err := model.ChatModelGenerate(ctx, fsm.openaiChat, messages)
 		if err != nil {
 			return fmt.Errorf("error calling chain: %w", err)
 		}
 		zLog.Info().Msgf("token usage: %v", r.LLMOutput)
-		fsm.tokensUsed += r.LLMOutput["TokenUsage"].(map[string]int)["TotalTokens"]
+		// a model which doesn't report its usage counts no tokens
+		usage, ok := r.LLMOutput["TokenUsage"].(map[string]int)
+		if !ok {
+			zLog.Warn().Msg("no token usage in the chat response")
+		}
+		tokens := usage["TotalTokens"]
+		fsm.auditMu.Lock()
+		fsm.tokensUsed += tokens
+		fsm.auditMu.Unlock()
+		modelName, ok := r.LLMOutput["ModelName"].(string)
+		if !ok {
+			modelName = fsm.openaiChat.Type()
+		}
+		trace.SpanFromContext(ctx).SetAttributes(telemetry.AttrModel.String(modelName))
+		span.SetAttributes(append(telemetry.TokenAttributes(usage["PromptTokens"], usage["CompletionTokens"], tokens), telemetry.AttrModel.String(modelName))...)
 		msg, ok := r.Generations[0].Message.(*schema.AIChatMessage)
 		if !ok {
 			return backoff.Permanent(errors.New("unexpected result type"))
 		}
 		result = *msg
+		event := chatEvent(ctx, messages, result)
+		event.Model, event.Tokens, event.Duration = modelName, tokens, time.Since(start)
+		event.PromptTokens, event.CompletionTokens = usage["PromptTokens"], usage["CompletionTokens"]
+		fsm.notify(event)
 		return nil
-	}
+	})
 
 	notify := func(err error, t time.Duration) {
 		zLog.Error().Err(err).Msg("Operation failed. Retrying...")
+		fsm.notify(Event{Type: EventRetry, Role: roleFrom(ctx), Error: err.Error()})
 	}
 
-	err = backoff.RetryNotify(operation, backoff.NewConstantBackOff(time.Second), notify)
+	err = backoff.RetryNotify(operation, fsm.backOff(), notify)
+	endSpan(span, err)
 	if err != nil {
 		return schema.AIChatMessage{}, err
 	}
 	return result, nil
 }
 
+// AgentGenerate runs the input on a new agent executor and returns its output and audit log.
 func (fsm *FSM) AgentGenerate(ctx context.Context, input string) (string, string, error) {
 	var result string
 	var auditLog string
 	var err error
-	operation := func() error {
-		aLog := customAgent.NewCallbackAuditLog()
-		result, err = golc.SimpleCall(ctx, fsm.actionAgent, input, func(o *golc.SimpleCallOptions) {
+	ctx = cassette.WithSource(ctx, cassette.SourceAgent)
+	ctx, span := fsm.tracer.Start(ctx, "agent.generate")
+	operation := fsm.attempts(ctx, func(ctx context.Context) error {
+		spans := telemetry.NewAuditSpans(ctx, fsm.tracer)
+		defer spans.End()
+		aLog := customAgent.NewCallbackAuditLog(fsm.auditSink, spans.Sink)
+		executor, err := customAgent.NewExecutor(fsm.openaiChat, fsm.tools, aLog)
+		if err != nil {
+			return backoff.Permanent(fmt.Errorf("failed to create agent: %w", err))
+		}
+		result, err = golc.SimpleCall(ctx, executor, input, func(o *golc.SimpleCallOptions) {
 			o.Callbacks = []schema.Callback{aLog}
 		})
 		auditLog = aLog.AuditLog()
+		zLog.Debug().Msgf("audit log:\n%s", customAgent.HumanReadable(aLog.Records()))
 		if err != nil {
 			var bashErr customIntegration.BashProcessError
 			if errors.As(err, &bashErr) {
@@ -381,13 +733,15 @@ func (fsm *FSM) AgentGenerate(ctx context.Context, input string) (string, string
 			}
 		}
 		return nil
-	}
+	})
 
 	notify := func(err error, t time.Duration) {
 		zLog.Error().Err(err).Msg("Operation failed. Retrying...")
+		fsm.notify(Event{Type: EventRetry, Role: RoleAgent, Error: err.Error()})
 	}
 
-	err = backoff.RetryNotify(operation, backoff.NewConstantBackOff(time.Second), notify)
+	err = backoff.RetryNotify(operation, fsm.backOff(), notify)
+	endSpan(span, err)
 	if err != nil {
 		return "", auditLog, err
 	}
@@ -397,6 +751,60 @@ func (fsm *FSM) AgentGenerate(ctx context.Context, input string) (string, string
 	return result, auditLog, nil
 }
 
+// attempts traces each attempt of a retried operation as a span below the span of ctx.
+func (fsm *FSM) attempts(ctx context.Context, operation func(ctx context.Context) error) backoff.Operation {
+	n := 0
+	return func() error {
+		n++
+		ctx, span := fsm.tracer.Start(ctx, "attempt", trace.WithAttributes(attribute.Int("attempt", n)))
+		err := operation(ctx)
+		endSpan(span, err)
+		return err
+	}
+}
+
+// auditSink exports and publishes each audit record as it is captured, agent calls of parallel tasks share it.
+func (fsm *FSM) auditSink(record customAgent.Record) {
+	record = redactRecord(fsm.opts.Redactor, record)
+	fsm.auditMu.Lock()
+	if record.Tokens != nil {
+		fsm.agentTokens += record.Tokens.Total
+	}
+	if fsm.opts.AuditWriter != nil {
+		if err := customAgent.WriteJSONLines(fsm.opts.AuditWriter, []customAgent.Record{record}); err != nil {
+			zLog.Error().Err(err).Msg("failed to export audit log")
+		}
+	}
+	fsm.auditMu.Unlock()
+	fsm.notify(Event{Type: EventAudit, Audit: []customAgent.Record{record}})
+}
+
+func (fsm *FSM) currentSubgoal() *Subgoal {
+	if fsm.plan == nil {
+		return nil
+	}
+	return fsm.plan.Current()
+}
+
+func planEvent(plan *PlanTree) string {
+	b, err := json.Marshal(map[string]any{
+		"type": "plan",
+		"plan": plan,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+func (fsm *FSM) backOff() backoff.BackOff {
+	var b backoff.BackOff = backoff.NewConstantBackOff(time.Second)
+	if fsm.opts.MaxRetries > 0 {
+		b = backoff.WithMaxRetries(b, fsm.opts.MaxRetries)
+	}
+	return b
+}
+
 func unmarshalAction(action string) (Action, error) {
 	r := Action{}
 	err := json.Unmarshal([]byte(action), &r)
@@ -429,20 +837,3 @@ func nextTurnPrompt(turn int) (schema.ChatMessage, error) {
 func (fsm *FSM) appendThinkChat(chat ...schema.ChatMessage) {
 	fsm.thinkMessages = append(fsm.thinkMessages, chat...)
 }
-
-func (fsm *FSM) Handler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Print("Upgrade: ", err)
-		return
-	}
-	defer conn.Close()
-
-	for {
-		out := <-fsm.stream
-		if err = conn.WriteMessage(websocket.TextMessage, []byte(out)); err != nil {
-			log.Println("Write: ", err)
-			break
-		}
-	}
-}
@@ -0,0 +1,931 @@
+package fsm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	customAgent "flow-gpt/internal/agent"
+	"flow-gpt/internal/cassette"
+	"flow-gpt/internal/fake"
+	"flow-gpt/internal/integration"
+	"flow-gpt/internal/secret"
+	"flow-gpt/internal/telemetry"
+	"github.com/hupe1980/golc/schema"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	initPrompt         = "Let's start working on the problem"
+	nextThoughtPrompt  = "Review the history from previous turns"
+	badThoughtPrompt   = "You have provided a bad solution"
+	judgeThoughtPrompt = "critically evaluate and analyze"
+	judgeActionPrompt  = "analyze and validate the completed tasks"
+)
+
+var (
+	agentThought    = `{"resources":{},"type":"agent","thought":"list the files","output":"Run ls in the terminal."}`
+	completeThought = `{"resources":{},"type":"complete","thought":"the files were listed"}`
+	goodCritique    = `{"type":"critique","status":"good","reason":"ok"}`
+	badCritique     = `{"type":"critique","status":"bad","reason":"not ok"}`
+)
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// harness drives Process with a fake chat model and tools and records the transitions and messages of the run.
+type harness struct {
+	fsm      *FSM
+	model    *fake.ChatModel
+	tools    []schema.Tool
+	states   []string
+	messages []string
+	audit    []customAgent.Record
+}
+
+func newHarness(responses []fake.Response, tools ...schema.Tool) *harness {
+	return &harness{
+		model: fake.NewChatModel(responses...),
+		tools: append([]schema.Tool{}, tools...),
+	}
+}
+
+func (h *harness) run(t *testing.T, optFns ...func(o *Options)) error {
+	t.Helper()
+	fns := append([]func(o *Options){func(o *Options) {
+		o.ChatModel = h.model
+		o.Tools = h.tools
+		o.MaxRetries = 1
+		o.Observers = []Observer{func(e Event) {
+			switch e.Type {
+			case EventTransition:
+				h.states = append(h.states, e.State)
+			case EventMessage:
+				h.messages = append(h.messages, e.Content)
+			case EventAudit:
+				h.audit = append(h.audit, e.Audit...)
+			}
+		}}
+	}}, optFns...)
+	f, err := New("list the files", 0, fns...)
+	if err != nil {
+		t.Fatalf("failed to create fsm: %v", err)
+	}
+	h.fsm = f
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-f.stream:
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return f.Process(ctx)
+}
+
+func agentResponses(terminalInput string, finish string) []fake.Response {
+	return []fake.Response{
+		{Match: []string{"Complete the following problem:"}, FunctionCall: fake.ToolCall("Terminal", terminalInput)},
+		{Match: []string{finish}, Content: "I listed the files."},
+	}
+}
+
+func TestProcess(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []fake.Response
+		terminal  []fake.ToolResult
+		states    []string
+		messages  []string
+		err       string
+	}{
+		{
+			name: "complete immediately",
+			responses: []fake.Response{
+				{Match: []string{initPrompt}, Content: completeThought},
+				{Match: []string{judgeThoughtPrompt}, Content: goodCritique},
+			},
+			states:   []string{"JudgeThought", "ThoughtDecider", "Complete"},
+			messages: []string{completeThought, goodCritique, "Completed! Tokens used: 4"},
+		},
+		{
+			name: "good path",
+			responses: append(append([]fake.Response{
+				{Match: []string{initPrompt}, Content: agentThought},
+				{Match: []string{judgeThoughtPrompt, "list the files"}, Content: goodCritique},
+			}, agentResponses("ls", "main.go")...),
+				fake.Response{Match: []string{judgeActionPrompt}, Content: goodCritique},
+				fake.Response{Match: []string{nextThoughtPrompt}, Content: completeThought},
+				fake.Response{Match: []string{judgeThoughtPrompt, "the files were listed"}, Content: goodCritique},
+			),
+			terminal: []fake.ToolResult{{Match: "ls", Output: "main.go"}},
+			states:   []string{"JudgeThought", "ThoughtDecider", "Action", "JudgeAction", "Next", "JudgeThought", "ThoughtDecider", "Complete"},
+		},
+		{
+			name: "bad critique retry",
+			responses: []fake.Response{
+				{Match: []string{initPrompt}, Content: agentThought},
+				{Match: []string{judgeThoughtPrompt, "list the files"}, Content: badCritique},
+				{Match: []string{badThoughtPrompt}, Content: completeThought},
+				{Match: []string{judgeThoughtPrompt, "the files were listed"}, Content: goodCritique},
+			},
+			states:   []string{"JudgeThought", "ThoughtDecider", "JudgeThought", "ThoughtDecider", "Complete"},
+			messages: []string{agentThought, badCritique, completeThought, goodCritique, "Completed! Tokens used: 11"},
+		},
+		{
+			name: "bash failure",
+			responses: []fake.Response{
+				{Match: []string{initPrompt}, Content: agentThought},
+				{Match: []string{judgeThoughtPrompt, "list the files"}, Content: goodCritique},
+				{Match: []string{"Complete the following problem:"}, FunctionCall: fake.ToolCall("Terminal", "ls")},
+				{Match: []string{judgeActionPrompt, "exit status 2"}, Content: badCritique},
+				{Match: []string{nextThoughtPrompt}, Content: completeThought},
+				{Match: []string{judgeThoughtPrompt, "the files were listed"}, Content: goodCritique},
+			},
+			terminal: []fake.ToolResult{{Match: "ls", Err: fmt.Errorf("failed to run the following command=[ls]: %w", integration.BashProcessError{
+				Output:       "ls: cannot access",
+				ProcessState: "exit status 2",
+				Err:          errors.New("exit status 2"),
+			})}},
+			states: []string{"JudgeThought", "ThoughtDecider", "Action", "JudgeAction", "Next", "JudgeThought", "ThoughtDecider", "Complete"},
+		},
+		{
+			name: "unknown thought type",
+			responses: []fake.Response{
+				{Match: []string{initPrompt}, Content: `{"type":"unknown"}`},
+				{Match: []string{judgeThoughtPrompt}, Content: goodCritique},
+			},
+			states: []string{"JudgeThought", "ThoughtDecider"},
+			err:    "unknown thought type",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			terminal := fake.NewTool("Terminal", tt.terminal...)
+			h := newHarness(tt.responses, terminal)
+			err := h.run(t)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(h.states, tt.states) {
+				t.Errorf("states = %v, want %v", h.states, tt.states)
+			}
+			if tt.messages != nil && !reflect.DeepEqual(h.messages, tt.messages) {
+				t.Errorf("messages = %q, want %q", h.messages, tt.messages)
+			}
+			if unused := h.model.Unused(); len(unused) > 0 {
+				t.Errorf("responses never served: %+v", unused)
+			}
+			if len(tt.terminal) > 0 && len(terminal.Inputs()) == 0 {
+				t.Error("terminal was never run")
+			}
+		})
+	}
+}
+
+// gatedTool counts the runs of a tool in flight. Runs wait for gate runs to be in flight at once, or a second, before
+// running the tool.
+type gatedTool struct {
+	schema.Tool
+	gate     int
+	mu       sync.Mutex
+	inFlight int
+	max      int
+	released chan struct{}
+}
+
+func newGatedTool(tool schema.Tool, gate int) *gatedTool {
+	return &gatedTool{Tool: tool, gate: gate, released: make(chan struct{})}
+}
+
+func (t *gatedTool) Run(ctx context.Context, input any) (string, error) {
+	t.mu.Lock()
+	t.inFlight++
+	if t.inFlight > t.max {
+		t.max = t.inFlight
+	}
+	if t.inFlight == t.gate {
+		select {
+		case <-t.released:
+		default:
+			close(t.released)
+		}
+	}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.inFlight--
+		t.mu.Unlock()
+	}()
+	select {
+	case <-t.released:
+	case <-time.After(time.Second):
+	}
+	return t.Tool.Run(ctx, input)
+}
+
+func TestProcessParallelActions(t *testing.T) {
+	tasks := []struct {
+		task, input, output string
+	}{
+		{"list the files", "ls", "main.go"},
+		{"count the lines", "wc -l", "42 lines"},
+		{"list the users", "who", "3 users"},
+		{"show the date", "date", "Monday"},
+	}
+	// responses scripts a run splitting the work into n tasks, the task failed fails on every attempt
+	responses := func(n, failed int, judge ...string) []fake.Response {
+		var actions []string
+		for _, task := range tasks[:n] {
+			actions = append(actions, fmt.Sprintf("%q", task.task))
+		}
+		rs := []fake.Response{
+			{Match: []string{initPrompt}, Content: `{"resources":{},"type":"agent","thought":"split the work","actions":[` + strings.Join(actions, ",") + `]}`},
+			{Match: []string{judgeThoughtPrompt, "split the work"}, Content: goodCritique},
+		}
+		for i, task := range tasks[:n] {
+			if i+1 == failed {
+				rs = append(rs, fake.Response{Match: []string{"Complete the following problem:", task.task}, FunctionCall: fake.ToolCall("Terminal", task.input), Times: 2})
+				continue
+			}
+			rs = append(rs,
+				fake.Response{Match: []string{"Complete the following problem:", task.task}, FunctionCall: fake.ToolCall("Terminal", task.input)},
+				fake.Response{Match: []string{task.output}, Content: "Done: " + task.output},
+			)
+		}
+		return append(rs,
+			fake.Response{Match: append([]string{judgeActionPrompt}, judge...), Content: goodCritique},
+			fake.Response{Match: []string{nextThoughtPrompt}, Content: completeThought},
+			fake.Response{Match: []string{judgeThoughtPrompt, "the files were listed"}, Content: goodCritique},
+		)
+	}
+	results := func(n int) []fake.ToolResult {
+		var rs []fake.ToolResult
+		for _, task := range tasks[:n] {
+			rs = append(rs, fake.ToolResult{Match: task.input, Output: task.output})
+		}
+		return rs
+	}
+	tests := []struct {
+		name      string
+		responses []fake.Response
+		terminal  []fake.ToolResult
+		limit     int
+		// maxInFlight is the number of tasks expected to run at once
+		maxInFlight int
+	}{
+		{
+			name: "concurrent tasks",
+			responses: responses(3, 0,
+				"[TASK-1] list the files\n[TASK-2] count the lines\n[TASK-3] list the users",
+				"[TASK-1] Done: main.go\n[TASK-2] Done: 42 lines\n[TASK-3] Done: 3 users",
+				"[TASK-3]\n[LOG-0] [AGENT]", "output=[3 users]"),
+			terminal:    results(3),
+			limit:       3,
+			maxInFlight: 3,
+		},
+		{
+			name:        "limit",
+			responses:   responses(4, 0, "[TASK-4] Done: Monday"),
+			terminal:    results(4),
+			limit:       2,
+			maxInFlight: 2,
+		},
+		{
+			name:      "failed task",
+			responses: responses(3, 2, "[TASK-1] Done: main.go", "[TASK-2] failed: ", "permission denied", "[TASK-3] Done: 3 users"),
+			terminal: append([]fake.ToolResult{{Match: "wc -l", Err: errors.New("permission denied")}},
+				results(3)...),
+			limit:       3,
+			maxInFlight: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			terminal := newGatedTool(fake.NewTool("Terminal", tt.terminal...), tt.limit)
+			h := newHarness(tt.responses, terminal)
+			err := h.run(t, func(o *Options) {
+				o.MaxParallelActions = tt.limit
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			want := []string{"JudgeThought", "ThoughtDecider", "Action", "JudgeAction", "Next", "JudgeThought", "ThoughtDecider", "Complete"}
+			if !reflect.DeepEqual(h.states, want) {
+				t.Errorf("states = %v, want %v", h.states, want)
+			}
+			if terminal.max != tt.maxInFlight {
+				t.Errorf("%d tasks ran at once, want %d", terminal.max, tt.maxInFlight)
+			}
+			if unused := h.model.Unused(); len(unused) > 0 {
+				t.Errorf("responses never served: %+v", unused)
+			}
+		})
+	}
+}
+
+func TestProcessCandidates(t *testing.T) {
+	const scorePrompt = "critically evaluate and score"
+	var (
+		findThought  = `{"resources":{},"type":"agent","thought":"find the files","output":"Run find in the terminal."}`
+		treeThought  = `{"resources":{},"type":"agent","thought":"tree the files","output":"Run tree in the terminal."}`
+		guessThought = `{"resources":{},"type":"complete","thought":"guess the files"}`
+	)
+	score := func(n int) string {
+		return fmt.Sprintf(`{"type":"critique","score":%d,"reason":"scored %d"}`, n, n)
+	}
+	// first acts on the thought of Init before the candidates of the next turn are sampled
+	first := append(append([]fake.Response{
+		{Match: []string{initPrompt}, Content: agentThought},
+		{Match: []string{judgeThoughtPrompt, "list the files"}, Content: goodCritique},
+	}, agentResponses("ls", "main.go")...),
+		fake.Response{Match: []string{judgeActionPrompt, "Run ls in the terminal."}, Content: goodCritique},
+	)
+	// candidates samples the thoughts of a turn and scores them
+	candidates := func(thoughts []string, scores []int) []fake.Response {
+		rs := []fake.Response{{Match: []string{nextThoughtPrompt}, Content: thoughts[0]}}
+		for i, thought := range thoughts[1:] {
+			rs = append(rs, fake.Response{Match: []string{"Propose a different approach", thoughts[i]}, Content: thought})
+		}
+		for i, thought := range thoughts {
+			rs = append(rs, fake.Response{Match: []string{scorePrompt, thought}, Content: score(scores[i])})
+		}
+		return rs
+	}
+	concat := func(rss ...[]fake.Response) []fake.Response {
+		var all []fake.Response
+		for _, rs := range rss {
+			all = append(all, rs...)
+		}
+		return all
+	}
+	act := func(input, output string) []fake.Response {
+		return []fake.Response{
+			{Match: []string{"Complete the following problem:", "Run " + input}, FunctionCall: fake.ToolCall("Terminal", input)},
+			{Match: []string{output}, Content: "I listed the files."},
+		}
+	}
+	terminal := []fake.ToolResult{{Match: "ls", Output: "main.go"}, {Match: "find", Output: "./main.go"}, {Match: "tree", Output: "`-- main.go"}}
+
+	tests := []struct {
+		name      string
+		responses []fake.Response
+		opts      func(o *Options)
+		states    []string
+		// chosen are the thoughts of the candidates accepted, in order
+		chosen     []string
+		backtracks int
+	}{
+		{
+			name:      "best candidate",
+			responses: concat(first, candidates([]string{guessThought, completeThought, findThought}, []int{4, 9, 7})),
+			opts:      func(o *Options) { o.Candidates = 3 },
+			states:    []string{"JudgeThought", "ThoughtDecider", "Action", "JudgeAction", "Next", "JudgeCandidates", "ThoughtDecider", "Complete"},
+			chosen:    []string{completeThought},
+		},
+		{
+			name: "every candidate below the minimum score",
+			responses: concat(first, candidates([]string{guessThought, completeThought}, []int{2, 5}), []fake.Response{
+				{Match: []string{badThoughtPrompt}, Content: completeThought},
+				{Match: []string{judgeThoughtPrompt, "the files were listed"}, Content: goodCritique},
+			}),
+			opts: func(o *Options) {
+				o.Candidates = 2
+				o.MinScore = 6
+			},
+			states: []string{"JudgeThought", "ThoughtDecider", "Action", "JudgeAction", "Next", "JudgeCandidates", "ThoughtDecider", "JudgeThought", "ThoughtDecider", "Complete"},
+			chosen: []string{completeThought},
+		},
+		{
+			name: "backtrack until out of candidates",
+			responses: concat(first, candidates([]string{findThought, treeThought}, []int{9, 7}),
+				act("find", "./main.go"),
+				[]fake.Response{{Match: []string{judgeActionPrompt, "Run find in the terminal."}, Content: badCritique}},
+				act("tree", "`-- main.go"),
+				[]fake.Response{{Match: []string{judgeActionPrompt, "Run tree in the terminal."}, Content: badCritique}},
+				candidates([]string{guessThought, completeThought}, []int{1, 8}),
+			),
+			opts: func(o *Options) {
+				o.Candidates = 2
+				o.BacktrackAfter = 1
+			},
+			states: []string{"JudgeThought", "ThoughtDecider", "Action", "JudgeAction", "Next", "JudgeCandidates", "ThoughtDecider",
+				"Action", "JudgeAction", "ThoughtDecider", "Action", "JudgeAction", "Next", "JudgeCandidates", "ThoughtDecider", "Complete"},
+			chosen:     []string{findThought, treeThought, completeThought},
+			backtracks: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(tt.responses, fake.NewTool("Terminal", terminal...))
+			if err := h.run(t, tt.opts); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(h.states, tt.states) {
+				t.Errorf("states = %v, want %v", h.states, tt.states)
+			}
+			// the accepted candidate is emitted right after the critiques of its turn
+			var chosen []string
+			backtracks := 0
+			for i, m := range h.messages {
+				if strings.Contains(m, `"type":"backtrack"`) {
+					backtracks++
+				}
+				if i > 0 && (strings.Contains(h.messages[i-1], `"score":`) || strings.Contains(h.messages[i-1], `"type":"backtrack"`)) && !strings.Contains(m, `"score":`) {
+					chosen = append(chosen, m)
+				}
+			}
+			if !reflect.DeepEqual(chosen, tt.chosen) {
+				t.Errorf("chosen candidates = %q, want %q", chosen, tt.chosen)
+			}
+			if backtracks != tt.backtracks {
+				t.Errorf("backtracked %d times, want %d", backtracks, tt.backtracks)
+			}
+			if unused := h.model.Unused(); len(unused) > 0 {
+				t.Errorf("responses never served: %+v", unused)
+			}
+		})
+	}
+}
+
+func TestProcessAudit(t *testing.T) {
+	h := newHarness(append(append([]fake.Response{
+		{Match: []string{initPrompt}, Content: agentThought},
+		{Match: []string{judgeThoughtPrompt, "list the files"}, Content: goodCritique},
+	}, agentResponses("ls", "main.go")...),
+		fake.Response{Match: []string{judgeActionPrompt, "[TOOL] name=[Terminal] output=[main.go]"}, Content: goodCritique},
+		fake.Response{Match: []string{nextThoughtPrompt}, Content: completeThought},
+		fake.Response{Match: []string{judgeThoughtPrompt, "the files were listed"}, Content: goodCritique},
+	), fake.NewTool("Terminal", fake.ToolResult{Match: "ls", Output: "main.go"}))
+	var jsonl bytes.Buffer
+	chatTokens, finishTokens := 0, 0
+	err := h.run(t, func(o *Options) {
+		o.AuditWriter = &jsonl
+		o.Observers = append(o.Observers, func(e Event) {
+			switch e.Type {
+			case EventChat:
+				chatTokens += e.Tokens
+				if e.PromptTokens+e.CompletionTokens != e.Tokens || e.CompletionTokens == 0 {
+					t.Errorf("chat event has %d prompt and %d completion tokens of %d", e.PromptTokens, e.CompletionTokens, e.Tokens)
+				}
+			case EventFinish:
+				finishTokens = e.Tokens
+			}
+		})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	agentTokens := 0
+	for _, r := range h.audit {
+		if r.Tokens != nil {
+			agentTokens += r.Tokens.Total
+		}
+	}
+	// the agent's tokens count towards the total of the run
+	if finishTokens != chatTokens+agentTokens || agentTokens == 0 {
+		t.Errorf("finish event has %d tokens, want %d chat and %d agent tokens", finishTokens, chatTokens, agentTokens)
+	}
+	var kinds []customAgent.RecordKind
+	for _, r := range h.audit {
+		kinds = append(kinds, r.Kind)
+	}
+	want := []customAgent.RecordKind{
+		customAgent.RecordLLMStart, customAgent.RecordLLMEnd, customAgent.RecordAgentAction,
+		customAgent.RecordToolStart, customAgent.RecordToolEnd,
+		customAgent.RecordLLMStart, customAgent.RecordLLMEnd, customAgent.RecordAgentFinish,
+	}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("audit kinds = %v, want %v", kinds, want)
+	}
+	if h.audit[1].Tokens == nil || h.audit[1].Tokens.Total == 0 {
+		t.Errorf("expected token usage on llm end, got %+v", h.audit[1])
+	}
+	if n := strings.Count(jsonl.String(), "\n"); n != len(want) {
+		t.Errorf("expected %d JSON lines, got %d", len(want), n)
+	}
+}
+
+func TestProcessTracing(t *testing.T) {
+	h := newHarness(append(append([]fake.Response{
+		{Match: []string{initPrompt}, Content: agentThought},
+		{Match: []string{judgeThoughtPrompt, "list the files"}, Content: goodCritique},
+	}, agentResponses("ls", "main.go")...),
+		fake.Response{Match: []string{judgeActionPrompt}, Content: goodCritique},
+		fake.Response{Match: []string{nextThoughtPrompt}, Content: completeThought},
+		fake.Response{Match: []string{judgeThoughtPrompt, "the files were listed"}, Content: goodCritique},
+	), fake.NewTool("Terminal", fake.ToolResult{Match: "ls", Output: "main.go"}))
+	recorder := tracetest.NewSpanRecorder()
+	err := h.run(t, func(o *Options) {
+		o.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	parents := map[string]map[string]bool{}
+	byID := map[trace.SpanID]string{}
+	for _, s := range recorder.Ended() {
+		spans[s.Name()] = s
+		byID[s.SpanContext().SpanID()] = s.Name()
+	}
+	for _, s := range recorder.Ended() {
+		if parents[s.Name()] == nil {
+			parents[s.Name()] = map[string]bool{}
+		}
+		parents[s.Name()][byID[s.Parent().SpanID()]] = true
+	}
+	for name, parent := range map[string]string{
+		"turn":               "run",
+		"state Init":         "turn",
+		"state Action":       "turn",
+		"chat.generate":      "state Init",
+		"agent.generate":     "state Action",
+		"agent.step":         "attempt",
+		"tool Terminal":      "agent.step",
+		"llm":                "attempt",
+		"state JudgeThought": "turn",
+	} {
+		if _, ok := spans[name]; !ok {
+			t.Errorf("missing span %q", name)
+			continue
+		}
+		if !parents[name][parent] {
+			t.Errorf("span %q has parents %v, want %q", name, parents[name], parent)
+		}
+	}
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range spans["llm"].Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs[telemetry.AttrTokensTotal].AsInt64() == 0 || attrs[telemetry.AttrModel].AsString() == "" {
+		t.Errorf("expected model and token attributes on the llm span, got %v", spans["llm"].Attributes())
+	}
+}
+
+func TestProcessPlan(t *testing.T) {
+	h := newHarness(append(append([]fake.Response{
+		{Match: []string{"break down a computer-related problem"}, Content: `{"type":"plan","subgoals":[{"description":"list the files"}]}`},
+		{Match: []string{nextThoughtPrompt, "[1] list the files"}, Content: agentThought},
+		{Match: []string{judgeThoughtPrompt, "list the files"}, Content: badCritique},
+		// the thinker retries the rejected thought on the same subgoal
+		{Match: []string{badThoughtPrompt, "[1] list the files"}, Content: agentThought},
+		{Match: []string{judgeThoughtPrompt, "list the files"}, Content: goodCritique},
+	}, agentResponses("ls", "main.go")...),
+		fake.Response{Match: []string{judgeActionPrompt, "[1] list the files"}, Content: `{"type":"critique","status":"good","reason":"ok","subgoalDone":true}`},
+		fake.Response{Match: []string{nextThoughtPrompt, "Every subgoal of the plan is done"}, Content: completeThought},
+		fake.Response{Match: []string{judgeThoughtPrompt, "the files were listed"}, Content: goodCritique},
+	), fake.NewTool("Terminal", fake.ToolResult{Match: "ls", Output: "main.go"}))
+	err := h.run(t, func(o *Options) {
+		o.Plan = true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"Plan", "Next", "JudgeThought", "ThoughtDecider", "JudgeThought", "ThoughtDecider", "Action", "JudgeAction", "Next", "JudgeThought", "ThoughtDecider", "Complete"}
+	if !reflect.DeepEqual(h.states, want) {
+		t.Errorf("states = %v, want %v", h.states, want)
+	}
+	var plans []string
+	for _, m := range h.messages {
+		if strings.HasPrefix(m, `{"plan"`) {
+			plans = append(plans, m)
+		}
+	}
+	if len(plans) != 2 || !strings.Contains(plans[1], `"status":"done"`) {
+		t.Errorf("expected the plan to be emitted twice with the subgoal done, got %q", plans)
+	}
+}
+
+func TestProcessRedaction(t *testing.T) {
+	const secret = "sk-abcdefghijklmnopqrstuvwx1234"
+	h := newHarness(append(append([]fake.Response{
+		{Match: []string{initPrompt}, Content: agentThought},
+		{Match: []string{judgeThoughtPrompt, "list the files"}, Content: goodCritique},
+	}, agentResponses("cat .env", "OPENAI_API_KEY=[REDACTED]")...),
+		fake.Response{Match: []string{judgeActionPrompt, "output=[OPENAI_API_KEY=[REDACTED]]"}, Content: goodCritique},
+		fake.Response{Match: []string{nextThoughtPrompt}, Content: completeThought},
+		fake.Response{Match: []string{judgeThoughtPrompt, "the files were listed"}, Content: goodCritique},
+	), fake.NewTool("Terminal", fake.ToolResult{Match: "cat .env", Output: "OPENAI_API_KEY=" + secret}))
+	var jsonl bytes.Buffer
+	err := h.run(t, func(o *Options) {
+		o.AuditWriter = &jsonl
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, c := range h.model.Calls() {
+		for _, m := range c.Messages {
+			if strings.Contains(m.Content(), secret) {
+				t.Errorf("secret sent to the model: %q", m.Content())
+			}
+		}
+	}
+	if strings.Contains(jsonl.String(), secret) || strings.Contains(fmt.Sprint(h.audit, h.messages), secret) {
+		t.Error("secret leaked to the audit log or the events")
+	}
+}
+
+func TestProcessSecrets(t *testing.T) {
+	h := newHarness(append(append([]fake.Response{
+		{Match: []string{initPrompt, "The available secrets are: {{secret:REGISTRY_TOKEN}}"}, Content: agentThought},
+		{Match: []string{judgeThoughtPrompt, "list the files"}, Content: goodCritique},
+	}, []fake.Response{
+		{Match: []string{"Complete the following problem:", "never print their values: {{secret:REGISTRY_TOKEN}}"}, FunctionCall: fake.ToolCall("Terminal", "ls")},
+		{Match: []string{"main.go"}, Content: "I listed the files."},
+	}...),
+		fake.Response{Match: []string{judgeActionPrompt}, Content: goodCritique},
+		fake.Response{Match: []string{nextThoughtPrompt}, Content: completeThought},
+		fake.Response{Match: []string{judgeThoughtPrompt, "the files were listed"}, Content: goodCritique},
+	), fake.NewTool("Terminal", fake.ToolResult{Match: "ls", Output: "main.go"}))
+	err := h.run(t, func(o *Options) {
+		o.Secrets = secret.New(map[string]string{"REGISTRY_TOKEN": "s3cr3t-token"})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, c := range h.model.Calls() {
+		for _, m := range c.Messages {
+			if strings.Contains(m.Content(), "s3cr3t-token") {
+				t.Errorf("secret value sent to the model: %q", m.Content())
+			}
+		}
+	}
+}
+
+func TestProcessBudget(t *testing.T) {
+	responses := func() []fake.Response {
+		return []fake.Response{
+			{Match: []string{initPrompt}, Content: agentThought},
+			{Match: []string{judgeThoughtPrompt}, Content: goodCritique},
+		}
+	}
+	tests := []struct {
+		name string
+		opts func(o *Options)
+		err  error
+	}{
+		{"turns", func(o *Options) { o.MaxTurns = 1 }, ErrMaxTurns},
+		{"tokens", func(o *Options) { o.MaxTokens = 4 }, ErrMaxTokens},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHarness(responses())
+			var finish Event
+			err := h.run(t, tt.opts, func(o *Options) {
+				o.Observers = append(o.Observers, func(e Event) {
+					if e.Type == EventFinish {
+						finish = e
+					}
+				})
+			})
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			if finish.Reason != ReasonBudgetExhausted {
+				t.Errorf("unexpected finish reason %q", finish.Reason)
+			}
+		})
+	}
+}
+
+// noUsageModel is a chat model which doesn't report its token usage.
+type noUsageModel struct {
+	*fake.ChatModel
+}
+
+func (m noUsageModel) Generate(ctx context.Context, messages schema.ChatMessages, optFns ...func(o *schema.GenerateOptions)) (*schema.ModelResult, error) {
+	r, err := m.ChatModel.Generate(ctx, messages, optFns...)
+	if err == nil {
+		delete(r.LLMOutput, "TokenUsage")
+	}
+	return r, err
+}
+
+func TestProcessNoTokenUsage(t *testing.T) {
+	h := newHarness([]fake.Response{
+		{Match: []string{initPrompt}, Content: completeThought},
+		{Match: []string{judgeThoughtPrompt}, Content: goodCritique},
+	})
+	err := h.run(t, func(o *Options) {
+		o.ChatModel = noUsageModel{h.model}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used := h.fsm.TokensUsed(); used != 0 {
+		t.Errorf("expected no tokens used, got %d", used)
+	}
+}
+
+func TestProcessControl(t *testing.T) {
+	h := newHarness([]fake.Response{
+		{Match: []string{initPrompt}, Content: agentThought},
+		{Match: []string{judgeThoughtPrompt, "list the files"}, Content: goodCritique},
+		{Match: []string{nextThoughtPrompt}, Content: completeThought},
+		{Match: []string{judgeThoughtPrompt, "the files were listed"}, Content: goodCritique},
+	})
+	events := map[EventType]bool{}
+	err := h.run(t, func(o *Options) {
+		o.RequireApproval = true
+		o.Observers = append(o.Observers, func(e Event) {
+			events[e.Type] = true
+			switch e.Type {
+			case EventStart:
+				h.fsm.Pause()
+				h.fsm.Hint("look in /tmp")
+			case EventPause:
+				h.fsm.Resume()
+			case EventApproval:
+				if err := h.fsm.Reject("not now"); err != nil {
+					t.Errorf("failed to reject: %v", err)
+				}
+			}
+		})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"JudgeThought", "ThoughtDecider", "AwaitApproval", "Next", "JudgeThought", "ThoughtDecider", "Complete"}
+	if !reflect.DeepEqual(h.states, want) {
+		t.Fatalf("expected states %v, got %v", want, h.states)
+	}
+	for _, typ := range []EventType{EventPause, EventResume, EventHint, EventApproval, EventDecision} {
+		if !events[typ] {
+			t.Errorf("expected a %s event", typ)
+		}
+	}
+	var history strings.Builder
+	for _, c := range h.model.Calls() {
+		if strings.Contains(c.Messages[len(c.Messages)-1].Content(), nextThoughtPrompt) {
+			for _, m := range c.Messages {
+				history.WriteString(m.Content())
+			}
+		}
+	}
+	for _, s := range []string{"look in /tmp", "rejected the following action", "Reason: not now"} {
+		if !strings.Contains(history.String(), s) {
+			t.Errorf("expected the next thought to be prompted with %q", s)
+		}
+	}
+	if err = h.fsm.Approve(); !errors.Is(err, ErrNoApproval) {
+		t.Errorf("expected ErrNoApproval once the run is done, got %v", err)
+	}
+}
+
+func TestProcessSkipCritic(t *testing.T) {
+	g := DefaultGraph()
+	g.Register(StateName(JudgeThought{}), StateDef{
+		Handler:     On(AcceptThought),
+		Transitions: []string{StateName(ThoughtDecider{})},
+	})
+	h := newHarness([]fake.Response{
+		{Match: []string{initPrompt}, Content: completeThought},
+	})
+	err := h.run(t, func(o *Options) {
+		o.Graph = g
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"JudgeThought", "ThoughtDecider", "Complete"}
+	if !reflect.DeepEqual(h.states, want) {
+		t.Errorf("states = %v, want %v", h.states, want)
+	}
+}
+
+func TestProcessReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	h := newHarness(append(append([]fake.Response{
+		{Match: []string{initPrompt}, Content: agentThought},
+		{Match: []string{judgeThoughtPrompt, "list the files"}, Content: goodCritique},
+	}, agentResponses("ls", "main.go")...),
+		fake.Response{Match: []string{judgeActionPrompt}, Content: goodCritique},
+		fake.Response{Match: []string{nextThoughtPrompt}, Content: completeThought},
+		fake.Response{Match: []string{judgeThoughtPrompt, "the files were listed"}, Content: goodCritique},
+	), fake.NewTool("Terminal", fake.ToolResult{Match: "ls", Output: "main.go"}))
+	err := h.run(t, func(o *Options) {
+		o.Cassette = cassette.New(path)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error while recording: %v", err)
+	}
+
+	tape, err := cassette.Load(path)
+	if err != nil {
+		t.Fatalf("failed to load cassette: %v", err)
+	}
+	replay := &harness{}
+	err = replay.run(t, func(o *Options) {
+		o.ChatModel = nil
+		o.Tools = nil
+		o.Cassette = tape
+	})
+	if err != nil {
+		t.Fatalf("unexpected error while replaying: %v", err)
+	}
+	if !reflect.DeepEqual(replay.states, h.states) {
+		t.Errorf("replayed states = %v, want %v", replay.states, h.states)
+	}
+	if !reflect.DeepEqual(replay.messages, h.messages) {
+		t.Errorf("replayed messages = %q, want %q", replay.messages, h.messages)
+	}
+	if n := tape.Remaining(); n != 0 {
+		t.Errorf("%d interactions were not replayed", n)
+	}
+}
+
+func TestGraphValidate(t *testing.T) {
+	if err := DefaultGraph().Validate(); err != nil {
+		t.Fatalf("default graph is invalid: %v", err)
+	}
+
+	g := DefaultGraph()
+	g.Remove(StateName(Complete{}))
+	err := g.Validate()
+	if err == nil || !strings.Contains(err.Error(), "unregistered state Complete") || !strings.Contains(err.Error(), "no terminal state") {
+		t.Errorf("expected missing terminal state errors, got %v", err)
+	}
+
+	g = DefaultGraph()
+	g.Register("Approval", StateDef{Handler: On(AcceptAction), Transitions: []string{StateName(Next{})}})
+	err = g.Validate()
+	if err == nil || !strings.Contains(err.Error(), "not reachable from Init: Approval") {
+		t.Errorf("expected unreachable state error, got %v", err)
+	}
+}
+
+func TestProcessDiff(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	dir := t.TempDir()
+	g := integration.NewGit(dir)
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"init", "--quiet"}, {"add", "."}, {"commit", "--quiet", "-m", "init"}} {
+		if _, err := g.Run(context.Background(), args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base, err := g.Head(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the change the run is about to make
+	if err = os.WriteFile(filepath.Join(dir, "new.go"), []byte("package main\n\nconst secret = \"sk-abcdefghijklmnopqrstuvwx1234\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newHarness([]fake.Response{
+		{Match: []string{initPrompt}, Content: completeThought},
+		{Match: []string{judgeThoughtPrompt}, Content: goodCritique},
+	})
+	var types []EventType
+	var diff Event
+	err = h.run(t, func(o *Options) {
+		o.Workspace, o.DiffBase = dir, base
+		o.Observers = append(o.Observers, func(e Event) {
+			types = append(types, e.Type)
+			if e.Type == EventDiff {
+				diff = e
+			}
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(types) < 2 || types[len(types)-2] != EventDiff || types[len(types)-1] != EventFinish {
+		t.Errorf("expected a diff event right before finishing, got %v", types)
+	}
+	if !strings.Contains(diff.Content, "+++ b/new.go") || strings.Contains(diff.Content, "sk-abcdefghijklmnopqrstuvwx1234") || diff.Error != "" {
+		t.Errorf("unexpected diff event %+v", diff)
+	}
+}
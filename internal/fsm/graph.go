@@ -0,0 +1,252 @@
+package fsm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Handler handles a state and returns the state to transition to.
+type Handler func(ctx context.Context, fsm *FSM, state State) (State, error)
+
+// StateDef describes a state registered in a Graph.
+type StateDef struct {
+	// Handler is called each time the FSM enters the state.
+	Handler Handler
+	// Transitions are the names of the states the handler is allowed to return.
+	Transitions []string
+	// Turn marks states which start a new turn once handled.
+	Turn bool
+	// Terminal marks states which end the run once handled.
+	Terminal bool
+}
+
+// Graph is the transition table of the FSM. States are registered by name, see StateName.
+type Graph struct {
+	initial string
+	states  map[string]StateDef
+}
+
+func NewGraph(initial string) *Graph {
+	return &Graph{
+		initial: initial,
+		states:  map[string]StateDef{},
+	}
+}
+
+// DefaultGraph returns the built-in state graph:
+// Init → (Plan →) Next → JudgeThought → ThoughtDecider → (AwaitApproval →) Action → JudgeAction → Next, until
+// ThoughtDecider → Complete.
+func DefaultGraph() *Graph {
+	g := NewGraph(StateName(Init{}))
+	g.Register(StateName(Init{}), StateDef{
+		Handler:     On((*FSM).HandleInitState),
+		Transitions: []string{StateName(JudgeThought{}), StateName(Plan{})},
+		Turn:        true,
+	})
+	g.Register(StateName(Plan{}), StateDef{
+		Handler:     On((*FSM).HandlePlanState),
+		Transitions: []string{StateName(Next{})},
+	})
+	g.Register(StateName(Next{}), StateDef{
+		Handler:     On((*FSM).HandleNextThought),
+		Transitions: []string{StateName(JudgeThought{}), StateName(JudgeCandidates{})},
+		Turn:        true,
+	})
+	g.Register(StateName(JudgeThought{}), StateDef{
+		Handler:     On((*FSM).HandleJudgeThoughtState),
+		Transitions: []string{StateName(ThoughtDecider{})},
+	})
+	g.Register(StateName(JudgeCandidates{}), StateDef{
+		Handler:     On((*FSM).HandleJudgeCandidatesState),
+		Transitions: []string{StateName(ThoughtDecider{})},
+	})
+	g.Register(StateName(ThoughtDecider{}), StateDef{
+		Handler:     On((*FSM).HandleThoughtDeciderState),
+		Transitions: []string{StateName(Complete{}), StateName(Action{}), StateName(JudgeThought{}), StateName(AwaitApproval{})},
+		Turn:        true,
+	})
+	g.Register(StateName(AwaitApproval{}), StateDef{
+		Handler:     On((*FSM).HandleAwaitApprovalState),
+		Transitions: []string{StateName(Action{}), StateName(Next{})},
+	})
+	g.Register(StateName(Action{}), StateDef{
+		Handler:     On((*FSM).HandleActionState),
+		Transitions: []string{StateName(JudgeAction{})},
+	})
+	g.Register(StateName(JudgeAction{}), StateDef{
+		Handler:     On((*FSM).HandleJudgeActionState),
+		Transitions: []string{StateName(Next{}), StateName(ThoughtDecider{})},
+	})
+	g.Register(StateName(Complete{}), StateDef{
+		Handler:  On((*FSM).HandleCompleteState),
+		Terminal: true,
+	})
+	return g
+}
+
+// On adapts a handler of a concrete state type to a Handler.
+func On[T State](fn func(fsm *FSM, ctx context.Context, state T) (State, error)) Handler {
+	return func(ctx context.Context, fsm *FSM, state State) (State, error) {
+		s, ok := state.(T)
+		if !ok {
+			return nil, fmt.Errorf("handler expected state %s, got %s", StateName(*new(T)), StateName(state))
+		}
+		return fn(fsm, ctx, s)
+	}
+}
+
+// StateName returns the name a state is registered under, which is the name of its type.
+func StateName(state State) string {
+	if state == nil {
+		return "<nil>"
+	}
+	return reflect.TypeOf(state).Name()
+}
+
+// Register adds a state to the graph, replacing any state already registered under the same name.
+func (g *Graph) Register(name string, def StateDef) {
+	g.states[name] = def
+}
+
+// Remove removes a state from the graph.
+func (g *Graph) Remove(name string) {
+	delete(g.states, name)
+}
+
+// AddTransition allows the state from to transition to the state to.
+func (g *Graph) AddTransition(from, to string) {
+	def := g.states[from]
+	for _, t := range def.Transitions {
+		if t == to {
+			return
+		}
+	}
+	def.Transitions = append(def.Transitions, to)
+	g.states[from] = def
+}
+
+// Validate checks the graph is well-formed: every state has a handler, every transition leads to a registered state,
+// every state is reachable from the initial state and a terminal state is reachable.
+func (g *Graph) Validate() error {
+	var errs []error
+	if _, ok := g.states[g.initial]; !ok {
+		return fmt.Errorf("initial state %s is not registered", g.initial)
+	}
+	for _, name := range g.names() {
+		def := g.states[name]
+		if def.Handler == nil {
+			errs = append(errs, fmt.Errorf("state %s has no handler", name))
+		}
+		if !def.Terminal && len(def.Transitions) == 0 {
+			errs = append(errs, fmt.Errorf("state %s is not terminal and has no transitions", name))
+		}
+		for _, t := range def.Transitions {
+			if _, ok := g.states[t]; !ok {
+				errs = append(errs, fmt.Errorf("state %s transitions to unregistered state %s", name, t))
+			}
+		}
+	}
+
+	reachable := g.reachable()
+	var unreachable []string
+	terminal := false
+	for _, name := range g.names() {
+		if !reachable[name] {
+			unreachable = append(unreachable, name)
+		} else if g.states[name].Terminal {
+			terminal = true
+		}
+	}
+	if len(unreachable) > 0 {
+		errs = append(errs, fmt.Errorf("states not reachable from %s: %s", g.initial, strings.Join(unreachable, ", ")))
+	}
+	if !terminal {
+		errs = append(errs, errors.New("no terminal state is reachable"))
+	}
+	return errors.Join(errs...)
+}
+
+func (g *Graph) reachable() map[string]bool {
+	seen := map[string]bool{g.initial: true}
+	queue := []string{g.initial}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, t := range g.states[name].Transitions {
+			if !seen[t] {
+				seen[t] = true
+				queue = append(queue, t)
+			}
+		}
+	}
+	return seen
+}
+
+func (g *Graph) names() []string {
+	names := make([]string, 0, len(g.states))
+	for name := range g.states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// StateInfo describes a registered state for display.
+type StateInfo struct {
+	Name        string   `json:"name"`
+	Transitions []string `json:"transitions"`
+	Turn        bool     `json:"turn,omitempty"`
+	Terminal    bool     `json:"terminal,omitempty"`
+}
+
+// GraphInfo describes a graph for display.
+type GraphInfo struct {
+	Initial string      `json:"initial"`
+	States  []StateInfo `json:"states"`
+}
+
+// Describe returns the states and transitions of the graph, states sorted by name.
+func (g *Graph) Describe() GraphInfo {
+	info := GraphInfo{Initial: g.initial}
+	for _, name := range g.names() {
+		def := g.states[name]
+		info.States = append(info.States, StateInfo{
+			Name:        name,
+			Transitions: append([]string{}, def.Transitions...),
+			Turn:        def.Turn,
+			Terminal:    def.Terminal,
+		})
+	}
+	return info
+}
+
+func (g *Graph) lookup(state State) (StateDef, error) {
+	def, ok := g.states[StateName(state)]
+	if !ok {
+		return StateDef{}, fmt.Errorf("unknown state: %s", StateName(state))
+	}
+	return def, nil
+}
+
+func (g *Graph) checkTransition(from string, to State) error {
+	for _, t := range g.states[from].Transitions {
+		if t == StateName(to) {
+			return nil
+		}
+	}
+	return fmt.Errorf("transition from %s to %s is not allowed", from, StateName(to))
+}
+
+// AcceptThought is a handler for JudgeThought which skips the critic and accepts every thought.
+func AcceptThought(fsm *FSM, ctx context.Context, state JudgeThought) (State, error) {
+	return ThoughtDecider{Thought: state.Message, JudgeMessage: `{"type":"critique","status":"good","reason":"critic skipped"}`}, nil
+}
+
+// AcceptAction is a handler for JudgeAction which skips the critic and continues with the next thought.
+func AcceptAction(fsm *FSM, ctx context.Context, state JudgeAction) (State, error) {
+	return Next{}, nil
+}
@@ -0,0 +1,109 @@
+package fsm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	customIntegration "flow-gpt/internal/integration"
+	"github.com/hupe1980/golc/prompt"
+	"github.com/hupe1980/golc/schema"
+	zLog "github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultMaxParallelActions = 3
+)
+
+// taskResult is the outcome of one of the independent tasks of an Action.
+type taskResult struct {
+	Task     string `json:"task"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+	AuditLog string `json:"auditLog"`
+}
+
+// HandleParallelActions runs each task of the Action on its own agent executor and audit log, bounded by MaxParallelActions, and
+// merges the results into a single JudgeAction.
+func (fsm *FSM) HandleParallelActions(ctx context.Context, state Action) (State, error) {
+	results := make([]taskResult, len(state.Actions))
+	errs := make([]error, len(state.Actions))
+	sem := make(chan struct{}, fsm.maxParallelActions())
+	var wg sync.WaitGroup
+	for i, task := range state.Actions {
+		wg.Add(1)
+		go func(i int, task string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			results[i], errs[i] = fsm.runTask(ctx, task, state.Resources)
+		}(i, task)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := json.Marshal(map[string]any{
+		"type":  "action",
+		"tasks": results,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal action results: %w", err)
+	}
+	fsm.Emit(string(b))
+	fsm.appendThinkChat(schema.NewSystemChatMessage(string(b)))
+
+	var problems, messages, auditLogs []string
+	for i, r := range results {
+		problems = append(problems, fmt.Sprintf("[TASK-%d] %s", i+1, r.Task))
+		if r.Error != "" {
+			messages = append(messages, fmt.Sprintf("[TASK-%d] failed: %s", i+1, r.Error))
+		} else {
+			messages = append(messages, fmt.Sprintf("[TASK-%d] %s", i+1, r.Output))
+		}
+		auditLogs = append(auditLogs, fmt.Sprintf("[TASK-%d]\n%s", i+1, r.AuditLog))
+	}
+	return JudgeAction{
+		Problem:  strings.Join(problems, "\n"),
+		Message:  strings.Join(messages, "\n"),
+		AuditLog: strings.Join(auditLogs, "\n"),
+	}, nil
+}
+
+func (fsm *FSM) runTask(ctx context.Context, task string, resources map[string]interface{}) (taskResult, error) {
+	f := prompt.NewFormatter(agentPrompt)
+	p, err := f.Render(map[string]any{
+		"problem":   task,
+		"resources": resources,
+		"secrets":   fsm.opts.Secrets.Names(),
+	})
+	if err != nil {
+		return taskResult{}, fmt.Errorf("failed to render prompt: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, fsm.opts.AgentTimeout)
+	defer cancel()
+	res, auditLog, err := fsm.AgentGenerate(ctx, p)
+	if err != nil {
+		var bashErr customIntegration.BashProcessError
+		if errors.As(err, &bashErr) {
+			return taskResult{Task: task, Error: bashErr.Error(), AuditLog: auditLog}, nil
+		}
+		zLog.Error().Err(err).Msgf("task failed: %s", task)
+		return taskResult{Task: task, Error: err.Error(), AuditLog: auditLog}, nil
+	}
+	return taskResult{Task: task, Output: res, AuditLog: auditLog}, nil
+}
+
+func (fsm *FSM) maxParallelActions() int {
+	if fsm.opts.MaxParallelActions <= 0 {
+		return DefaultMaxParallelActions
+	}
+	return fsm.opts.MaxParallelActions
+}
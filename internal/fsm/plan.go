@@ -0,0 +1,122 @@
+package fsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	SubgoalPending = "pending"
+	SubgoalActive  = "active"
+	SubgoalDone    = "done"
+)
+
+// Subgoal is a node of the plan tree. Leaf subgoals are worked on one at a time, a parent subgoal is done once all of
+// its children are done.
+type Subgoal struct {
+	ID          string     `json:"id"`
+	Description string     `json:"description"`
+	Status      string     `json:"status"`
+	Subgoals    []*Subgoal `json:"subgoals,omitempty"`
+}
+
+// PlanTree is the decomposition of the problem produced by the Plan state.
+type PlanTree struct {
+	Subgoals []*Subgoal `json:"subgoals"`
+}
+
+func parsePlan(content string) (*PlanTree, error) {
+	p := &PlanTree{}
+	err := json.Unmarshal([]byte(content), p)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Subgoals) == 0 {
+		return nil, errors.New("plan has no subgoals")
+	}
+	assignSubgoals(p.Subgoals, "")
+	p.activate()
+	return p, nil
+}
+
+func assignSubgoals(subgoals []*Subgoal, prefix string) {
+	for i, s := range subgoals {
+		s.ID = fmt.Sprintf("%s%d", prefix, i+1)
+		s.Status = SubgoalPending
+		assignSubgoals(s.Subgoals, s.ID+".")
+	}
+}
+
+// Current returns the leaf subgoal being worked on, or nil once every subgoal is done.
+func (p *PlanTree) Current() *Subgoal {
+	path := p.currentPath()
+	if len(path) == 0 {
+		return nil
+	}
+	return path[len(path)-1]
+}
+
+// Done reports whether every subgoal of the plan is done.
+func (p *PlanTree) Done() bool {
+	return p.Current() == nil
+}
+
+// CompleteCurrent marks the current subgoal as done, closes any parents whose children are all done and activates
+// the next subgoal.
+func (p *PlanTree) CompleteCurrent() {
+	path := p.currentPath()
+	if len(path) == 0 {
+		return
+	}
+	path[len(path)-1].Status = SubgoalDone
+	for i := len(path) - 2; i >= 0; i-- {
+		if !allDone(path[i].Subgoals) {
+			break
+		}
+		path[i].Status = SubgoalDone
+	}
+	p.activate()
+}
+
+func (p *PlanTree) activate() {
+	for _, s := range p.currentPath() {
+		s.Status = SubgoalActive
+	}
+}
+
+func (p *PlanTree) currentPath() []*Subgoal {
+	return firstOpen(p.Subgoals)
+}
+
+func firstOpen(subgoals []*Subgoal) []*Subgoal {
+	for _, s := range subgoals {
+		if s.Status == SubgoalDone {
+			continue
+		}
+		if len(s.Subgoals) == 0 {
+			return []*Subgoal{s}
+		}
+		if path := firstOpen(s.Subgoals); path != nil {
+			return append([]*Subgoal{s}, path...)
+		}
+	}
+	return nil
+}
+
+func allDone(subgoals []*Subgoal) bool {
+	for _, s := range subgoals {
+		if s.Status != SubgoalDone {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *PlanTree) String() string {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
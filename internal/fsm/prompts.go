@@ -29,6 +29,13 @@ Your task is to solve a computer-related problem. The process involves a thought
   - "ExtractText": To obtain all the text from the present webpage.
   - "Terminal": Run a bash command in a headless terminal. This excludes any GUI's or interactive applications!
  - Remember to keep track of your project resources and provide these to the Agent as needed.
+{{- if .secrets}}
+ - Credentials are kept in a vault and must never be written out or asked for. Refer to them with placeholders, which are replaced when a terminal command runs. The available secrets are: {{range $i, $s := .secrets}}{{if $i}}, {{end}}{{"{{"}}secret:{{$s}}{{"}}"}}{{end}}
+  - Correct: "Run 'docker login -u ci -p {{"{{"}}secret:REGISTRY_TOKEN{{"}}"}} registry.example.com' in the terminal."
+{{- end}}
+ - When several tasks don't depend on each other, list them in "actions" instead of "output" and they will be run at the same time by separate Agents:
+  - Correct: ["Run 'go version' in the terminal.", "Run 'docker version' in the terminal."]
+  - Incorrect: ["Create the file main.go.", "Compile main.go."]
 
 Following the completion of an Agent's task, decide on the next best step:
  - Using the output from the previous turns, plan your next thought to solve the problem.
@@ -51,6 +58,11 @@ Your responses should be structured in JSON format as follows:
       "type": "string",
       "description": "Holds the instructions you forward to the Agent."
     },
+    "actions": {
+      "type": "array",
+      "items": {"type": "string"},
+      "description": "Optional list of independent instructions, each forwarded to a separate Agent. Use instead of output."
+    },
     "resources": {
       "type": "object",
       "description": "Keeps track of past outputs to assist the Agent.",
@@ -88,7 +100,10 @@ Provide only the JSON output following the previous schema:
 [Turn {{.turn}}]
 
 You have provided a bad solution according to the critique. Look at the suggestions and update your previous response and try again. Provide the correct actions to take in the output.
-
+{{if .subgoal}}
+Keep the solution on the current subgoal of the plan:
+[{{.subgoal.ID}}] {{.subgoal.Description}}
+{{end}}
 Provide only the JSON output following the previous schema:
 `
 	actionOutputPrompt = `
@@ -106,7 +121,16 @@ Remember to update any details from the last action into the "resources" field.
 
 Question whether the previous steps completed the problem, if they have complete the problem or perform another action. Don't get side tracked or devise from the problem:
 {{.problem}}
-
+{{if .subgoal}}
+Focus this turn on the current subgoal of the plan, the other subgoals will be handled in later turns:
+[{{.subgoal.ID}}] {{.subgoal.Description}}
+
+The plan and the status of each subgoal:
+{{.plan}}
+{{else if .plan}}
+Every subgoal of the plan is done, verify the problem is solved before completing:
+{{.plan}}
+{{end}}
 Provide only the JSON output following the previous schema:
 `
 	thinkCritiquePrompt = `
@@ -121,6 +145,7 @@ Here are some guidelines for your analysis:
  - If the "type" field is "complete", you should assess whether the solution presented in other fields fully addresses the problem. Is everything adequately completed for the problem? 
     - Be sure to check previous notes to ensure that all steps have been addressed.
  - If the "type" field is "action", evaluate whether the "output" field contains a well-defined task.
+ - If an "actions" list is present, evaluate whether each entry is a well-defined task and that none of them depend on each other.
  - Each 'thought' should be one well-defined step towards the resolution of the original problem.
 
 For context, here is the original problem: 
@@ -152,6 +177,78 @@ Your response should include a "status", along with a reason for your evaluation
   "required": ["type", "status", "reason"]
 }
 
+Please provide your JSON-formatted response:
+`
+	alternativeCandidatePrompt = `
+The following thoughts have already been proposed for this turn:
+{{range .candidates}}{{.}}
+{{end}}
+Propose a different approach for this turn, don't repeat any of the thoughts above.
+
+Provide only the JSON output following the previous schema:
+`
+	backtrackPrompt = `
+The approach chosen in [Turn {{.turn}}] repeatedly failed and was abandoned:
+{{.thought}}
+
+Continue from the next best alternative instead, don't return to the abandoned approach.
+`
+	hintPrompt = `
+The operator watching the run gives you a hint, take it into account from now on:
+{{.hint}}
+`
+	rejectedActionPrompt = `
+The operator rejected the following action before it ran:
+{{.action}}
+
+Reason: {{if .reason}}{{.reason}}{{else}}none given{{end}}
+
+Propose a different action, don't repeat the rejected one.
+`
+	scoreCritiquePrompt = `
+Your role is to critically evaluate and score the logical reasoning behind a given 'thought'. 
+
+A 'thought' will be presented in JSON format and will consist of:
+ - A "type" field that can either be "complete" or "action"
+ - A "thought" field which contains the main idea
+ - Various additional fields providing supportive information
+
+Here are some guidelines for your analysis:
+ - If the "type" field is "complete", you should assess whether the solution presented in other fields fully addresses the problem. Is everything adequately completed for the problem? 
+ - If the "type" field is "action", evaluate whether the "output" field contains a well-defined task.
+ - Each 'thought' should be one well-defined step towards the resolution of the original problem.
+ - Score from 0 to 10, where 0 is a thought which doesn't help solve the problem and 10 is the best possible next step.
+
+For context, here is the original problem: 
+{{.problem}}
+
+And here is the current thought you are to score:
+{{.think}}
+
+Your response should include a "score", along with a reason for your evaluation. Your response should be formatted in JSON. Here is the schema:
+{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "properties": {
+    "type": {
+      "type": "string",
+      "enum": ["critique"],
+      "description": "Should always be 'critique'."
+    },
+    "score": {
+      "type": "number",
+      "minimum": 0,
+      "maximum": 10,
+      "description": "Represents how good the thought is."
+    },
+    "reason": {
+      "type": "string",
+      "description": "Provides the reason for the given score."
+    }
+  },
+  "required": ["type", "score", "reason"]
+}
+
 Please provide your JSON-formatted response:
 `
 	analyseActionPrompt = `
@@ -171,7 +268,12 @@ Here is the description of the completed task:
 
 Below is the Audit log containing a record of all actions taken:
 {{.auditLog}}
+{{if .subgoal}}
+The task is part of a plan, the subgoal currently being worked on is:
+[{{.subgoal.ID}}] {{.subgoal.Description}}
 
+Set "subgoalDone" to true only if the Audit log proves this subgoal is fully achieved.
+{{end}}
 Your response should include a "status", along with a reason for your evaluation. Your response should be formatted in JSON. Here is the schema:
 {
   "$schema": "http://json-schema.org/draft-07/schema#",
@@ -190,11 +292,63 @@ Your response should include a "status", along with a reason for your evaluation
     "reason": {
       "type": "string",
       "description": "Provides the reason for the given status."
+    },
+    "subgoalDone": {
+      "type": "boolean",
+      "description": "Whether the current subgoal of the plan is done."
     }
   },
   "required": ["type", "status", "reason"]
 }
 
+Please provide your JSON-formatted response:
+`
+	planPrompt = `
+Your task is to break down a computer-related problem into a plan of subgoals before any work starts.
+
+Guidelines for the plan:
+ - Each subgoal should be a concrete milestone towards solving the problem, listed in the order they need to be done.
+ - A subgoal that is too large for a few steps can be broken down further into its own subgoals.
+ - Keep the plan small, don't add subgoals which aren't required by the problem.
+ - The last subgoal should verify the problem is solved.
+
+The problem is:
+{{.problem}}
+
+Your response should be formatted in JSON. Here is the schema:
+{
+  "$schema": "http://json-schema.org/draft-07/schema#",
+  "type": "object",
+  "definitions": {
+    "subgoal": {
+      "type": "object",
+      "properties": {
+        "description": {
+          "type": "string",
+          "description": "What needs to be achieved for the subgoal."
+        },
+        "subgoals": {
+          "type": "array",
+          "items": {"$ref": "#/definitions/subgoal"}
+        }
+      },
+      "required": ["description"]
+    }
+  },
+  "properties": {
+    "type": {
+      "type": "string",
+      "enum": ["plan"],
+      "description": "Should always be 'plan'."
+    },
+    "subgoals": {
+      "type": "array",
+      "items": {"$ref": "#/definitions/subgoal"}
+    }
+  },
+  "required": ["type", "subgoals"]
+}
+
 Please provide your JSON-formatted response:
 `
 	agentPrompt = `
@@ -205,7 +359,9 @@ Current workspace resources:
 {{.resources}}
 
 If possible, use the resources to complete your problem.
-
+{{if .secrets}}
+Secrets are available to the Terminal as placeholders, which are replaced with their values when the command runs. Use the placeholders as they are and never print their values: {{range $i, $s := .secrets}}{{if $i}}, {{end}}{{"{{"}}secret:{{$s}}{{"}}"}}{{end}}
+{{end}}
 After you complete, say what you did.
 `
 	agentFailure = `
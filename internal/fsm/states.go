@@ -4,6 +4,7 @@ type Action struct {
 	Type            string                 `json:"type"`
 	Thought         string                 `json:"thought"`
 	Output          string                 `json:"output"`
+	Actions         []string               `json:"actions"`
 	ProblemAnalysis string                 `json:"problemAnalysis"`
 	Resources       map[string]interface{} `json:"resources"`
 }
@@ -19,10 +20,16 @@ type Complete struct{}
 
 type Init struct{}
 
+type Plan struct{}
+
 type JudgeThought struct {
 	Message string
 }
 
+type JudgeCandidates struct {
+	Candidates []string
+}
+
 type JudgeAction struct {
 	Problem  string
 	Message  string
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"os/exec"
+
+	"flow-gpt/internal/secret"
 )
 
 type BashProcessError struct {
@@ -16,23 +18,48 @@ func (bpe BashProcessError) Error() string {
 	return fmt.Sprintf("output=[%s], process state=[%s], error=[%s]", bpe.Output, bpe.ProcessState, bpe.Err)
 }
 
-type BashProcess struct{}
+type BashProcessOptions struct {
+	// Secrets substitutes the {{secret:NAME}} placeholders of commands right before they run, the values are masked
+	// in the output again.
+	Secrets *secret.Vault
+	// Dir is the working directory of the commands, defaults to the one of the process.
+	Dir string
+}
+
+type BashProcess struct {
+	opts BashProcessOptions
+}
 
-func NewBashProcess() *BashProcess {
-	return &BashProcess{}
+func NewBashProcess(optFns ...func(o *BashProcessOptions)) *BashProcess {
+	opts := BashProcessOptions{}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	return &BashProcess{
+		opts: opts,
+	}
 }
 
 func (bp *BashProcess) Run(ctx context.Context, command string) (string, error) {
+	command, err := bp.opts.Secrets.Substitute(command)
+	if err != nil {
+		return "", BashProcessError{
+			ProcessState: "not started",
+			Err:          err,
+		}
+	}
+
 	cmd := exec.Command("bash", "-c", command)
+	cmd.Dir = bp.opts.Dir
 
 	output, err := cmd.CombinedOutput()
 	if err != nil || cmd.ProcessState.ExitCode() != 0 {
 		return "", BashProcessError{
-			Output:       string(output),
+			Output:       bp.opts.Secrets.Mask(string(output)),
 			ProcessState: cmd.ProcessState.String(),
 			Err:          err,
 		}
 	}
 
-	return string(output), nil
+	return bp.opts.Secrets.Mask(string(output)), nil
 }
@@ -0,0 +1,50 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"flow-gpt/internal/secret"
+)
+
+func TestBashProcessSecrets(t *testing.T) {
+	bp := NewBashProcess(func(o *BashProcessOptions) {
+		o.Secrets = secret.New(map[string]string{"TOKEN": "s3cr3t-token"})
+	})
+
+	out, err := bp.Run(context.Background(), "echo token={{secret:TOKEN}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "token={{secret:TOKEN}}\n" {
+		t.Errorf("secret not masked in the output: %q", out)
+	}
+
+	_, err = bp.Run(context.Background(), "echo {{secret:TOKEN}}; exit 3")
+	var bashErr BashProcessError
+	if !errors.As(err, &bashErr) || bashErr.Output != "{{secret:TOKEN}}\n" {
+		t.Errorf("secret not masked in the error: %v", err)
+	}
+
+	_, err = bp.Run(context.Background(), "echo {{secret:MISSING}}")
+	if !errors.As(err, &bashErr) || bashErr.ProcessState != "not started" {
+		t.Errorf("expected a bash error for an unknown secret, got %v", err)
+	}
+}
+
+func TestBashProcessDir(t *testing.T) {
+	dir := t.TempDir()
+	bp := NewBashProcess(func(o *BashProcessOptions) {
+		o.Dir = dir
+	})
+
+	if _, err := bp.Run(context.Background(), "echo hello > hello.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "hello.txt")); err != nil || string(b) != "hello\n" {
+		t.Errorf("command didn't run in the directory: %q, %v", b, err)
+	}
+}
@@ -0,0 +1,138 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// BranchPrefix prefixes the working branches of runs, the git tool only commits to branches with it.
+const BranchPrefix = "flow-gpt/"
+
+// Identity of the commits made by runs.
+const (
+	GitUserName  = "flow-gpt"
+	GitUserEmail = "flow-gpt@localhost"
+)
+
+type GitError struct {
+	Args   []string
+	Output string
+	Err    error
+}
+
+func (ge GitError) Error() string {
+	return fmt.Sprintf("git %s: output=[%s], error=[%s]", strings.Join(ge.Args, " "), ge.Output, ge.Err)
+}
+
+type GitOptions struct {
+	// UserName and UserEmail are the identity of the commits.
+	UserName  string
+	UserEmail string
+}
+
+// Git runs git commands in a repository.
+type Git struct {
+	dir  string
+	opts GitOptions
+}
+
+func NewGit(dir string, optFns ...func(o *GitOptions)) *Git {
+	opts := GitOptions{
+		UserName:  GitUserName,
+		UserEmail: GitUserEmail,
+	}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	return &Git{
+		dir:  dir,
+		opts: opts,
+	}
+}
+
+// IsGitRepo tells if dir is the root of a git work tree.
+func IsGitRepo(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".git"))
+	return err == nil
+}
+
+// Dir returns the directory of the repository.
+func (g *Git) Dir() string {
+	return g.dir
+}
+
+// Run runs git with args in the repository and returns its combined output. Git never prompts for credentials.
+func (g *Git) Run(ctx context.Context, args ...string) (string, error) {
+	return g.run(ctx, nil, args...)
+}
+
+// run runs git with args and the extra environment variables env.
+func (g *Git) run(ctx context.Context, env []string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-c", "user.name=" + g.opts.UserName, "-c", "user.email=" + g.opts.UserEmail}, args...)...)
+	cmd.Dir = g.dir
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Run(); err != nil {
+		return "", GitError{Args: args, Output: strings.TrimSpace(out.String()), Err: err}
+	}
+	return out.String(), nil
+}
+
+// Head returns the commit checked out.
+func (g *Git) Head(ctx context.Context) (string, error) {
+	out, err := g.Run(ctx, "rev-parse", "HEAD")
+	return strings.TrimSpace(out), err
+}
+
+// Branch returns the branch checked out, empty when the HEAD is detached.
+func (g *Git) Branch(ctx context.Context) (string, error) {
+	out, err := g.Run(ctx, "symbolic-ref", "--quiet", "--short", "HEAD")
+	var gitErr GitError
+	if err != nil && errors.As(err, &gitErr) && gitErr.Output == "" {
+		// symbolic-ref fails silently on a detached HEAD
+		return "", nil
+	}
+	return strings.TrimSpace(out), err
+}
+
+// Diff returns the changes of the work tree since the commit base, new files included. The index of the repository is
+// left as it is.
+func (g *Git) Diff(ctx context.Context, base string) (string, error) {
+	index, err := g.Run(ctx, "rev-parse", "--git-path", "index")
+	if err != nil {
+		return "", err
+	}
+	index = strings.TrimSpace(index)
+	if !filepath.IsAbs(index) {
+		index = filepath.Join(g.dir, index)
+	}
+	dir, err := os.MkdirTemp("", "flow-gpt-index-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary index: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	tmpIndex := filepath.Join(dir, "index")
+	b, err := os.ReadFile(index)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to read index: %w", err)
+	}
+	// a repository without an index gets none either, git creates it
+	if err == nil {
+		if err = os.WriteFile(tmpIndex, b, 0644); err != nil {
+			return "", fmt.Errorf("failed to write temporary index: %w", err)
+		}
+	}
+	env := []string{"GIT_INDEX_FILE=" + tmpIndex}
+	// new files only show up in the diff once they are known to the index
+	if _, err = g.run(ctx, env, "add", "--all", "--intent-to-add"); err != nil {
+		return "", err
+	}
+	return g.run(ctx, env, "diff", base, "--")
+}
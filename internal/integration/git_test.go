@@ -0,0 +1,53 @@
+package integration
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGitDiff(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	g := NewGit(dir)
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"init", "--quiet"}, {"add", "."}, {"commit", "--quiet", "-m", "init"}} {
+		if _, err := g.Run(ctx, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base, err := g.Head(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "new.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	status, err := g.Run(ctx, "status", "--porcelain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := g.Diff(ctx, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(diff, "+func main() {}") || !strings.Contains(diff, "+++ b/new.go") {
+		t.Errorf("unexpected diff %s", diff)
+	}
+	// the new file is still untracked
+	if after, err := g.Run(ctx, "status", "--porcelain"); err != nil || after != status {
+		t.Errorf("the diff changed the index, status %q, want %q: %v", after, status, err)
+	}
+}
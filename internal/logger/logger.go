@@ -1,13 +1,15 @@
 package logger
 
 import (
+	"io"
 	"os"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-func NewGlobal(level string, pretty bool) error {
+// NewGlobal configures the global logger to write to out, or stderr if out is nil.
+func NewGlobal(level string, pretty bool, out io.Writer) error {
 	l, err := zerolog.ParseLevel(level)
 	if err != nil {
 		return err
@@ -15,8 +17,13 @@ func NewGlobal(level string, pretty bool) error {
 
 	zerolog.SetGlobalLevel(l)
 
+	if out == nil {
+		out = os.Stderr
+	}
 	if pretty {
-		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: out})
+	} else {
+		log.Logger = log.Output(out)
 	}
 	return nil
 }
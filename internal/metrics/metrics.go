@@ -0,0 +1,135 @@
+// Package metrics exposes Prometheus metrics of runs, fed by the events of the FSM.
+package metrics
+
+import (
+	customAgent "flow-gpt/internal/agent"
+	"flow-gpt/internal/fsm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const Namespace = "flowgpt"
+
+// Metrics holds the collectors of the runs. Observe is safe for concurrent use, so one Metrics can serve many runs.
+type Metrics struct {
+	RunsStarted  prometheus.Counter
+	RunsFinished *prometheus.CounterVec
+	Turns        prometheus.Histogram
+	Transitions  *prometheus.CounterVec
+	Critiques    *prometheus.CounterVec
+	LLMDuration  *prometheus.HistogramVec
+	LLMTokens    *prometheus.CounterVec
+	Retries      *prometheus.CounterVec
+	ToolCalls    *prometheus.CounterVec
+	ToolErrors   *prometheus.CounterVec
+	ToolDuration *prometheus.HistogramVec
+}
+
+// New creates the collectors and registers them with reg.
+func New(reg prometheus.Registerer) *Metrics {
+	f := promauto.With(reg)
+	return &Metrics{
+		RunsStarted: f.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "runs_started_total",
+			Help:      "Number of runs started.",
+		}),
+		RunsFinished: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "runs_finished_total",
+			Help:      "Number of runs finished, by status completed or failed.",
+		}, []string{"status"}),
+		Turns: f.NewHistogram(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "run_turns",
+			Help:      "Number of turns of finished runs.",
+			Buckets:   []float64{1, 2, 3, 5, 8, 13, 21, 34, 55},
+		}),
+		Transitions: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "state_transitions_total",
+			Help:      "Number of state transitions, by source and target state.",
+		}, []string{"from", "to"}),
+		Critiques: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "critiques_total",
+			Help:      "Number of critic verdicts, by subject thought or action and status good or bad.",
+		}, []string{"subject", "status"}),
+		LLMDuration: f.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "llm_duration_seconds",
+			Help:      "Latency of successful model calls, by role and model.",
+			Buckets:   prometheus.ExponentialBuckets(0.25, 2, 8),
+		}, []string{"role", "model"}),
+		LLMTokens: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "llm_tokens_total",
+			Help:      "Number of tokens used by model calls, by role and model.",
+		}, []string{"role", "model"}),
+		Retries: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "retries_total",
+			Help:      "Number of retried model and agent calls, by role.",
+		}, []string{"role"}),
+		ToolCalls: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "tool_invocations_total",
+			Help:      "Number of tool invocations, by tool.",
+		}, []string{"tool"}),
+		ToolErrors: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "tool_errors_total",
+			Help:      "Number of failed tool invocations, by tool.",
+		}, []string{"tool"}),
+		ToolDuration: f.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "tool_duration_seconds",
+			Help:      "Duration of tool invocations, by tool.",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+		}, []string{"tool"}),
+	}
+}
+
+// Observe updates the metrics with an event of a run, it is an fsm.Observer.
+func (m *Metrics) Observe(event fsm.Event) {
+	switch event.Type {
+	case fsm.EventStart:
+		m.RunsStarted.Inc()
+	case fsm.EventFinish:
+		status := "completed"
+		if event.Error != "" {
+			status = "failed"
+		}
+		m.RunsFinished.WithLabelValues(status).Inc()
+		m.Turns.Observe(float64(event.Turn))
+	case fsm.EventTransition:
+		m.Transitions.WithLabelValues(event.From, event.State).Inc()
+	case fsm.EventCritique:
+		m.Critiques.WithLabelValues(event.Subject, event.Content).Inc()
+	case fsm.EventChat:
+		m.LLMDuration.WithLabelValues(event.Role, event.Model).Observe(event.Duration.Seconds())
+		m.LLMTokens.WithLabelValues(event.Role, event.Model).Add(float64(event.Tokens))
+	case fsm.EventRetry:
+		m.Retries.WithLabelValues(event.Role).Inc()
+	case fsm.EventAudit:
+		for _, r := range event.Audit {
+			m.observeRecord(r)
+		}
+	}
+}
+
+func (m *Metrics) observeRecord(r customAgent.Record) {
+	switch r.Kind {
+	case customAgent.RecordLLMEnd:
+		m.LLMDuration.WithLabelValues(fsm.RoleAgent, r.Model).Observe(r.Duration.Seconds())
+		if r.Tokens != nil {
+			m.LLMTokens.WithLabelValues(fsm.RoleAgent, r.Model).Add(float64(r.Tokens.Total))
+		}
+	case customAgent.RecordToolEnd, customAgent.RecordToolError:
+		m.ToolCalls.WithLabelValues(r.Tool).Inc()
+		m.ToolDuration.WithLabelValues(r.Tool).Observe(r.Duration.Seconds())
+		if r.Kind == customAgent.RecordToolError {
+			m.ToolErrors.WithLabelValues(r.Tool).Inc()
+		}
+	}
+}
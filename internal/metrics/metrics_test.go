@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"flow-gpt/internal/fake"
+	"flow-gpt/internal/fsm"
+	"github.com/hupe1980/golc/schema"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+func TestObserve(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	model := fake.NewChatModel(
+		fake.Response{Match: []string{"Let's start working on the problem"}, Content: `{"resources":{},"type":"agent","thought":"list the files","output":"Run ls in the terminal."}`},
+		fake.Response{Match: []string{"critically evaluate and analyze", "list the files"}, Content: `{"type":"critique","status":"good","reason":"ok"}`},
+		fake.Response{Match: []string{"Complete the following problem:"}, FunctionCall: fake.ToolCall("Terminal", "ls")},
+		fake.Response{Match: []string{"main.go"}, Content: "I listed the files."},
+		fake.Response{Match: []string{"analyze and validate the completed tasks"}, Content: `{"type":"critique","status":"bad","reason":"not ok"}`},
+		fake.Response{Match: []string{"Review the history from previous turns"}, Content: `{"resources":{},"type":"complete","thought":"the files were listed"}`},
+		fake.Response{Match: []string{"critically evaluate and analyze", "the files were listed"}, Content: `{"type":"critique","status":"good","reason":"ok"}`},
+	)
+	reg := prometheus.NewRegistry()
+	m := New(reg)
+	f, err := fsm.New("list the files", 0, func(o *fsm.Options) {
+		o.ChatModel = model
+		o.Tools = []schema.Tool{fake.NewTool("Terminal", fake.ToolResult{Match: "ls", Output: "main.go"})}
+		o.MaxRetries = 1
+		o.Observers = []fsm.Observer{m.Observe}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range f.Stream() {
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = f.Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		c    prometheus.Collector
+		want float64
+	}{
+		"started":         {m.RunsStarted, 1},
+		"completed":       {m.RunsFinished.WithLabelValues("completed"), 1},
+		"init transition": {m.Transitions.WithLabelValues("Init", "JudgeThought"), 1},
+		"good thoughts":   {m.Critiques.WithLabelValues(fsm.SubjectThought, "good"), 2},
+		"bad actions":     {m.Critiques.WithLabelValues(fsm.SubjectAction, "bad"), 1},
+		"tool calls":      {m.ToolCalls.WithLabelValues("Terminal"), 1},
+		"tool errors":     {m.ToolErrors.WithLabelValues("Terminal"), 0},
+	} {
+		if got := testutil.ToFloat64(tc.c); got != tc.want {
+			t.Errorf("%s = %v, want %v", name, got, tc.want)
+		}
+	}
+	if n := testutil.CollectAndCount(m.LLMTokens); n != 3 {
+		t.Errorf("expected tokens of the thinker, critic and agent, got %d series", n)
+	}
+	if n := testutil.CollectAndCount(m.LLMDuration); n != 3 {
+		t.Errorf("expected latencies of the thinker, critic and agent, got %d series", n)
+	}
+}
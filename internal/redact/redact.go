@@ -0,0 +1,142 @@
+// Package redact masks secrets in tool outputs, events and logs before they leave the process.
+package redact
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const Mask = "[REDACTED]"
+
+// MinValueLength is the length below which configured secret values are not redacted, short values would mask
+// unrelated text.
+const MinValueLength = 4
+
+// Builtins match common key formats. When a pattern has a group named "secret" only the group is masked, so the name
+// of an assignment stays readable.
+var Builtins = []string{
+	// OpenAI and Anthropic style keys
+	`\bsk-[A-Za-z0-9_-]{20,}`,
+	// AWS access key ids
+	`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+	// GitHub tokens
+	`\bgh[pousr]_[A-Za-z0-9]{36,}\b`,
+	`\bgithub_pat_[A-Za-z0-9_]{22,}\b`,
+	// Slack tokens
+	`\bxox[abposr]-[A-Za-z0-9-]{10,}`,
+	// Google API keys
+	`\bAIza[0-9A-Za-z_-]{35}`,
+	// JSON web tokens
+	`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`,
+	// PEM private keys
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`,
+	// bearer tokens of authorization headers
+	`(?i)\bbearer\s+(?P<secret>[A-Za-z0-9._~+/-]{8,}=*)`,
+	// credentials of URLs
+	`[a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]+:(?P<secret>[^/\s@]+)@`,
+	// assignments of env files and shell exports
+	`(?im)^\s*(?:export\s+)?[A-Z0-9_]*(?:KEY|SECRET|TOKEN|PASSWORD|PASSWD|CREDENTIALS)[A-Z0-9_]*\s*[=:]\s*["']?(?P<secret>[^\s"']+)`,
+}
+
+type Options struct {
+	// Patterns are regular expressions of secrets redacted in addition to the builtins.
+	Patterns []string
+	// Values are literal secrets, like the values of configured API keys.
+	Values []string
+	// NoBuiltins disables the builtin patterns.
+	NoBuiltins bool
+}
+
+// Redactor masks secrets in text. It is safe for concurrent use.
+type Redactor struct {
+	patterns []*regexp.Regexp
+	values   []string
+}
+
+// New creates a redactor of the builtin patterns and the configured patterns and values.
+func New(optFns ...func(o *Options)) (*Redactor, error) {
+	opts := Options{}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+
+	var sources []string
+	if !opts.NoBuiltins {
+		sources = append(sources, Builtins...)
+	}
+	sources = append(sources, opts.Patterns...)
+
+	r := &Redactor{}
+	for _, s := range sources {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", s, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	for _, v := range opts.Values {
+		if len(v) >= MinValueLength {
+			r.values = append(r.values, v)
+		}
+	}
+	// longest first, so a secret containing another one is masked as a whole
+	sort.Slice(r.values, func(i, j int) bool {
+		return len(r.values[i]) > len(r.values[j])
+	})
+	return r, nil
+}
+
+// String returns s with every secret masked, a nil redactor returns s unchanged.
+func (r *Redactor) String(s string) string {
+	if r == nil || s == "" {
+		return s
+	}
+	for _, v := range r.values {
+		s = strings.ReplaceAll(s, v, Mask)
+	}
+	for _, re := range r.patterns {
+		s = replace(re, s)
+	}
+	return s
+}
+
+func replace(re *regexp.Regexp, s string) string {
+	group := re.SubexpIndex("secret")
+	if group < 0 {
+		return re.ReplaceAllLiteralString(s, Mask)
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+		start, end := m[2*group], m[2*group+1]
+		if start < 0 {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(Mask)
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// Writer returns a writer masking the secrets of each write before passing it to w. Loggers writing one entry per
+// write, like zerolog, get each entry redacted as a whole.
+func (r *Redactor) Writer(w io.Writer) io.Writer {
+	return &writer{r: r, w: w}
+}
+
+type writer struct {
+	r *Redactor
+	w io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, w.r.String(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,56 @@
+package redact
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"flow-gpt/internal/integration"
+	"github.com/hupe1980/golc/schema"
+)
+
+var _ schema.Tool = (*Tool)(nil)
+
+// Tool masks the secrets in the output and errors of the wrapped tool, so they never reach the agent, the audit log
+// or the prompts of the FSM.
+type Tool struct {
+	schema.Tool
+	redactor *Redactor
+}
+
+// WrapTools wraps the tools with the redactor.
+func (r *Redactor) WrapTools(tools []schema.Tool) []schema.Tool {
+	wrapped := make([]schema.Tool, len(tools))
+	for i, t := range tools {
+		wrapped[i] = &Tool{Tool: t, redactor: r}
+	}
+	return wrapped
+}
+
+func (t *Tool) Run(ctx context.Context, input any) (string, error) {
+	output, err := t.Tool.Run(ctx, input)
+	if err != nil {
+		return "", t.redactor.Error(err)
+	}
+	return t.redactor.String(output), nil
+}
+
+// Error returns err with its message masked. Bash errors are rebuilt with masked fields so they can still be told
+// apart.
+func (r *Redactor) Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	var bashErr integration.BashProcessError
+	if errors.As(err, &bashErr) {
+		masked := integration.BashProcessError{
+			Output:       r.String(bashErr.Output),
+			ProcessState: bashErr.ProcessState,
+		}
+		if bashErr.Err != nil {
+			masked.Err = errors.New(r.String(bashErr.Err.Error()))
+		}
+		return fmt.Errorf("%s: %w", r.String(err.Error()), masked)
+	}
+	return errors.New(r.String(err.Error()))
+}
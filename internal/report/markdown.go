@@ -0,0 +1,128 @@
+package report
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Markdown renders the report.
+func Markdown(r Report) string {
+	var sb strings.Builder
+	w := func(format string, args ...any) {
+		fmt.Fprintf(&sb, format, args...)
+	}
+
+	w("# Run %s: %s\n\n", r.Run, r.Status)
+	if r.Error != "" {
+		w("**Error:** %s\n\n", r.Error)
+	}
+	w("## Problem\n\n%s\n\n", quote(r.Problem))
+
+	w("## Result\n\n%s\n\n", orNone(r.Result.Answer))
+	if len(r.Result.Resources) > 0 && string(r.Result.Resources) != "{}" {
+		w("Resources:\n\n```json\n%s\n```\n\n", r.Result.Resources)
+	}
+	if r.Result.Output != "" {
+		w("Output of the last action:\n\n```\n%s\n```\n\n", r.Result.Output)
+	}
+
+	w("## Steps\n\n")
+	if len(r.Steps) == 0 {
+		w("None.\n\n")
+	}
+	for i, s := range r.Steps {
+		w("%d. **Turn %d:** %s\n", i+1, s.Turn, oneLine(s.Thought))
+		item := func(label, text string) {
+			if text != "" {
+				w("   - %s: %s\n", label, oneLine(text))
+			}
+		}
+		item("Critic", s.Verdict)
+		item("Action", s.Action)
+		item("Approval", s.Approval)
+		item("Outcome", s.Outcome)
+		item("Error", s.Error)
+		item("Action critic", s.ActionVerdict)
+		for _, n := range s.Notes {
+			item("Note", n)
+		}
+	}
+	w("\n")
+
+	w("## Artifacts\n\n")
+	if len(r.Artifacts) == 0 {
+		w("None.\n")
+	}
+	for _, a := range r.Artifacts {
+		if a.Status != "" {
+			w("- `%s` (%s, %d bytes)\n", a.Path, a.Status, a.Size)
+		} else {
+			w("- `%s` (%d bytes)\n", a.Path, a.Size)
+		}
+	}
+	w("\n")
+
+	if r.Diff != nil {
+		w("## Changes\n\n")
+		switch {
+		case r.Diff.Error != "":
+			w("Failed to diff the workspace: %s\n\n", r.Diff.Error)
+		case r.Diff.Patch == "":
+			w("The run didn't change the repository of its workspace.\n\n")
+		default:
+			w("Changes to the repository of the workspace since `%s`:\n\n````diff\n%s\n````\n\n", r.Diff.Base, strings.TrimRight(r.Diff.Patch, "\n"))
+		}
+	}
+
+	w("## Verification evidence\n\n")
+	if len(r.Evidence) == 0 {
+		w("No tool call of an accepted action.\n\n")
+	}
+	for _, e := range r.Evidence {
+		w("- Turn %d, %s: `%s`\n", e.Turn, e.Tool, oneLine(e.Input))
+		out := e.Output
+		if e.Error != "" {
+			out = "error: " + e.Error
+		}
+		if out != "" {
+			w("\n  ```\n%s\n  ```\n", indent(out, "  "))
+		}
+	}
+	w("\n")
+
+	w("## Usage\n\n")
+	w("| | |\n|---|---|\n")
+	w("| Thinker tokens | %d |\n", r.Tokens.Thinker)
+	w("| Critic tokens | %d |\n", r.Tokens.Critic)
+	w("| Agent tokens | %d |\n", r.Tokens.Agent)
+	w("| Total tokens | %d |\n", r.Tokens.Total)
+	w("| Estimated cost | $%.4f |\n", r.Cost)
+	w("| Duration | %s |\n", r.Duration.Round(time.Second))
+	if !r.StartedAt.IsZero() {
+		w("| Started | %s |\n", r.StartedAt.Format(time.RFC3339))
+	}
+	if !r.FinishedAt.IsZero() {
+		w("| Finished | %s |\n", r.FinishedAt.Format(time.RFC3339))
+	}
+	return sb.String()
+}
+
+func quote(s string) string {
+	return "> " + strings.ReplaceAll(strings.TrimSpace(s), "\n", "\n> ")
+}
+
+func orNone(s string) string {
+	if strings.TrimSpace(s) == "" {
+		return "None."
+	}
+	return s
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func indent(s, prefix string) string {
+	return prefix + strings.ReplaceAll(s, "\n", "\n"+prefix)
+}
@@ -0,0 +1,428 @@
+// Package report builds the final report of a run from its events: the problem, the result, the steps taken, the
+// artifacts, the evidence of the audit log and the tokens used. It is written as Markdown and JSON when the run
+// finishes.
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	customAgent "flow-gpt/internal/agent"
+	"flow-gpt/internal/fsm"
+	"flow-gpt/internal/workspace"
+	zLog "github.com/rs/zerolog/log"
+	"github.com/tidwall/gjson"
+)
+
+// Files the report is written to in the output directory of the run.
+const (
+	MarkdownFile = "report.md"
+	JSONFile     = "report.json"
+)
+
+// Limits of the report, longer outputs are cut and extra artifacts are left out.
+const (
+	MaxOutputLength = 2000
+	MaxArtifacts    = 200
+	MaxEvidence     = 20
+)
+
+// Statuses of a finished run, by the reason it finished.
+const (
+	StatusCompleted       = "completed"
+	StatusFailed          = "failed"
+	StatusCancelled       = "cancelled"
+	StatusBudgetExhausted = "budget_exhausted"
+)
+
+// Price is the price in USD of a thousand tokens of a model.
+type Price struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// Prices are the prices of the OpenAI chat models, used to estimate the cost of a run.
+var Prices = map[string]Price{
+	"gpt-4":             {Prompt: 0.03, Completion: 0.06},
+	"gpt-4-32k":         {Prompt: 0.06, Completion: 0.12},
+	"gpt-3.5-turbo":     {Prompt: 0.0015, Completion: 0.002},
+	"gpt-3.5-turbo-16k": {Prompt: 0.003, Completion: 0.004},
+}
+
+type Report struct {
+	Run       string     `json:"run"`
+	Problem   string     `json:"problem"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	Result    Result     `json:"result"`
+	Steps     []*Step    `json:"steps"`
+	Artifacts []Artifact `json:"artifacts"`
+	Evidence  []Evidence `json:"evidence"`
+	// Diff is the change of the run to the git repository of its workspace, nil if it has none.
+	Diff   *Diff  `json:"diff,omitempty"`
+	Tokens Tokens `json:"tokens"`
+	// Cost is the cost estimated from Prices, model calls of unknown models aren't counted.
+	Cost       float64       `json:"cost"`
+	StartedAt  time.Time     `json:"startedAt"`
+	FinishedAt time.Time     `json:"finishedAt"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// Result is the answer of the thinker when it considered the problem solved, or its last thought.
+type Result struct {
+	Answer    string          `json:"answer"`
+	Resources json.RawMessage `json:"resources,omitempty"`
+	// Output is the output of the last action.
+	Output string `json:"output,omitempty"`
+}
+
+// Step is a thought of the thinker with what followed it.
+type Step struct {
+	Turn          int      `json:"turn"`
+	Thought       string   `json:"thought"`
+	Verdict       string   `json:"verdict,omitempty"`
+	Action        string   `json:"action,omitempty"`
+	Approval      string   `json:"approval,omitempty"`
+	Outcome       string   `json:"outcome,omitempty"`
+	Error         string   `json:"error,omitempty"`
+	ActionVerdict string   `json:"actionVerdict,omitempty"`
+	Notes         []string `json:"notes,omitempty"`
+	resources     json.RawMessage
+	complete      bool
+	evidence      []Evidence
+}
+
+// Artifact is a file in the output directory of the run, or one the run changed in its workspace.
+type Artifact struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	// Status is the change of the file in the workspace: created, modified or deleted.
+	Status string `json:"status,omitempty"`
+}
+
+// Evidence is a tool call of an action which the critic accepted.
+type Evidence struct {
+	Turn   int    `json:"turn"`
+	Tool   string `json:"tool"`
+	Input  string `json:"input"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Diff is the final diff of the run against the commit its workspace started from.
+type Diff struct {
+	Base  string `json:"base,omitempty"`
+	Patch string `json:"patch"`
+	Error string `json:"error,omitempty"`
+}
+
+// Tokens are the tokens used by role.
+type Tokens struct {
+	Thinker int `json:"thinker"`
+	Critic  int `json:"critic"`
+	Agent   int `json:"agent"`
+	Total   int `json:"total"`
+}
+
+// Builder builds the report of a run from its events.
+type Builder struct {
+	report Report
+	reason string
+	base   string
+}
+
+func NewBuilder(run string) *Builder {
+	return &Builder{report: Report{Run: run}}
+}
+
+// SetBase sets the commit the diff of the run is against.
+func (b *Builder) SetBase(base string) {
+	b.base = base
+}
+
+// Observe adds an event of the run to the report.
+func (b *Builder) Observe(e fsm.Event) {
+	r := &b.report
+	switch e.Type {
+	case fsm.EventStart:
+		r.Problem, r.StartedAt = e.Content, e.Time
+	case fsm.EventChat:
+		if e.PromptTokens+e.CompletionTokens > 0 {
+			b.addTokens(e.Role, e.Model, e.PromptTokens, e.CompletionTokens)
+		} else {
+			// events stored before chat events had the parts of their tokens
+			b.addTokens(e.Role, e.Model, e.Tokens, 0)
+		}
+		if e.Role == fsm.RoleThinker {
+			b.addThought(e)
+		} else if e.Role == fsm.RoleCritic {
+			// the reason of the verdict which the critique event follows with
+			b.reason = gjson.Get(e.Content, "reason").String()
+		}
+	case fsm.EventCritique:
+		if s := b.step(); s != nil {
+			verdict := e.Content
+			if b.reason != "" {
+				verdict += ": " + b.reason
+			}
+			if e.Subject == fsm.SubjectAction {
+				s.ActionVerdict = verdict
+				if e.Content != "good" {
+					s.evidence = nil
+				}
+			} else {
+				s.Verdict = verdict
+			}
+		}
+		b.reason = ""
+	case fsm.EventMessage:
+		if gjson.Get(e.Content, "type").String() != "action" {
+			return
+		}
+		if s := b.step(); s != nil {
+			s.Outcome = cut(gjson.Get(e.Content, "output").String())
+			s.Error = gjson.Get(e.Content, "error").String()
+		}
+	case fsm.EventAudit:
+		s := b.step()
+		for _, rec := range e.Audit {
+			if rec.Tokens != nil {
+				b.addTokens(fsm.RoleAgent, rec.Model, rec.Tokens.Prompt, rec.Tokens.Completion)
+			}
+			if s != nil && (rec.Kind == customAgent.RecordToolEnd || rec.Kind == customAgent.RecordToolError) {
+				s.evidence = append(s.evidence, Evidence{
+					Turn:   e.Turn,
+					Tool:   rec.Tool,
+					Input:  cut(rec.Input),
+					Output: cut(rec.Output),
+					Error:  rec.Error,
+				})
+			}
+		}
+	case fsm.EventApproval:
+		if s := b.step(); s != nil {
+			s.Approval = "pending"
+		}
+	case fsm.EventDecision:
+		if s := b.step(); s != nil {
+			s.Approval = e.Content
+			if e.Error != "" {
+				s.Approval += ": " + e.Error
+			}
+		}
+	case fsm.EventHint:
+		if s := b.step(); s != nil {
+			s.Notes = append(s.Notes, "hint: "+e.Content)
+		}
+	case fsm.EventRetry:
+		if s := b.step(); s != nil {
+			s.Notes = append(s.Notes, "retry of the "+e.Role+": "+e.Error)
+		}
+	case fsm.EventDiff:
+		r.Diff = &Diff{Base: b.base, Patch: e.Content, Error: e.Error}
+	case fsm.EventFinish:
+		r.FinishedAt, r.Error = e.Time, e.Error
+		r.Status = finishStatus(e)
+		if !r.StartedAt.IsZero() {
+			r.Duration = r.FinishedAt.Sub(r.StartedAt)
+		}
+	}
+}
+
+// finishStatus returns the status of the run by the reason of its finish event.
+func finishStatus(e fsm.Event) string {
+	switch e.Reason {
+	case fsm.ReasonCompleted:
+		return StatusCompleted
+	case fsm.ReasonCancelled:
+		return StatusCancelled
+	case fsm.ReasonBudgetExhausted:
+		return StatusBudgetExhausted
+	case fsm.ReasonFailed:
+		return StatusFailed
+	}
+	if e.Error != "" {
+		return StatusFailed
+	}
+	return StatusCompleted
+}
+
+func (b *Builder) addThought(e fsm.Event) {
+	s := &Step{Turn: e.Turn, Thought: e.Content}
+	if gjson.Valid(e.Content) {
+		if t := gjson.Get(e.Content, "thought").String(); t != "" {
+			s.Thought = t
+		}
+		if res := gjson.Get(e.Content, "resources"); res.Exists() {
+			s.resources = json.RawMessage(res.Raw)
+		}
+		switch gjson.Get(e.Content, "type").String() {
+		case "agent":
+			action := gjson.Get(e.Content, "output").String()
+			for _, a := range gjson.Get(e.Content, "actions").Array() {
+				action += "\n- " + a.String()
+			}
+			s.Action = strings.TrimSpace(action)
+		case "complete":
+			s.complete = true
+		}
+	}
+	b.report.Steps = append(b.report.Steps, s)
+}
+
+// step returns the step of the last thought, events before the first thought have none.
+func (b *Builder) step() *Step {
+	if len(b.report.Steps) == 0 {
+		return nil
+	}
+	return b.report.Steps[len(b.report.Steps)-1]
+}
+
+func (b *Builder) addTokens(role, model string, prompt, completion int) {
+	t := &b.report.Tokens
+	switch role {
+	case fsm.RoleThinker:
+		t.Thinker += prompt + completion
+	case fsm.RoleCritic:
+		t.Critic += prompt + completion
+	default:
+		t.Agent += prompt + completion
+	}
+	t.Total += prompt + completion
+	if p, ok := Prices[model]; ok {
+		b.report.Cost += float64(prompt)/1000*p.Prompt + float64(completion)/1000*p.Completion
+	}
+}
+
+// Report returns the report of the events observed so far.
+func (b *Builder) Report() Report {
+	r := b.report
+	r.Evidence = nil
+	for _, s := range r.Steps {
+		r.Evidence = append(r.Evidence, s.evidence...)
+	}
+	if len(r.Evidence) > MaxEvidence {
+		r.Evidence = r.Evidence[len(r.Evidence)-MaxEvidence:]
+	}
+	for i := len(r.Steps) - 1; i >= 0; i-- {
+		s := r.Steps[i]
+		if r.Result.Answer == "" && (s.complete || i == len(r.Steps)-1) {
+			r.Result.Answer, r.Result.Resources = s.Thought, s.resources
+		}
+		if r.Result.Output == "" && s.Outcome != "" {
+			r.Result.Output = s.Outcome
+		}
+	}
+	return r
+}
+
+// Observer returns the observer of a run which writes its report to dir when it finishes. The files the run changed
+// in its workspace are its artifacts, the files of dir without a workspace.
+func Observer(run, dir string, ws *workspace.Workspace) fsm.Observer {
+	b := NewBuilder(run)
+	if ws != nil {
+		b.SetBase(ws.Base)
+	}
+	return func(e fsm.Event) {
+		b.Observe(e)
+		if e.Type != fsm.EventFinish {
+			return
+		}
+		r := b.Report()
+		var err error
+		if ws != nil {
+			r.Artifacts, err = workspaceArtifacts(ws)
+		} else {
+			r.Artifacts, err = Artifacts(dir)
+		}
+		if err != nil {
+			zLog.Warn().Err(err).Str("dir", dir).Msg("failed to list the artifacts of the run")
+		}
+		if err = Write(r, dir); err != nil {
+			zLog.Error().Err(err).Msg("failed to write the report of the run")
+			return
+		}
+		zLog.Info().Str("run", run).Str("report", filepath.Join(dir, MarkdownFile)).Msg("wrote report")
+	}
+}
+
+// Artifacts lists the files of dir but the report, at most MaxArtifacts of them.
+func Artifacts(dir string) ([]Artifact, error) {
+	var artifacts []Artifact
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == MarkdownFile || rel == JSONFile {
+			return err
+		}
+		if len(artifacts) == MaxArtifacts {
+			return filepath.SkipAll
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		artifacts = append(artifacts, Artifact{Path: filepath.ToSlash(rel), Size: info.Size(), Modified: info.ModTime()})
+		return nil
+	})
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifacts[i].Path < artifacts[j].Path
+	})
+	return artifacts, err
+}
+
+// workspaceArtifacts lists the files the run changed in its workspace, at most MaxArtifacts of them.
+func workspaceArtifacts(ws *workspace.Workspace) ([]Artifact, error) {
+	files, err := ws.Artifacts()
+	var artifacts []Artifact
+	for _, f := range files {
+		if len(artifacts) == MaxArtifacts {
+			break
+		}
+		artifacts = append(artifacts, Artifact{Path: f.Path, Size: f.Size, Modified: f.Modified, Status: f.Status})
+	}
+	return artifacts, err
+}
+
+// Write saves the report to dir as Markdown and JSON.
+func Write(r Report, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create report directory: %w", err)
+	}
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(dir, JSONFile), b, 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, MarkdownFile), []byte(Markdown(r)), 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+func cut(s string) string {
+	if r := []rune(s); len(r) > MaxOutputLength {
+		return string(r[:MaxOutputLength-3]) + "..."
+	}
+	return s
+}
@@ -0,0 +1,158 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	customAgent "flow-gpt/internal/agent"
+	"flow-gpt/internal/fake"
+	"flow-gpt/internal/fsm"
+	"flow-gpt/internal/workspace"
+	"github.com/hupe1980/golc/schema"
+	"github.com/rs/zerolog"
+)
+
+func TestBuilder(t *testing.T) {
+	start := time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)
+	b := NewBuilder("run-1")
+	b.SetBase("abc123")
+	for _, e := range []fsm.Event{
+		{Type: fsm.EventStart, Content: "write hello.txt", Time: start},
+		{Type: fsm.EventChat, Role: fsm.RoleThinker, Model: "gpt-4", Tokens: 1000, PromptTokens: 900, CompletionTokens: 100, Turn: 1,
+			Content: `{"type":"agent","thought":"write the file","output":"create hello.txt","actions":["echo hello > hello.txt"]}`},
+		{Type: fsm.EventChat, Role: fsm.RoleCritic, Model: "gpt-4", Tokens: 500, Content: `{"type":"critique","status":"good","reason":"sensible"}`},
+		{Type: fsm.EventCritique, Subject: fsm.SubjectThought, Content: "good", Turn: 2},
+		{Type: fsm.EventAudit, Turn: 3, Audit: []customAgent.Record{
+			{Kind: customAgent.RecordToolEnd, Tool: "Terminal", Input: "echo hello > hello.txt && cat hello.txt", Output: "hello"},
+			{Kind: customAgent.RecordLLMEnd, Model: "gpt-4", Tokens: &customAgent.TokenUsage{Prompt: 100, Completion: 50, Total: 150}},
+		}},
+		{Type: fsm.EventMessage, Turn: 3, Content: `{"type":"action","output":"hello.txt contains hello"}`},
+		{Type: fsm.EventCritique, Subject: fsm.SubjectAction, Content: "good", Turn: 4},
+		{Type: fsm.EventHint, Content: "check the file", Turn: 4},
+		{Type: fsm.EventChat, Role: fsm.RoleThinker, Model: "gpt-4", Tokens: 1000, Turn: 5,
+			Content: `{"type":"complete","thought":"hello.txt was written","resources":{"file":"hello.txt"}}`},
+		{Type: fsm.EventDiff, Content: "diff --git a/hello.txt b/hello.txt\n+hello\n"},
+		{Type: fsm.EventFinish, Reason: fsm.ReasonCompleted, Time: start.Add(90 * time.Second)},
+	} {
+		b.Observe(e)
+	}
+	r := b.Report()
+
+	if r.Status != StatusCompleted || r.Problem != "write hello.txt" || r.Duration != 90*time.Second {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if r.Result.Answer != "hello.txt was written" || string(r.Result.Resources) != `{"file":"hello.txt"}` ||
+		r.Result.Output != "hello.txt contains hello" {
+		t.Errorf("unexpected result %+v", r.Result)
+	}
+	if len(r.Steps) != 2 || r.Steps[0].Verdict != "good: sensible" || r.Steps[0].ActionVerdict != "good" ||
+		!strings.Contains(r.Steps[0].Action, "- echo hello > hello.txt") || len(r.Steps[0].Notes) != 1 {
+		t.Errorf("unexpected steps %+v", r.Steps)
+	}
+	if len(r.Evidence) != 1 || r.Evidence[0].Tool != "Terminal" || r.Evidence[0].Output != "hello" {
+		t.Errorf("unexpected evidence %+v", r.Evidence)
+	}
+	if r.Diff == nil || r.Diff.Base != "abc123" || !strings.Contains(r.Diff.Patch, "+hello") {
+		t.Errorf("unexpected diff %+v", r.Diff)
+	}
+	if r.Tokens != (Tokens{Thinker: 2000, Critic: 500, Agent: 150, Total: 2650}) {
+		t.Errorf("unexpected tokens %+v", r.Tokens)
+	}
+	// the first thought and the agent call priced by their parts, the chat events without parts as prompt tokens
+	if want := 0.9*0.03 + 0.1*0.06 + 1.5*0.03 + 0.1*0.03 + 0.05*0.06; r.Cost < want-1e-9 || r.Cost > want+1e-9 {
+		t.Errorf("cost = %f, want %f", r.Cost, want)
+	}
+
+	md := Markdown(r)
+	for _, want := range []string{"# Run run-1: completed", "> write hello.txt", "hello.txt was written", "1. **Turn 1:** write the file",
+		"Action critic: good", "## Changes", "since `abc123`", "````diff\ndiff --git a/hello.txt b/hello.txt\n+hello\n````", "Turn 3, Terminal: `echo hello > hello.txt && cat hello.txt`", "| Total tokens | 2650 |", "| Duration | 1m30s |"} {
+		if !strings.Contains(md, want) {
+			t.Errorf("markdown misses %q:\n%s", want, md)
+		}
+	}
+}
+
+func TestBuilderStatus(t *testing.T) {
+	for _, tt := range []struct {
+		event fsm.Event
+		want  string
+	}{
+		{fsm.Event{Reason: fsm.ReasonCompleted}, StatusCompleted},
+		{fsm.Event{Reason: fsm.ReasonFailed, Error: "boom"}, StatusFailed},
+		{fsm.Event{Reason: fsm.ReasonCancelled, Error: "context canceled"}, StatusCancelled},
+		{fsm.Event{Reason: fsm.ReasonBudgetExhausted, Error: "turn limit reached: 5 turns"}, StatusBudgetExhausted},
+		{fsm.Event{Error: "boom"}, StatusFailed},
+	} {
+		b := NewBuilder("run-1")
+		tt.event.Type = fsm.EventFinish
+		b.Observe(tt.event)
+		if r := b.Report(); r.Status != tt.want || r.Error != tt.event.Error {
+			t.Errorf("finish %+v reported as %q (%s), want %q", tt.event, r.Status, r.Error, tt.want)
+		}
+	}
+}
+
+func TestObserver(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	dir := filepath.Join(t.TempDir(), "run-1")
+	ws, err := workspace.Create(context.Background(), "run-1", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.MkdirAll(filepath.Join(ws.Dir, "out"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(ws.Dir, "out", "hello.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	model := fake.NewChatModel(
+		fake.Response{Match: []string{"Let's start working on the problem"}, Content: `{"resources":{},"type":"complete","thought":"nothing to do"}`},
+		fake.Response{Match: []string{"critically evaluate and analyze"}, Content: `{"type":"critique","status":"good","reason":"ok"}`},
+	)
+	f, err := fsm.New("do nothing", 0, func(o *fsm.Options) {
+		o.ChatModel = model
+		o.Tools = []schema.Tool{fake.NewTool("Terminal")}
+		o.Observers = []fsm.Observer{Observer("run-1", dir, ws)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-f.Stream():
+			case <-done:
+				return
+			}
+		}
+	}()
+	if err = f.Process(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, JSONFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r Report
+	if err = json.Unmarshal(b, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Run != "run-1" || r.Status != StatusCompleted || r.Result.Answer != "nothing to do" || len(r.Steps) != 1 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if len(r.Artifacts) != 1 || r.Artifacts[0].Path != "out/hello.txt" || r.Artifacts[0].Size != 5 ||
+		r.Artifacts[0].Status != workspace.StatusCreated {
+		t.Errorf("unexpected artifacts %+v", r.Artifacts)
+	}
+	if md, err := os.ReadFile(filepath.Join(dir, MarkdownFile)); err != nil || !strings.Contains(string(md), "nothing to do") {
+		t.Errorf("unexpected markdown report %q: %v", md, err)
+	}
+}
@@ -0,0 +1,153 @@
+// Package secret keeps credentials out of prompts. The thinker and the agent refer to them with {{secret:NAME}}
+// placeholders, which are only substituted when a command runs.
+package secret
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const DefaultEnvPrefix = "FLOWGPT_SECRET_"
+
+var placeholder = regexp.MustCompile(`\{\{\s*secret:([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// Placeholder returns the placeholder of the secret name.
+func Placeholder(name string) string {
+	return "{{secret:" + name + "}}"
+}
+
+type Options struct {
+	// EnvPrefix selects the environment variables holding secrets, FLOWGPT_SECRET_TOKEN is the secret TOKEN.
+	EnvPrefix string
+	// File is an optional env file of NAME=VALUE lines, its secrets override those of the environment.
+	File string
+}
+
+// Vault holds the secrets by name. It is read-only after loading and safe for concurrent use.
+type Vault struct {
+	values map[string]string
+}
+
+// New creates a vault of the given secrets.
+func New(values map[string]string) *Vault {
+	v := &Vault{values: map[string]string{}}
+	for name, value := range values {
+		v.values[name] = value
+	}
+	return v
+}
+
+// Load reads the secrets from the environment and the optional file.
+func Load(optFns ...func(o *Options)) (*Vault, error) {
+	opts := Options{
+		EnvPrefix: DefaultEnvPrefix,
+	}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+
+	values := map[string]string{}
+	if opts.EnvPrefix != "" {
+		for _, kv := range os.Environ() {
+			name, value, _ := strings.Cut(kv, "=")
+			if strings.HasPrefix(name, opts.EnvPrefix) && len(name) > len(opts.EnvPrefix) {
+				values[strings.TrimPrefix(name, opts.EnvPrefix)] = value
+			}
+		}
+	}
+	if opts.File != "" {
+		err := readFile(opts.File, values)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secrets file: %w", err)
+		}
+	}
+	return New(values), nil
+}
+
+func readFile(path string, values map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return fmt.Errorf("line %d: expected NAME=VALUE", n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[strings.TrimSpace(name)] = value
+	}
+	return scanner.Err()
+}
+
+// Names returns the sorted names of the secrets, a nil vault has none.
+func (v *Vault) Names() []string {
+	if v == nil {
+		return nil
+	}
+	names := make([]string, 0, len(v.values))
+	for name := range v.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Values returns the values of the secrets, to redact them wherever they might still appear.
+func (v *Vault) Values() []string {
+	var values []string
+	for _, name := range v.Names() {
+		values = append(values, v.values[name])
+	}
+	return values
+}
+
+// Substitute replaces the placeholders of s with the values of the secrets. It fails on placeholders of unknown
+// secrets, so a command never runs with a placeholder left in it.
+func (v *Vault) Substitute(s string) (string, error) {
+	var missing []string
+	out := placeholder.ReplaceAllStringFunc(s, func(m string) string {
+		name := placeholder.FindStringSubmatch(m)[1]
+		value, ok := "", false
+		if v != nil {
+			value, ok = v.values[name]
+		}
+		if !ok {
+			missing = append(missing, name)
+			return m
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unknown secrets: %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+// Mask replaces the values of the secrets in s with their placeholders, longest values first.
+func (v *Vault) Mask(s string) string {
+	names := v.Names()
+	sort.SliceStable(names, func(i, j int) bool {
+		return len(v.values[names[i]]) > len(v.values[names[j]])
+	})
+	for _, name := range names {
+		if value := v.values[name]; value != "" {
+			s = strings.ReplaceAll(s, value, Placeholder(name))
+		}
+	}
+	return s
+}
@@ -0,0 +1,62 @@
+package secret
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	t.Setenv("TEST_SECRET_TOKEN", "from-env")
+	t.Setenv("TEST_SECRET_USER", "ci")
+	path := filepath.Join(t.TempDir(), "secrets.env")
+	err := os.WriteFile(path, []byte("# registry\nexport TOKEN=\"from-file\"\nPASSWORD='p4ss word'\n\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := Load(func(o *Options) {
+		o.EnvPrefix = "TEST_SECRET_"
+		o.File = path
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := v.Names(); !reflect.DeepEqual(names, []string{"PASSWORD", "TOKEN", "USER"}) {
+		t.Errorf("names = %v", names)
+	}
+	if got, _ := v.Substitute("{{secret:TOKEN}} {{secret:PASSWORD}}"); got != "from-file p4ss word" {
+		t.Errorf("file secrets not loaded: %q", got)
+	}
+
+	if err = os.WriteFile(path, []byte("TOKEN\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Load(func(o *Options) { o.File = path }); err == nil {
+		t.Error("expected an error for a malformed line")
+	}
+}
+
+func TestSubstituteAndMask(t *testing.T) {
+	v := New(map[string]string{"TOKEN": "s3cr3t-token", "TOKEN_SUFFIX": "s3cr3t-token-2"})
+	cmd, err := v.Substitute("docker login -p {{secret:TOKEN}} && echo {{ secret:TOKEN_SUFFIX }}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd != "docker login -p s3cr3t-token && echo s3cr3t-token-2" {
+		t.Errorf("Substitute() = %q", cmd)
+	}
+	if got := v.Mask("token s3cr3t-token-2 and s3cr3t-token"); got != "token {{secret:TOKEN_SUFFIX}} and {{secret:TOKEN}}" {
+		t.Errorf("Mask() = %q", got)
+	}
+	if _, err = v.Substitute("{{secret:MISSING}}"); err == nil {
+		t.Error("expected an error for an unknown secret")
+	}
+	var empty *Vault
+	if _, err = empty.Substitute("{{secret:TOKEN}}"); err == nil {
+		t.Error("expected an error for a secret of a nil vault")
+	}
+	if got := empty.Mask("nothing"); got != "nothing" {
+		t.Errorf("nil vault Mask() = %q", got)
+	}
+}
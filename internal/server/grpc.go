@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	flowgptv1 "flow-gpt/api/flowgpt/v1"
+	customAgent "flow-gpt/internal/agent"
+	"flow-gpt/internal/auth"
+	"flow-gpt/internal/fsm"
+	zLog "github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// readMethods are the gRPC methods a read token may call, the others need a control token.
+var readMethods = map[string]bool{
+	flowgptv1.RunService_GetRun_FullMethodName:   true,
+	flowgptv1.RunService_WatchRun_FullMethodName: true,
+}
+
+type GRPCOptions struct {
+	// Authenticator checks the token of each call, every call is allowed without it.
+	Authenticator *auth.Authenticator
+	// ServerOptions are passed to grpc.NewServer, e.g. its TLS credentials.
+	ServerOptions []grpc.ServerOption
+}
+
+// GRPC serves the runs of a manager over the RunService of api/flowgpt/v1, the way Server serves them over HTTP.
+type GRPC struct {
+	flowgptv1.UnimplementedRunServiceServer
+	manager *Manager
+}
+
+// NewGRPC creates a gRPC server with the RunService of the manager registered.
+func NewGRPC(manager *Manager, optFns ...func(o *GRPCOptions)) *grpc.Server {
+	opts := GRPCOptions{}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	serverOpts := opts.ServerOptions
+	if a := opts.Authenticator; a != nil && a.Enabled() {
+		serverOpts = append(serverOpts,
+			grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+				if err := authorize(ctx, a, info.FullMethod); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+			grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := authorize(ss.Context(), a, info.FullMethod); err != nil {
+					return err
+				}
+				return handler(srv, ss)
+			}),
+		)
+	}
+	s := grpc.NewServer(serverOpts...)
+	flowgptv1.RegisterRunServiceServer(s, &GRPC{manager: manager})
+	return s
+}
+
+// authorize checks the bearer token of the authorization metadata of a call.
+func authorize(ctx context.Context, a *auth.Authenticator, method string) error {
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			token = auth.BearerToken(values[0])
+		}
+	}
+	id, err := a.Authenticate(token)
+	if err != nil {
+		zLog.Warn().Err(err).Str("method", method).Msg("unauthenticated call")
+		return status.Error(codes.Unauthenticated, "unauthenticated")
+	}
+	need := auth.PermissionControl
+	if readMethods[method] {
+		need = auth.PermissionRead
+	}
+	if !id.Permission.Allows(need) {
+		zLog.Warn().Str("subject", id.Subject).Str("method", method).Msgf("call needs the %s permission", need)
+		return status.Errorf(codes.PermissionDenied, "the %s permission is needed", need)
+	}
+	return nil
+}
+
+func (g *GRPC) CreateRun(_ context.Context, req *flowgptv1.CreateRunRequest) (*flowgptv1.Run, error) {
+	if strings.TrimSpace(req.GetProblem()) == "" {
+		return nil, status.Error(codes.InvalidArgument, "a problem is needed")
+	}
+	run, err := g.manager.Start(req.GetProblem())
+	if err != nil {
+		zLog.Error().Err(err).Msg("failed to start run")
+		return nil, status.Error(codes.Internal, "failed to start run")
+	}
+	return runProto(run.Info()), nil
+}
+
+func (g *GRPC) GetRun(_ context.Context, req *flowgptv1.GetRunRequest) (*flowgptv1.Run, error) {
+	run, err := g.manager.Get(req.GetRunId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return runProto(run.Info()), nil
+}
+
+// CancelRun cancels a run and returns it once it finished, so its status is final. The wait is bounded by the context
+// of the request.
+func (g *GRPC) CancelRun(ctx context.Context, req *flowgptv1.CancelRunRequest) (*flowgptv1.Run, error) {
+	run, err := g.manager.Get(req.GetRunId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if err = g.manager.Cancel(run.ID); err != nil {
+		return nil, grpcError(err)
+	}
+	select {
+	case <-run.Done():
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	return runProto(run.Info()), nil
+}
+
+func (g *GRPC) ApproveAction(_ context.Context, req *flowgptv1.ApproveActionRequest) (*flowgptv1.ApproveActionResponse, error) {
+	control := ControlApprove
+	if req.GetReject() {
+		control = ControlReject
+	}
+	if err := g.manager.Control(req.GetRunId(), control, req.GetReason()); err != nil {
+		return nil, grpcError(err)
+	}
+	return &flowgptv1.ApproveActionResponse{}, nil
+}
+
+func (g *GRPC) InjectHint(_ context.Context, req *flowgptv1.InjectHintRequest) (*flowgptv1.InjectHintResponse, error) {
+	if err := g.manager.Control(req.GetRunId(), ControlHint, req.GetHint()); err != nil {
+		return nil, grpcError(err)
+	}
+	return &flowgptv1.InjectHintResponse{}, nil
+}
+
+// WatchRun streams the entries of a run from its hub, like /ws. A watcher which falls behind the run gets Unavailable
+// and resumes after the id of its last event.
+func (g *GRPC) WatchRun(req *flowgptv1.WatchRunRequest, stream flowgptv1.RunService_WatchRunServer) error {
+	var run *Run
+	var err error
+	if req.GetRunId() != "" {
+		run, err = g.manager.Get(req.GetRunId())
+	} else {
+		run, err = g.manager.Latest()
+	}
+	if err != nil {
+		return grpcError(err)
+	}
+	history, live, cancel := run.Hub.Subscribe(int(req.GetAfterId()))
+	defer cancel()
+	for _, e := range history {
+		if err = stream.Send(entryProto(e)); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case e, ok := <-live:
+			if !ok {
+				select {
+				case <-run.Done():
+					return nil
+				default:
+					return status.Error(codes.Unavailable, "fell behind the run, resume after the last event")
+				}
+			}
+			if err = stream.Send(entryProto(e)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrNotRunning), errors.Is(err, fsm.ErrNoApproval):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, ErrInvalidControl):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func runProto(info Info) *flowgptv1.Run {
+	return &flowgptv1.Run{
+		Id:        info.ID,
+		Problem:   info.Problem,
+		Status:    info.Status,
+		Error:     info.Error,
+		Paused:    info.Paused,
+		Events:    int32(info.Events),
+		StartedAt: timestamppb.New(info.StartedAt),
+	}
+}
+
+func entryProto(entry Entry) *flowgptv1.RunEvent {
+	e := entry.Event
+	event := &flowgptv1.Event{
+		Type:    string(e.Type),
+		Turn:    int32(e.Turn),
+		State:   e.State,
+		From:    e.From,
+		Content: e.Content,
+		Role:    e.Role,
+		Model:   e.Model,
+		Subject: e.Subject,
+		Tokens:  int32(e.Tokens),
+		Error:   e.Error,
+		Time:    timestamppb.New(e.Time),
+		Reason:  string(e.Reason),
+	}
+	if e.Duration != 0 {
+		event.Duration = durationpb.New(e.Duration)
+	}
+	for _, m := range e.Prompt {
+		event.Prompt = append(event.Prompt, &flowgptv1.ChatMessage{Role: m.Role, Content: m.Content})
+	}
+	for _, r := range e.Audit {
+		event.Audit = append(event.Audit, recordProto(r))
+	}
+	return &flowgptv1.RunEvent{Id: int64(entry.ID), Event: event}
+}
+
+func recordProto(r customAgent.Record) *flowgptv1.AuditRecord {
+	record := &flowgptv1.AuditRecord{
+		Seq:      int32(r.Seq),
+		Kind:     string(r.Kind),
+		Time:     timestamppb.New(r.Time),
+		SpanId:   r.SpanID,
+		ParentId: r.ParentID,
+		RunId:    r.RunID,
+		Tool:     r.Tool,
+		Model:    r.Model,
+		Input:    r.Input,
+		Output:   r.Output,
+		Error:    r.Error,
+		Log:      r.Log,
+	}
+	if r.Tokens != nil {
+		record.Tokens = &flowgptv1.TokenUsage{
+			Prompt:     int32(r.Tokens.Prompt),
+			Completion: int32(r.Tokens.Completion),
+			Total:      int32(r.Tokens.Total),
+		}
+	}
+	if r.Duration != 0 {
+		record.Duration = durationpb.New(r.Duration)
+	}
+	return record
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	flowgptv1 "flow-gpt/api/flowgpt/v1"
+	"flow-gpt/internal/auth"
+	"flow-gpt/internal/fake"
+	"flow-gpt/internal/fsm"
+	"github.com/hupe1980/golc/schema"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialGRPC serves the RunService of the manager in process and returns a client of it.
+func dialGRPC(t *testing.T, manager *Manager, optFns ...func(o *GRPCOptions)) flowgptv1.RunServiceClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := NewGRPC(manager, optFns...)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return flowgptv1.NewRunServiceClient(conn)
+}
+
+func TestGRPC(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	manager := newTestManager(ctx)
+	client := dialGRPC(t, manager)
+
+	if _, err := client.CreateRun(ctx, &flowgptv1.CreateRunRequest{Problem: " "}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected an empty problem to be invalid, got %v", err)
+	}
+	run, err := client.CreateRun(ctx, &flowgptv1.CreateRunRequest{Problem: "do nothing"})
+	if err != nil || run.GetId() != "run-1" || run.GetStatus() != StatusRunning {
+		t.Fatalf("unexpected run %v: %v", run, err)
+	}
+
+	stream, err := client.WatchRun(ctx, &flowgptv1.WatchRunRequest{RunId: run.GetId()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []*flowgptv1.RunEvent
+	for {
+		e, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	if len(events) == 0 || events[0].GetId() != 1 || events[0].GetEvent().GetContent() != "do nothing" ||
+		events[len(events)-1].GetEvent().GetType() != "finish" || events[len(events)-1].GetEvent().GetReason() != "completed" {
+		t.Fatalf("expected the events from start to finish, got %v", events)
+	}
+
+	manager.Wait()
+	run, err = client.GetRun(ctx, &flowgptv1.GetRunRequest{RunId: "run-1"})
+	if err != nil || run.GetStatus() != StatusCompleted || int(run.GetEvents()) != len(events) {
+		t.Fatalf("unexpected run %v: %v", run, err)
+	}
+	stream, err = client.WatchRun(ctx, &flowgptv1.WatchRunRequest{AfterId: int64(len(events) - 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := stream.Recv(); err != nil || e.GetId() != int64(len(events)) {
+		t.Fatalf("expected to resume at the last event, got %v: %v", e, err)
+	}
+
+	if _, err = client.InjectHint(ctx, &flowgptv1.InjectHintRequest{RunId: "run-1", Hint: "hurry"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected a finished run not to take hints, got %v", err)
+	}
+	if _, err = client.CancelRun(ctx, &flowgptv1.CancelRunRequest{RunId: "run-1"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected a finished run not to be cancellable, got %v", err)
+	}
+	if _, err = client.ApproveAction(ctx, &flowgptv1.ApproveActionRequest{RunId: "unknown"}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected an unknown run not to be found, got %v", err)
+	}
+}
+
+func TestGRPCCancel(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// the run waits for the approval of its action until it is cancelled
+	manager := NewManager(ctx, func(problem string, observer fsm.Observer) (string, *fsm.FSM, error) {
+		model := fake.NewChatModel(
+			fake.Response{Match: []string{"Let's start working on the problem"}, Content: `{"resources":{},"type":"agent","thought":"list the files","output":"Run ls."}`},
+			fake.Response{Match: []string{"critically evaluate and analyze"}, Content: `{"type":"critique","status":"good","reason":"ok"}`},
+		)
+		f, err := fsm.New(problem, 0, func(o *fsm.Options) {
+			o.ChatModel = model
+			o.Tools = []schema.Tool{fake.NewTool("Terminal")}
+			o.Observers = []fsm.Observer{observer}
+			o.RequireApproval = true
+		})
+		return "run-1", f, err
+	})
+	client := dialGRPC(t, manager)
+	if _, err := client.CreateRun(ctx, &flowgptv1.CreateRunRequest{Problem: "list the files"}); err != nil {
+		t.Fatal(err)
+	}
+	run, err := client.CancelRun(ctx, &flowgptv1.CancelRunRequest{RunId: "run-1"})
+	if err != nil || run.GetStatus() != StatusCancelled {
+		t.Fatalf("expected the cancelled run once finished, got %v: %v", run, err)
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a, err := auth.New(func(o *auth.Options) {
+		o.Tokens = map[string]auth.Permission{"viewer": auth.PermissionRead, "operator": auth.PermissionControl}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := newTestManager(ctx)
+	client := dialGRPC(t, manager, func(o *GRPCOptions) {
+		o.Authenticator = a
+	})
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+
+	req := &flowgptv1.CreateRunRequest{Problem: "do nothing"}
+	if _, err = client.CreateRun(ctx, req); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected a call without token to be unauthenticated, got %v", err)
+	}
+	if _, err = client.CreateRun(withToken("viewer"), req); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected a read token not to create runs, got %v", err)
+	}
+	if _, err = client.CreateRun(withToken("operator"), req); err != nil {
+		t.Errorf("expected a control token to create runs, got %v", err)
+	}
+	stream, err := client.WatchRun(withToken("viewer"), &flowgptv1.WatchRunRequest{RunId: "run-1"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if err != nil {
+		t.Errorf("expected a read token to watch runs, got %v", err)
+	}
+	manager.Wait()
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"flow-gpt/internal/fsm"
+	"github.com/gorilla/websocket"
+	zLog "github.com/rs/zerolog/log"
+)
+
+const (
+	// FormatMessages streams the content of the messages of a run as text frames, as the web UI expects.
+	FormatMessages = "messages"
+	// FormatEvents streams every event of a run as a JSON entry with its id.
+	FormatEvents = "events"
+)
+
+// Server serves the runs of a manager:
+//
+//	POST /api/runs              starts a run of {"problem": "..."}
+//	GET  /api/runs              lists the runs
+//	GET  /api/runs/{id}         describes a run
+//	GET  /api/runs/{id}/graph   describes the state graph of a run
+//	POST /api/runs/{id}/cancel  cancels a run
+//	POST /api/runs/{id}/pause   pauses a run before its next state
+//	POST /api/runs/{id}/resume  resumes a paused run
+//	POST /api/runs/{id}/hint    gives the thinker a hint of {"hint": "..."}
+//	POST /api/runs/{id}/approve approves the action awaiting approval
+//	POST /api/runs/{id}/reject  rejects the action awaiting approval for {"reason": "..."}
+//	GET  /ws?run=id&format=f&after=n
+//	                            streams a run, the latest one if no id is given, from the event after id n
+//	GET  /api/events?run=id&after=n
+//	                            streams the events of a run as server-sent events, resuming after Last-Event-ID
+type Server struct {
+	manager  *Manager
+	upgrader websocket.Upgrader
+}
+
+type Options struct {
+	// CheckOrigin reports whether a websocket may be opened from the origin of the request, by default only the
+	// origin of the server may.
+	CheckOrigin func(r *http.Request) bool
+}
+
+func New(manager *Manager, optFns ...func(o *Options)) *Server {
+	opts := Options{}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	return &Server{manager: manager, upgrader: websocket.Upgrader{CheckOrigin: opts.CheckOrigin}}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/runs", s.handleRuns)
+	mux.HandleFunc("/api/runs/", s.handleRun)
+	mux.HandleFunc("/api/events", s.handleEvents)
+	mux.HandleFunc("/ws", s.handleWebsocket)
+	return mux
+}
+
+func (s *Server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.manager.List())
+	case http.MethodPost:
+		var req struct {
+			Problem string `json:"problem"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Problem) == "" {
+			http.Error(w, "expected a JSON body with a problem", http.StatusBadRequest)
+			return
+		}
+		run, err := s.manager.Start(req.Problem)
+		if err != nil {
+			zLog.Error().Err(err).Msg("failed to start run")
+			http.Error(w, "failed to start run", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, run.Info())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/runs/"), "/")
+	run, err := s.manager.Get(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if action == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, run.Info())
+		return
+	}
+	if action == "graph" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, run.FSM.Graph().Describe())
+		return
+	}
+	if !controls[action] {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Hint   string `json:"hint"`
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	}
+	text := req.Hint
+	if action == ControlReject {
+		text = req.Reason
+	}
+	err = s.manager.Control(id, action, text)
+	switch {
+	case errors.Is(err, ErrNotRunning), errors.Is(err, fsm.ErrNoApproval):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrInvalidControl):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// streamedRun returns the run named by the run parameter of a stream request, the latest one if there is none.
+func (s *Server) streamedRun(r *http.Request) (*Run, error) {
+	if id := r.URL.Query().Get("run"); id != "" {
+		return s.manager.Get(id)
+	}
+	return s.manager.Latest()
+}
+
+func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
+	run, err := s.streamedRun(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = FormatMessages
+	}
+	if format != FormatMessages && format != FormatEvents {
+		http.Error(w, "unknown format", http.StatusBadRequest)
+		return
+	}
+	after, _ := strconv.Atoi(r.URL.Query().Get("after"))
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		zLog.Error().Err(err).Msg("failed to upgrade connection")
+		return
+	}
+	defer conn.Close()
+
+	history, live, cancel := run.Hub.Subscribe(after)
+	defer cancel()
+	send := func(e Entry) error {
+		if format == FormatEvents {
+			return conn.WriteJSON(e)
+		}
+		if e.Event.Type != fsm.EventMessage {
+			return nil
+		}
+		return conn.WriteMessage(websocket.TextMessage, []byte(e.Event.Content))
+	}
+	for _, e := range history {
+		if err = send(e); err != nil {
+			return
+		}
+	}
+	for e := range live {
+		if err = send(e); err != nil {
+			return
+		}
+	}
+	code, reason := websocket.CloseNormalClosure, "run finished"
+	select {
+	case <-run.Done():
+	default:
+		code, reason = websocket.CloseTryAgainLater, "fell behind the run, resume after the last event"
+	}
+	_ = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zLog.Error().Err(err).Msg("failed to write response")
+	}
+}
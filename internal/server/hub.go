@@ -0,0 +1,107 @@
+package server
+
+import (
+	"sync"
+
+	"flow-gpt/internal/fsm"
+)
+
+// SubscriberBuffer is the number of entries a subscriber may fall behind before it is dropped.
+const SubscriberBuffer = 256
+
+// Entry is an event of a run with its id, ids start at 1 and increase by one.
+type Entry struct {
+	ID    int       `json:"id"`
+	Event fsm.Event `json:"event"`
+}
+
+// Hub keeps the events of a run and fans them out to subscribers, late subscribers get the history first. It is safe
+// for concurrent use.
+type Hub struct {
+	mu      sync.Mutex
+	entries []Entry
+	subs    map[chan Entry]struct{}
+	closed  bool
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subs: map[chan Entry]struct{}{},
+	}
+}
+
+// Publish adds an event, it is an fsm.Observer.
+func (h *Hub) Publish(event fsm.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	e := Entry{ID: len(h.entries) + 1, Event: event}
+	h.entries = append(h.entries, e)
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			// the subscriber can't keep up, it notices the closed channel and may resubscribe from its last id
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the entries after the id and a channel of the following ones. The channel is closed when the hub
+// is closed or the subscriber falls behind, cancel releases it.
+func (h *Hub) Subscribe(after int) ([]Entry, <-chan Entry, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if after < 0 {
+		after = 0
+	}
+	var history []Entry
+	if after < len(h.entries) {
+		history = append(history, h.entries[after:]...)
+	}
+	ch := make(chan Entry, SubscriberBuffer)
+	if h.closed {
+		close(ch)
+		return history, ch, func() {}
+	}
+	h.subs[ch] = struct{}{}
+	return history, ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Entries returns all entries so far.
+func (h *Hub) Entries() []Entry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Entry(nil), h.entries...)
+}
+
+// Len returns the number of entries published.
+func (h *Hub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.entries)
+}
+
+// Close ends the subscriptions, the history stays available.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for ch := range h.subs {
+		close(ch)
+	}
+	h.subs = map[chan Entry]struct{}{}
+}
@@ -0,0 +1,265 @@
+// Package server runs many problems at once and streams their events over HTTP.
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"flow-gpt/internal/fsm"
+	zLog "github.com/rs/zerolog/log"
+)
+
+const (
+	StatusRunning   = "running"
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// Controls of the operator over a running run.
+const (
+	ControlCancel  = "cancel"
+	ControlPause   = "pause"
+	ControlResume  = "resume"
+	ControlHint    = "hint"
+	ControlApprove = "approve"
+	ControlReject  = "reject"
+)
+
+var controls = map[string]bool{
+	ControlCancel:  true,
+	ControlPause:   true,
+	ControlResume:  true,
+	ControlHint:    true,
+	ControlApprove: true,
+	ControlReject:  true,
+}
+
+var (
+	ErrNotFound       = errors.New("server: run not found")
+	ErrNotRunning     = errors.New("server: run is not running")
+	ErrInvalidControl = errors.New("server: invalid control")
+)
+
+// Factory creates the FSM of a new run which reports to the observer, and returns the id of the run.
+type Factory func(problem string, observer fsm.Observer) (string, *fsm.FSM, error)
+
+// Run is a run of the manager.
+type Run struct {
+	ID        string
+	Problem   string
+	StartedAt time.Time
+	Hub       *Hub
+	FSM       *fsm.FSM
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	mu     sync.Mutex
+	status string
+	err    error
+}
+
+// Info describes a run.
+type Info struct {
+	ID        string    `json:"id"`
+	Problem   string    `json:"problem"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Paused    bool      `json:"paused"`
+	Events    int       `json:"events"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+func (r *Run) Info() Info {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := Info{
+		ID:        r.ID,
+		Problem:   r.Problem,
+		Status:    r.status,
+		Paused:    r.FSM.Paused(),
+		Events:    r.Hub.Len(),
+		StartedAt: r.StartedAt,
+	}
+	if r.err != nil {
+		info.Error = r.err.Error()
+	}
+	return info
+}
+
+// Done is closed once the run has finished.
+func (r *Run) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns the error of a finished run.
+func (r *Run) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Manager starts runs and keeps them, with their events, for its lifetime. It is safe for concurrent use.
+type Manager struct {
+	ctx     context.Context
+	factory Factory
+	mu      sync.Mutex
+	runs    map[string]*Run
+	wg      sync.WaitGroup
+}
+
+// NewManager creates a manager whose runs are cancelled when ctx is done.
+func NewManager(ctx context.Context, factory Factory) *Manager {
+	return &Manager{
+		ctx:     ctx,
+		factory: factory,
+		runs:    map[string]*Run{},
+	}
+}
+
+// Start creates a run of the problem and processes it in the background.
+func (m *Manager) Start(problem string) (*Run, error) {
+	hub := NewHub()
+	id, f, err := m.factory(problem, hub.Publish)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create run: %w", err)
+	}
+	ctx, cancel := context.WithCancel(m.ctx)
+	run := &Run{
+		ID:        id,
+		Problem:   problem,
+		StartedAt: time.Now(),
+		Hub:       hub,
+		FSM:       f,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		status:    StatusRunning,
+	}
+	m.mu.Lock()
+	m.runs[id] = run
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		// messages are published as events, the stream only has to be drained
+		go func() {
+			for {
+				select {
+				case <-f.Stream():
+				case <-run.done:
+					return
+				}
+			}
+		}()
+		err := f.Process(ctx)
+		if cErr := f.Close(); cErr != nil {
+			zLog.Error().Err(cErr).Str("run", id).Msg("failed to close browser")
+		}
+		run.mu.Lock()
+		run.err = err
+		switch {
+		case err == nil:
+			run.status = StatusCompleted
+		case errors.Is(err, context.Canceled):
+			run.status = StatusCancelled
+		default:
+			run.status = StatusFailed
+			zLog.Error().Err(err).Str("run", id).Msg("failed to process problem")
+		}
+		run.mu.Unlock()
+		cancel()
+		// subscribers ending with the hub can tell the run has finished
+		close(run.done)
+		hub.Close()
+	}()
+	return run, nil
+}
+
+// Get returns a run by id.
+func (m *Manager) Get(id string) (*Run, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	run, ok := m.runs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return run, nil
+}
+
+// Latest returns the most recently started run.
+func (m *Manager) Latest() (*Run, error) {
+	runs := m.List()
+	if len(runs) == 0 {
+		return nil, ErrNotFound
+	}
+	return m.Get(runs[0].ID)
+}
+
+// List describes the runs, most recent first.
+func (m *Manager) List() []Info {
+	m.mu.Lock()
+	runs := make([]*Run, 0, len(m.runs))
+	for _, r := range m.runs {
+		runs = append(runs, r)
+	}
+	m.mu.Unlock()
+
+	infos := make([]Info, len(runs))
+	for i, r := range runs {
+		infos[i] = r.Info()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.After(infos[j].StartedAt)
+	})
+	return infos
+}
+
+// Cancel stops a running run.
+func (m *Manager) Cancel(id string) error {
+	return m.Control(id, ControlCancel, "")
+}
+
+// Control applies a control of the operator to a running run. text is the hint of ControlHint and the reason of
+// ControlReject.
+func (m *Manager) Control(id, control, text string) error {
+	run, err := m.Get(id)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-run.done:
+		return ErrNotRunning
+	default:
+	}
+	switch control {
+	case ControlCancel:
+		run.cancel()
+	case ControlPause:
+		run.FSM.Pause()
+	case ControlResume:
+		run.FSM.Resume()
+	case ControlHint:
+		if strings.TrimSpace(text) == "" {
+			return fmt.Errorf("%w: empty hint", ErrInvalidControl)
+		}
+		run.FSM.Hint(text)
+	case ControlApprove:
+		return run.FSM.Approve()
+	case ControlReject:
+		return run.FSM.Reject(text)
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidControl, control)
+	}
+	return nil
+}
+
+// Wait blocks until every run has finished.
+func (m *Manager) Wait() {
+	m.wg.Wait()
+}
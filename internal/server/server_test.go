@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"flow-gpt/internal/fake"
+	"flow-gpt/internal/fsm"
+	"github.com/gorilla/websocket"
+	"github.com/hupe1980/golc/schema"
+	"github.com/rs/zerolog"
+)
+
+func TestHub(t *testing.T) {
+	h := NewHub()
+	for _, c := range []string{"a", "b", "c"} {
+		h.Publish(fsm.Event{Type: fsm.EventMessage, Content: c})
+	}
+	history, live, cancel := h.Subscribe(1)
+	defer cancel()
+	if len(history) != 2 || history[0].ID != 2 || history[1].Event.Content != "c" {
+		t.Fatalf("unexpected history %+v", history)
+	}
+	h.Publish(fsm.Event{Type: fsm.EventMessage, Content: "d"})
+	if e := <-live; e.ID != 4 || e.Event.Content != "d" {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	h.Close()
+	if _, ok := <-live; ok {
+		t.Fatal("expected the subscription to end with the hub")
+	}
+	if history, _, _ = h.Subscribe(0); len(history) != 4 || h.Len() != 4 {
+		t.Fatalf("expected the history to outlive the hub, got %d entries", len(history))
+	}
+}
+
+// newTestManager creates a manager whose runs, named run-1, run-2..., complete on their first turn.
+func newTestManager(ctx context.Context) *Manager {
+	var n int
+	return NewManager(ctx, func(problem string, observer fsm.Observer) (string, *fsm.FSM, error) {
+		model := fake.NewChatModel(
+			fake.Response{Match: []string{"Let's start working on the problem"}, Content: `{"resources":{},"type":"complete","thought":"nothing to do"}`},
+			fake.Response{Match: []string{"critically evaluate and analyze"}, Content: `{"type":"critique","status":"good","reason":"ok"}`},
+		)
+		f, err := fsm.New(problem, 0, func(o *fsm.Options) {
+			o.ChatModel = model
+			o.Tools = []schema.Tool{fake.NewTool("Terminal")}
+			o.Observers = []fsm.Observer{observer}
+		})
+		n++
+		return "run-" + strconv.Itoa(n), f, err
+	})
+}
+
+func TestServer(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	manager := newTestManager(ctx)
+	srv := httptest.NewServer(New(manager).Handler())
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL+"/api/runs", "application/json", strings.NewReader(`{"problem":"do nothing"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info Info
+	err = json.NewDecoder(res.Body).Decode(&info)
+	res.Body.Close()
+	if err != nil || res.StatusCode != http.StatusCreated || info.ID != "run-1" {
+		t.Fatalf("unexpected response %d %+v: %v", res.StatusCode, info, err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?run=run-1&format=events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var entries []Entry
+	for {
+		var e Entry
+		if err = conn.ReadJSON(&e); err != nil {
+			break
+		}
+		entries = append(entries, e)
+	}
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected the stream to end with the run: %v", err)
+	}
+	if len(entries) == 0 || entries[0].Event.Type != fsm.EventStart || entries[len(entries)-1].Event.Type != fsm.EventFinish {
+		t.Fatalf("expected the events from start to finish, got %+v", entries)
+	}
+
+	manager.Wait()
+	res, err = http.Get(srv.URL + "/api/runs/run-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.NewDecoder(res.Body).Decode(&info)
+	res.Body.Close()
+	if err != nil || info.Status != StatusCompleted || info.Events != len(entries) {
+		t.Fatalf("unexpected run %+v: %v", info, err)
+	}
+	events := readEvents(t, srv.URL+"/api/events?run=run-1", "")
+	if len(events) != len(entries)+1 || events[len(events)-1] != EventEnd {
+		t.Fatalf("expected every entry and the end of the run as server-sent events, got %v", events)
+	}
+	if events[0] != "run-1:1" {
+		t.Fatalf("expected event ids with the run, got %v", events)
+	}
+	// EventSource reconnects to the same URL, which streams the latest run without the run parameter
+	for _, url := range []string{srv.URL + "/api/events?run=run-1", srv.URL + "/api/events"} {
+		events = readEvents(t, url, "run-1:2")
+		if len(events) != len(entries)-1 || events[0] != "run-1:3" {
+			t.Fatalf("expected the events of %s after Last-Event-ID run-1:2, got %v", url, events)
+		}
+	}
+	events = readEvents(t, srv.URL+"/api/events?run=run-1", "2")
+	if len(events) != len(entries)-1 || events[0] != "run-1:3" {
+		t.Fatalf("expected the events after Last-Event-ID 2, got %v", events)
+	}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/events", nil)
+	req.Header.Set("Last-Event-ID", "run-2:2")
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected Last-Event-ID of an unknown run not to be found, got %d", res.StatusCode)
+	}
+
+	res, err = http.Get(srv.URL + "/api/runs/run-1/graph")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var graph fsm.GraphInfo
+	err = json.NewDecoder(res.Body).Decode(&graph)
+	res.Body.Close()
+	if err != nil || graph.Initial != "Init" || len(graph.States) != len(fsm.DefaultGraph().Describe().States) {
+		t.Fatalf("unexpected graph %+v: %v", graph, err)
+	}
+	res, err = http.Post(srv.URL+"/api/runs/run-1/cancel", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("expected a finished run not to be cancellable, got %d", res.StatusCode)
+	}
+}
+
+// readEvents reads a stream of server-sent events until it ends, returning the id of each event or its type if it has
+// no id.
+func readEvents(t *testing.T, url, lastEventID string) []string {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	var events []string
+	var id, typ string
+	var data bool
+	sc := bufio.NewScanner(res.Body)
+	for sc.Scan() {
+		field, value, _ := strings.Cut(sc.Text(), ": ")
+		switch field {
+		case "id":
+			id = value
+		case "event":
+			typ = value
+		case "data":
+			var e sseEntry
+			if typ == "" && (json.Unmarshal([]byte(value), &e) != nil || e.Run+":"+strconv.Itoa(e.ID) != id) {
+				t.Fatalf("event %s has unexpected data %s", id, value)
+			}
+			data = true
+		case "":
+			if data {
+				if id == "" {
+					id = typ
+				}
+				events = append(events, id)
+			}
+			id, typ, data = "", "", false
+		}
+	}
+	return events
+}
+
+func TestParseEventID(t *testing.T) {
+	for _, tt := range []struct {
+		id    string
+		run   string
+		after int
+		err   bool
+	}{
+		{id: "run-1:3", run: "run-1", after: 3},
+		{id: "a:b:12", run: "a:b", after: 12},
+		{id: "7", after: 7},
+		{id: "run-1:", err: true},
+		{id: "run-1", err: true},
+	} {
+		run, after, err := parseEventID(tt.id)
+		if (err != nil) != tt.err || !tt.err && (run != tt.run || after != tt.after) {
+			t.Errorf("parseEventID(%q) = %q, %d, %v", tt.id, run, after, err)
+		}
+	}
+}
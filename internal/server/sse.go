@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	zLog "github.com/rs/zerolog/log"
+)
+
+const (
+	// KeepAliveInterval is the time after which an idle event stream gets a comment, so proxies keep it open.
+	KeepAliveInterval = 15 * time.Second
+	// RetryDelay is the delay before an EventSource reconnects a broken stream, in milliseconds.
+	RetryDelay = 3000
+)
+
+// EventEnd is the type of the last server-sent event of a finished run, clients stop reconnecting on it.
+const EventEnd = "end"
+
+// sseEntry is an entry as sent in a server-sent event, with the run it belongs to.
+type sseEntry struct {
+	Run string `json:"run"`
+	Entry
+}
+
+// handleEvents streams the entries of a run as server-sent events, the way /ws streams them with the events format.
+// Entry ids are only unique within a run, so the id of each event is the run and the id of its entry, RUN:ID. A client
+// reconnecting with Last-Event-ID resumes after it in the same run, even when it streams the latest run without the
+// run parameter.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	runID, after := "", 0
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		var err error
+		if runID, after, err = parseEventID(lastEventID); err != nil {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	} else {
+		after, _ = strconv.Atoi(r.URL.Query().Get("after"))
+	}
+	run, err := s.streamedRun(r)
+	if runID != "" {
+		run, err = s.manager.Get(runID)
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// stops nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", RetryDelay)
+	flusher.Flush()
+
+	history, live, cancel := run.Hub.Subscribe(after)
+	defer cancel()
+	send := func(e Entry) error {
+		b, err := json.Marshal(sseEntry{Run: run.ID, Entry: e})
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", eventID(run.ID, e.ID), b)
+		return err
+	}
+	for _, e := range history {
+		if err = send(e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(KeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e, ok := <-live:
+			if !ok {
+				// a subscriber which fell behind is dropped, it reconnects and resumes after its last event
+				select {
+				case <-run.Done():
+					fmt.Fprintf(w, "event: %s\ndata: run finished\n\n", EventEnd)
+					flusher.Flush()
+				default:
+					zLog.Debug().Str("run", run.ID).Msg("event stream fell behind the run")
+				}
+				return
+			}
+			if err = send(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// eventID returns the id of the server-sent event of an entry of a run.
+func eventID(run string, id int) string {
+	return run + ":" + strconv.Itoa(id)
+}
+
+// parseEventID returns the run and the entry id of the id of a server-sent event. An id without a run, as sent before
+// the ids had one, resumes the run the request streams.
+func parseEventID(id string) (string, int, error) {
+	run := ""
+	if i := strings.LastIndex(id, ":"); i >= 0 {
+		run, id = id[:i], id[i+1:]
+	}
+	after, err := strconv.Atoi(id)
+	return run, after, err
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"flow-gpt/internal/fsm"
+	zLog "github.com/rs/zerolog/log"
+)
+
+// Handler serves the stored runs as JSON:
+//
+//	GET /runs?q=query   lists the runs, matching the query if given
+//	GET /runs/{id}      returns the summary and transcript of a run
+func (s *Store) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/runs", s.handleList)
+	mux.HandleFunc("/runs/", s.handleRun)
+	return mux
+}
+
+func (s *Store) handleList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	runs, err := s.Search(r.URL.Query().Get("q"))
+	if err != nil {
+		zLog.Error().Err(err).Msg("failed to list runs")
+		http.Error(w, "failed to list runs", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, runs)
+}
+
+func (s *Store) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/runs/")
+	run, err := s.Get(id)
+	if errors.Is(err, ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		zLog.Error().Err(err).Str("run", id).Msg("failed to get run")
+		http.Error(w, "failed to get run", http.StatusInternalServerError)
+		return
+	}
+	events, err := s.Events(id)
+	if err != nil {
+		zLog.Error().Err(err).Str("run", id).Msg("failed to get run events")
+		http.Error(w, "failed to get run", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, struct {
+		Run
+		Transcript []fsm.Event `json:"transcript"`
+	}{run, events})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zLog.Error().Err(err).Msg("failed to write response")
+	}
+}
@@ -0,0 +1,481 @@
+// Package store persists the transcripts of runs to an embedded bbolt database.
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"flow-gpt/internal/fsm"
+	"github.com/google/uuid"
+	zLog "github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	StatusRunning         = "running"
+	StatusCompleted       = "completed"
+	StatusFailed          = "failed"
+	StatusCancelled       = "cancelled"
+	StatusBudgetExhausted = "budget_exhausted"
+)
+
+var (
+	runsBucket   = []byte("runs")
+	eventsBucket = []byte("events")
+)
+
+var ErrNotFound = errors.New("store: run not found")
+
+// Run is the summary of a stored run, its transcript is kept as events.
+type Run struct {
+	ID         string            `json:"id"`
+	Problem    string            `json:"problem"`
+	Config     map[string]string `json:"config,omitempty"`
+	Status     string            `json:"status"`
+	Error      string            `json:"error,omitempty"`
+	Turns      int               `json:"turns"`
+	TokensUsed int               `json:"tokensUsed"`
+	Events     int               `json:"events"`
+	StartedAt  time.Time         `json:"startedAt"`
+	FinishedAt *time.Time        `json:"finishedAt,omitempty"`
+}
+
+// Store is a database of runs. It is safe for concurrent use, also by several processes: bbolt locks the database
+// file for a single process at a time, so the file is only opened for each operation. The events appended by a process
+// are written together by a background writer, so the runs appending them never wait for the file.
+type Store struct {
+	path string
+	opts Options
+	// mu serializes the opening of the file, which bbolt locks per open file
+	mu sync.Mutex
+	// pendingMu guards pending and finishing, the events waiting for the writer
+	pendingMu sync.Mutex
+	pending   []pendingEvent
+	finishing bool
+	// wake tells the writer about pending events, urgent about a pending finish event
+	wake, urgent chan struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
+	wg           sync.WaitGroup
+}
+
+type pendingEvent struct {
+	run   string
+	event fsm.Event
+}
+
+type Options struct {
+	// ReadOnly opens the database without write access.
+	ReadOnly bool
+	// Timeout bounds the wait for the lock on the database file, held by another process for one operation at most.
+	Timeout time.Duration
+	// FlushInterval is how long appended events wait to be written together, finish events are written at once.
+	FlushInterval time.Duration
+}
+
+// Open checks the database at path, creating it if needed.
+func Open(path string, optFns ...func(o *Options)) (*Store, error) {
+	opts := Options{
+		Timeout:       5 * time.Second,
+		FlushInterval: 200 * time.Millisecond,
+	}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	s := &Store{
+		path:   path,
+		opts:   opts,
+		wake:   make(chan struct{}, 1),
+		urgent: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if opts.ReadOnly {
+		if err := s.view(func(tx *bolt.Tx) error { return nil }); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	err := s.update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(runsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(eventsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create buckets: %w", err)
+	}
+	s.wg.Add(1)
+	go s.write()
+	return s, nil
+}
+
+// Close stops the writer and writes the pending events.
+func (s *Store) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	s.wg.Wait()
+	return s.Flush()
+}
+
+// write writes the pending events when woken, waiting FlushInterval for more events unless a run finished.
+func (s *Store) write() {
+	defer s.wg.Done()
+	for {
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+		s.pendingMu.Lock()
+		finishing := s.finishing
+		s.pendingMu.Unlock()
+		if !finishing && s.opts.FlushInterval > 0 {
+			t := time.NewTimer(s.opts.FlushInterval)
+			select {
+			case <-t.C:
+			case <-s.urgent:
+			case <-s.done:
+			}
+			t.Stop()
+		}
+		if err := s.Flush(); err != nil {
+			zLog.Error().Err(err).Msg("failed to store events")
+		}
+	}
+}
+
+// open opens the database for one operation, the caller holds mu.
+func (s *Store) open(readOnly bool) (*bolt.DB, error) {
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: s.opts.Timeout, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	return db, nil
+}
+
+// view reads the database. The pending events are written first in the same open, so a process reads what it
+// appended.
+func (s *Store) view(fn func(tx *bolt.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.takePending()
+	if len(pending) == 0 {
+		db, err := s.open(true)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return db.View(fn)
+	}
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = db.Update(writePending(pending)); err != nil {
+		return fmt.Errorf("failed to store %d events: %w", len(pending), err)
+	}
+	return db.View(fn)
+}
+
+func (s *Store) update(fn func(tx *bolt.Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updateLocked(fn)
+}
+
+func (s *Store) updateLocked(fn func(tx *bolt.Tx) error) error {
+	if s.opts.ReadOnly {
+		return errors.New("store: opened read only")
+	}
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	if err = db.Update(fn); err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+// Create stores a new running run and returns it.
+func (s *Store) Create(problem string, config map[string]string) (Run, error) {
+	run := Run{
+		ID:        uuid.NewString(),
+		Problem:   problem,
+		Config:    config,
+		Status:    StatusRunning,
+		StartedAt: time.Now(),
+	}
+	err := s.update(func(tx *bolt.Tx) error {
+		if _, err := tx.Bucket(eventsBucket).CreateBucket([]byte(run.ID)); err != nil {
+			return err
+		}
+		return putRun(tx, run)
+	})
+	if err != nil {
+		return Run{}, fmt.Errorf("failed to create run: %w", err)
+	}
+	return run, nil
+}
+
+// Append queues an event for the transcript of a run and the update of its summary, without waiting for the file. The
+// event is written with the other events appended within FlushInterval, or at once if it finishes the run.
+func (s *Store) Append(id string, event fsm.Event) error {
+	if s.opts.ReadOnly {
+		return errors.New("store: opened read only")
+	}
+	select {
+	case <-s.done:
+		// the writer stopped with the store, the event is written at once
+		s.pendingMu.Lock()
+		s.pending = append(s.pending, pendingEvent{run: id, event: event})
+		s.pendingMu.Unlock()
+		return s.Flush()
+	default:
+	}
+	s.pendingMu.Lock()
+	s.pending = append(s.pending, pendingEvent{run: id, event: event})
+	urgent := event.Type == fsm.EventFinish
+	s.finishing = s.finishing || urgent
+	s.pendingMu.Unlock()
+	notify(s.wake)
+	if urgent {
+		notify(s.urgent)
+	}
+	return nil
+}
+
+// notify signals c without blocking, a signal already waiting covers this one.
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Flush writes the pending events in one transaction.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.takePending()
+	if len(pending) == 0 {
+		return nil
+	}
+	if err := s.updateLocked(writePending(pending)); err != nil {
+		return fmt.Errorf("failed to store %d events: %w", len(pending), err)
+	}
+	return nil
+}
+
+// takePending returns the pending events and clears them, the caller holds mu so they are written in order.
+func (s *Store) takePending() []pendingEvent {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	pending := s.pending
+	s.pending, s.finishing = nil, false
+	return pending
+}
+
+func writePending(pending []pendingEvent) func(tx *bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		for _, p := range pending {
+			err := appendEvent(tx, p.run, p.event)
+			if errors.Is(err, ErrNotFound) {
+				// an unknown run doesn't fail the events of the others
+				zLog.Error().Str("run", p.run).Msg("failed to store event of an unknown run")
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func appendEvent(tx *bolt.Tx, id string, event fsm.Event) error {
+	run, err := getRun(tx, id)
+	if err != nil {
+		return err
+	}
+	events := tx.Bucket(eventsBucket).Bucket([]byte(id))
+	seq, err := events.NextSequence()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if err = events.Put(itob(seq), b); err != nil {
+		return err
+	}
+
+	run.Events++
+	run.Turns = event.Turn
+	switch event.Type {
+	case fsm.EventChat:
+		run.TokensUsed += event.Tokens
+	case fsm.EventAudit:
+		for _, r := range event.Audit {
+			if r.Tokens != nil {
+				run.TokensUsed += r.Tokens.Total
+			}
+		}
+	case fsm.EventFinish:
+		run.Status, run.Error = finishStatus(event), event.Error
+		finished := event.Time
+		run.FinishedAt = &finished
+	}
+	return putRun(tx, run)
+}
+
+// Observer returns an observer which appends the events of a run to its transcript.
+func (s *Store) Observer(id string) fsm.Observer {
+	return func(event fsm.Event) {
+		if err := s.Append(id, event); err != nil {
+			zLog.Error().Err(err).Str("run", id).Msg("failed to store event")
+		}
+	}
+}
+
+// Get returns the summary of a run.
+func (s *Store) Get(id string) (Run, error) {
+	var run Run
+	err := s.view(func(tx *bolt.Tx) error {
+		var err error
+		run, err = getRun(tx, id)
+		return err
+	})
+	return run, err
+}
+
+// Events returns the transcript of a run in order.
+func (s *Store) Events(id string) ([]fsm.Event, error) {
+	var events []fsm.Event
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(eventsBucket)
+		if b != nil {
+			b = b.Bucket([]byte(id))
+		}
+		if b == nil {
+			return ErrNotFound
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var event fsm.Event
+			if err := json.Unmarshal(v, &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+			return nil
+		})
+	})
+	return events, err
+}
+
+// List returns the summaries of all runs, most recent first.
+func (s *Store) List() ([]Run, error) {
+	return s.Search("")
+}
+
+// Search returns the runs whose problem or transcript contains the query, ignoring case, most recent first. An empty
+// query matches every run.
+func (s *Store) Search(query string) ([]Run, error) {
+	query = strings.ToLower(query)
+	runs := []Run{}
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(runsBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var run Run
+			if err := json.Unmarshal(v, &run); err != nil {
+				return err
+			}
+			if query == "" || strings.Contains(strings.ToLower(run.Problem), query) || transcriptContains(tx, run.ID, query) {
+				runs = append(runs, run)
+			}
+			return nil
+		})
+	})
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].StartedAt.After(runs[j].StartedAt)
+	})
+	return runs, err
+}
+
+func transcriptContains(tx *bolt.Tx, id, query string) bool {
+	b := tx.Bucket(eventsBucket)
+	if b != nil {
+		b = b.Bucket([]byte(id))
+	}
+	if b == nil {
+		return false
+	}
+	found := errors.New("found")
+	err := b.ForEach(func(k, v []byte) error {
+		if strings.Contains(strings.ToLower(string(v)), query) {
+			return found
+		}
+		return nil
+	})
+	return err == found
+}
+
+// finishStatus returns the status of a run by the reason of its finish event.
+func finishStatus(event fsm.Event) string {
+	switch event.Reason {
+	case fsm.ReasonCompleted:
+		return StatusCompleted
+	case fsm.ReasonCancelled:
+		return StatusCancelled
+	case fsm.ReasonBudgetExhausted:
+		return StatusBudgetExhausted
+	case fsm.ReasonFailed:
+		return StatusFailed
+	}
+	// events stored before finish events had a reason
+	if event.Error != "" {
+		return StatusFailed
+	}
+	return StatusCompleted
+}
+
+func getRun(tx *bolt.Tx, id string) (Run, error) {
+	var run Run
+	b := tx.Bucket(runsBucket)
+	if b == nil {
+		return run, ErrNotFound
+	}
+	v := b.Get([]byte(id))
+	if v == nil {
+		return run, ErrNotFound
+	}
+	err := json.Unmarshal(v, &run)
+	return run, err
+}
+
+func putRun(tx *bolt.Tx, run Run) error {
+	b, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(runsBucket).Put([]byte(run.ID), b)
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	customAgent "flow-gpt/internal/agent"
+	"flow-gpt/internal/fsm"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runs.db")
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listed, err := db.Create("list the files", map[string]string{"plan": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, err := db.Create("count the lines", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	observe := db.Observer(listed.ID)
+	observe(fsm.Event{Type: fsm.EventChat, Turn: 1, Content: "run ls in the terminal", Tokens: 4})
+	observe(fsm.Event{Type: fsm.EventAudit, Turn: 1, Audit: []customAgent.Record{
+		{Kind: customAgent.RecordLLMEnd, Tokens: &customAgent.TokenUsage{Total: 3}},
+	}})
+	observe(fsm.Event{Type: fsm.EventFinish, Turn: 2, Time: time.Now()})
+	db.Observer(failed.ID)(fsm.Event{Type: fsm.EventFinish, Turn: 1, Error: "boom", Time: time.Now()})
+
+	run, err := db.Get(listed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != StatusCompleted || run.TokensUsed != 7 || run.Turns != 2 || run.Events != 3 || run.FinishedAt == nil {
+		t.Errorf("unexpected summary: %+v", run)
+	}
+	if run.Config["plan"] != "true" {
+		t.Errorf("config not stored: %v", run.Config)
+	}
+	if run, _ = db.Get(failed.ID); run.Status != StatusFailed || run.Error != "boom" {
+		t.Errorf("unexpected failed summary: %+v", run)
+	}
+	if _, err = db.Get("missing"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	events, err := db.Events(listed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || events[0].Content != "run ls in the terminal" || events[2].Type != fsm.EventFinish {
+		t.Errorf("unexpected transcript: %+v", events)
+	}
+
+	for query, want := range map[string]int{"": 2, "COUNT": 1, "terminal": 1, "nothing": 0} {
+		runs, err := db.Search(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) != want {
+			t.Errorf("search %q found %d runs, want %d", query, len(runs), want)
+		}
+	}
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, func(o *Options) {
+		o.ReadOnly = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	srv := httptest.NewServer(db.Handler())
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/runs?q=lines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var runs []Run
+	err = json.NewDecoder(res.Body).Decode(&runs)
+	res.Body.Close()
+	if err != nil || len(runs) != 1 || runs[0].ID != failed.ID {
+		t.Errorf("unexpected search response: %v %+v", err, runs)
+	}
+
+	res, err = http.Get(srv.URL + "/runs/" + listed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var view struct {
+		Run
+		Transcript []fsm.Event `json:"transcript"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&view)
+	res.Body.Close()
+	if err != nil || view.ID != listed.ID || len(view.Transcript) != 3 {
+		t.Errorf("unexpected run response: %v %+v", err, view)
+	}
+
+	res, err = http.Get(srv.URL + "/runs/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing run, got %d", res.StatusCode)
+	}
+}
+
+func TestStoreProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "runs.db")
+	// each store stands for a process, bbolt locks the file for each of them
+	first, err := Open(path, func(o *Options) {
+		o.FlushInterval = time.Hour
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	run, err := first.Create("list the files", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		first.Observer(run.ID)(fsm.Event{Type: fsm.EventChat, Turn: i, Tokens: 1})
+	}
+	other, err := second.Create("count the lines", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := Open(path, func(o *Options) {
+		o.ReadOnly = true
+		o.Timeout = time.Second
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs, err := reader.List(); err != nil || len(runs) != 2 {
+		t.Errorf("unexpected runs %+v: %v", runs, err)
+	}
+	// the events are written together once flushed
+	if got, err := reader.Get(run.ID); err != nil || got.Events != 0 {
+		t.Errorf("events written before the flush: %+v, %v", got, err)
+	}
+	// another process holding the file doesn't hold up the run appending the events
+	lock, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	first.Observer(run.ID)(fsm.Event{Type: fsm.EventFinish, Turn: 3, Time: time.Now()})
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("appending the finish event waited %s for the file", d)
+	}
+	lock.Close()
+	// the finish event is written without waiting for FlushInterval
+	var got Run
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if got, err = reader.Get(run.ID); err != nil || got.Events == 4 {
+			break
+		}
+	}
+	if err != nil || got.Events != 4 || got.TokensUsed != 3 || got.Status != StatusCompleted {
+		t.Errorf("unexpected summary after the finish %+v: %v", got, err)
+	}
+	if got, err := first.Get(other.ID); err != nil || got.Problem != "count the lines" {
+		t.Errorf("run of the other store not found %+v: %v", got, err)
+	}
+	if _, err = reader.Create("read only", nil); err == nil {
+		t.Error("expected a read only store to refuse writes")
+	}
+}
+
+func TestFinishStatus(t *testing.T) {
+	for _, tt := range []struct {
+		event fsm.Event
+		want  string
+	}{
+		{fsm.Event{Reason: fsm.ReasonCompleted}, StatusCompleted},
+		{fsm.Event{Reason: fsm.ReasonFailed, Error: "boom"}, StatusFailed},
+		{fsm.Event{Reason: fsm.ReasonCancelled, Error: "context canceled"}, StatusCancelled},
+		{fsm.Event{Reason: fsm.ReasonBudgetExhausted, Error: "turn limit reached: 5 turns"}, StatusBudgetExhausted},
+		{fsm.Event{Error: "boom"}, StatusFailed},
+		{fsm.Event{}, StatusCompleted},
+	} {
+		if got := finishStatus(tt.event); got != tt.want {
+			t.Errorf("finish %+v has status %q, want %q", tt.event, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package telemetry
+
+import (
+	"context"
+
+	customAgent "flow-gpt/internal/agent"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	AttrModel            = attribute.Key("llm.model")
+	AttrTokensPrompt     = attribute.Key("llm.tokens.prompt")
+	AttrTokensCompletion = attribute.Key("llm.tokens.completion")
+	AttrTokensTotal      = attribute.Key("llm.tokens.total")
+	AttrTool             = attribute.Key("tool.name")
+)
+
+// AuditSpans turns the audit records of an agent call into spans below the span of ctx: a span per agent step, with
+// a child span per tool invocation, and a span per model call. Its Sink is called under the lock of the audit log, so
+// it needs no locking of its own.
+type AuditSpans struct {
+	ctx    context.Context
+	tracer trace.Tracer
+	spans  map[string]trace.Span
+	step   trace.Span
+	stepID string
+}
+
+func NewAuditSpans(ctx context.Context, tracer trace.Tracer) *AuditSpans {
+	return &AuditSpans{
+		ctx:    ctx,
+		tracer: tracer,
+		spans:  map[string]trace.Span{},
+	}
+}
+
+// Sink records the spans of the audit records.
+func (a *AuditSpans) Sink(r customAgent.Record) {
+	switch r.Kind {
+	case customAgent.RecordAgentAction:
+		a.endStep(r)
+		_, a.step = a.tracer.Start(a.ctx, "agent.step", trace.WithTimestamp(r.Time), trace.WithAttributes(AttrTool.String(r.Tool)))
+		a.stepID = r.SpanID
+	case customAgent.RecordAgentFinish:
+		a.endStep(r)
+	case customAgent.RecordToolStart:
+		ctx := a.ctx
+		if a.step != nil && r.ParentID == a.stepID {
+			ctx = trace.ContextWithSpan(ctx, a.step)
+		}
+		_, a.spans[r.SpanID] = a.tracer.Start(ctx, "tool "+r.Tool, trace.WithTimestamp(r.Time), trace.WithAttributes(AttrTool.String(r.Tool)))
+	case customAgent.RecordLLMStart:
+		_, a.spans[r.SpanID] = a.tracer.Start(a.ctx, "llm", trace.WithTimestamp(r.Time), trace.WithAttributes(AttrModel.String(r.Model)))
+	case customAgent.RecordToolEnd, customAgent.RecordToolError, customAgent.RecordLLMEnd, customAgent.RecordLLMError:
+		span, ok := a.spans[r.SpanID]
+		if !ok {
+			return
+		}
+		delete(a.spans, r.SpanID)
+		if r.Model != "" {
+			span.SetAttributes(AttrModel.String(r.Model))
+		}
+		if r.Tokens != nil {
+			span.SetAttributes(TokenAttributes(r.Tokens.Prompt, r.Tokens.Completion, r.Tokens.Total)...)
+		}
+		if r.Error != "" {
+			span.SetStatus(codes.Error, r.Error)
+		}
+		span.End(trace.WithTimestamp(r.Time))
+	}
+}
+
+// End ends the spans left open by an agent call which didn't finish.
+func (a *AuditSpans) End() {
+	for id, span := range a.spans {
+		span.SetStatus(codes.Error, "unfinished")
+		span.End()
+		delete(a.spans, id)
+	}
+	if a.step != nil {
+		a.step.End()
+		a.step = nil
+	}
+}
+
+func (a *AuditSpans) endStep(r customAgent.Record) {
+	if a.step != nil {
+		a.step.End(trace.WithTimestamp(r.Time))
+		a.step = nil
+	}
+}
+
+// TokenAttributes returns the token count attributes of a model call.
+func TokenAttributes(prompt, completion, total int) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		AttrTokensPrompt.Int(prompt),
+		AttrTokensCompletion.Int(completion),
+		AttrTokensTotal.Int(total),
+	}
+}
@@ -0,0 +1,82 @@
+// Package telemetry exports OpenTelemetry traces of runs and turns audit records into spans.
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+const (
+	ExporterOTLP = "otlp"
+	ExporterFile = "file"
+)
+
+const ServiceName = "flow-gpt"
+
+type Options struct {
+	// Exporter is ExporterOTLP, configured by the standard OTEL_EXPORTER_OTLP_* environment variables, or ExporterFile.
+	Exporter string
+	// File is the path the spans are written to as JSON Lines by ExporterFile.
+	File string
+}
+
+// Setup installs a global tracer provider exporting to the configured exporter. The returned function flushes the
+// remaining spans and releases the exporter.
+func Setup(ctx context.Context, optFns ...func(o *Options)) (func(context.Context) error, error) {
+	opts := Options{
+		Exporter: ExporterOTLP,
+		File:     "trace.jsonl",
+	}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+
+	var exporter sdktrace.SpanExporter
+	var closer io.Closer
+	switch opts.Exporter {
+	case ExporterOTLP:
+		e, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create otlp exporter: %w", err)
+		}
+		exporter = e
+	case ExporterFile:
+		f, err := os.Create(opts.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create trace file: %w", err)
+		}
+		e, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to create file exporter: %w", err)
+		}
+		exporter, closer = e, f
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", opts.Exporter)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(ServiceName))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closer != nil {
+			if cErr := closer.Close(); err == nil {
+				err = cErr
+			}
+		}
+		return err
+	}, nil
+}
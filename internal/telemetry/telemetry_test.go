@@ -0,0 +1,44 @@
+package telemetry
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetupFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	shutdown, err := Setup(context.Background(), func(o *Options) {
+		o.Exporter = ExporterFile
+		o.File = path
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := otel.Tracer("test").Start(context.Background(), "turn")
+	span.End()
+	if err = shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"Name":"turn"`) || !strings.Contains(string(b), ServiceName) {
+		t.Errorf("span not exported to the file:\n%s", b)
+	}
+}
+
+func TestSetupUnknownExporter(t *testing.T) {
+	_, err := Setup(context.Background(), func(o *Options) {
+		o.Exporter = "zipkin"
+	})
+	if err == nil {
+		t.Error("expected an error for an unknown exporter")
+	}
+}
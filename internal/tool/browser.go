@@ -0,0 +1,116 @@
+package tool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/hupe1980/golc/schema"
+	"github.com/playwright-community/playwright-go"
+	zLog "github.com/rs/zerolog/log"
+)
+
+var _ schema.Tool = (*Screenshot)(nil)
+
+// Screenshot saves a screenshot of the current page of the browser to a file of a directory.
+type Screenshot struct {
+	browser playwright.Browser
+	dir     string
+}
+
+func NewScreenshot(browser playwright.Browser, dir string) *Screenshot {
+	return &Screenshot{
+		browser: browser,
+		dir:     dir,
+	}
+}
+
+func (t *Screenshot) Name() string {
+	return "Screenshot"
+}
+
+func (t *Screenshot) Description() string {
+	return `Agent will save a screenshot of the current page of the browser to the given relative png file path.`
+}
+
+func (t *Screenshot) ArgsType() reflect.Type {
+	return reflect.TypeOf("") // string
+}
+
+func (t *Screenshot) Run(ctx context.Context, input any) (string, error) {
+	name := strings.TrimSpace(input.(string))
+	if name == "" {
+		name = "screenshot.png"
+	}
+	path, err := Within(t.dir, name)
+	if err != nil {
+		return "", err
+	}
+	page, err := currentPage(t.browser)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the current page: %w", err)
+	}
+	if _, err = page.Screenshot(playwright.PageScreenshotOptions{Path: &path}); err != nil {
+		return "", fmt.Errorf("failed to take a screenshot: %w", err)
+	}
+
+	return fmt.Sprintf("Saved a screenshot of %s to %s", page.URL(), name), nil
+}
+
+func (t *Screenshot) Verbose() bool {
+	return false
+}
+
+func (t *Screenshot) Callbacks() []schema.Callback {
+	return nil
+}
+
+// SaveDownloads saves the downloads of the pages of the browser context to dir, by their suggested file name.
+func SaveDownloads(bc playwright.BrowserContext, dir string) {
+	bc.On("page", func(page playwright.Page) {
+		page.On("download", func(d playwright.Download) {
+			// saving waits for the download, which must not hold up the events of the page
+			go func() {
+				path := filepath.Join(dir, filepath.Base(d.SuggestedFilename()))
+				if err := d.SaveAs(path); err != nil {
+					zLog.Error().Err(err).Str("url", d.URL()).Msg("failed to save download")
+					return
+				}
+				zLog.Info().Str("url", d.URL()).Str("path", path).Msg("saved download")
+			}()
+		})
+	})
+}
+
+// Within joins the relative path name to dir, refusing paths which leave it.
+func Within(dir, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return "", errors.New("the path must be relative")
+	}
+	clean := filepath.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.New("the path must not leave the workspace")
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// currentPage returns the last page of the first context of the browser, creating them if needed, like the browser
+// tools of golc.
+func currentPage(browser playwright.Browser) (playwright.Page, error) {
+	if len(browser.Contexts()) == 0 {
+		bc, err := browser.NewContext()
+		if err != nil {
+			return nil, err
+		}
+		return bc.NewPage()
+	}
+	bc := browser.Contexts()[0]
+	pages := bc.Pages()
+	if len(pages) == 0 {
+		return bc.NewPage()
+	}
+	return pages[len(pages)-1], nil
+}
@@ -0,0 +1,168 @@
+package tool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"flow-gpt/internal/integration"
+	"github.com/hupe1980/golc/schema"
+)
+
+var _ schema.Tool = (*Git)(nil)
+
+// Limits of the log operation.
+const (
+	DefaultLogCount = 10
+	MaxLogCount     = 100
+)
+
+// Git runs the git operations of the agent in the repository of the workspace. Commits are only made on branches
+// with integration.BranchPrefix and nothing leaves the workspace: paths outside of it are refused and there is no
+// push.
+type Git struct {
+	git *integration.Git
+}
+
+func NewGit(git *integration.Git) *Git {
+	return &Git{
+		git: git,
+	}
+}
+
+func (t *Git) Name() string {
+	return "Git"
+}
+
+func (t *Git) Description() string {
+	return `Agent will run a git operation in the repository of the workspace, the input is one of:
+status: the changed files and the branch;
+diff [--staged] [PATH...]: the changes of the work tree, or of the index with --staged;
+branch [NAME]: the branches, or create and switch to the branch ` + integration.BranchPrefix + `NAME;
+commit MESSAGE: commit every change with the message, only on ` + integration.BranchPrefix + ` branches;
+log [N]: the last N commits;
+restore PATH...: discard the changes of the files since the last commit.`
+}
+
+func (t *Git) ArgsType() reflect.Type {
+	return reflect.TypeOf("") // string
+}
+
+func (t *Git) Run(ctx context.Context, input any) (string, error) {
+	op, args, _ := strings.Cut(strings.TrimSpace(input.(string)), " ")
+	args = strings.TrimSpace(args)
+	var output string
+	var err error
+	switch op {
+	case "status":
+		output, err = t.git.Run(ctx, "status", "--short", "--branch")
+	case "diff":
+		output, err = t.diff(ctx, strings.Fields(args))
+	case "branch":
+		output, err = t.branch(ctx, args)
+	case "commit":
+		output, err = t.commit(ctx, args)
+	case "log":
+		output, err = t.log(ctx, args)
+	case "restore":
+		output, err = t.restore(ctx, strings.Fields(args))
+	default:
+		return "", fmt.Errorf("unknown git operation %q, use status, diff, branch, commit, log or restore", op)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to run git %s: %w", op, err)
+	}
+
+	return fmt.Sprintf("Successfully ran git %s with output=[%s]", op, output), nil
+}
+
+func (t *Git) Verbose() bool {
+	return false
+}
+
+func (t *Git) Callbacks() []schema.Callback {
+	return nil
+}
+
+func (t *Git) diff(ctx context.Context, args []string) (string, error) {
+	gitArgs := []string{"diff"}
+	if len(args) > 0 && args[0] == "--staged" {
+		gitArgs, args = append(gitArgs, "--staged"), args[1:]
+	}
+	paths, err := t.paths(args)
+	if err != nil {
+		return "", err
+	}
+	return t.git.Run(ctx, append(append(gitArgs, "--"), paths...)...)
+}
+
+func (t *Git) branch(ctx context.Context, name string) (string, error) {
+	if name == "" {
+		return t.git.Run(ctx, "branch", "--list")
+	}
+	if !strings.HasPrefix(name, integration.BranchPrefix) {
+		name = integration.BranchPrefix + name
+	}
+	if _, err := t.git.Run(ctx, "check-ref-format", "--branch", name); err != nil {
+		return "", fmt.Errorf("invalid branch name %q", name)
+	}
+	return t.git.Run(ctx, "switch", "--create", name)
+}
+
+func (t *Git) commit(ctx context.Context, message string) (string, error) {
+	if message == "" {
+		return "", errors.New("a commit message is needed")
+	}
+	branch, err := t.git.Branch(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(branch, integration.BranchPrefix) {
+		return "", fmt.Errorf("commits are only made on %s branches, create one with branch NAME", integration.BranchPrefix)
+	}
+	if _, err = t.git.Run(ctx, "add", "--all"); err != nil {
+		return "", err
+	}
+	if _, err = t.git.Run(ctx, "commit", "--quiet", "--message", message); err != nil {
+		return "", err
+	}
+	return t.git.Run(ctx, "log", "-1", "--stat", "--format=%h %s")
+}
+
+func (t *Git) log(ctx context.Context, count string) (string, error) {
+	n := DefaultLogCount
+	if count != "" {
+		var err error
+		if n, err = strconv.Atoi(count); err != nil || n < 1 {
+			return "", fmt.Errorf("invalid number of commits %q", count)
+		}
+	}
+	if n > MaxLogCount {
+		n = MaxLogCount
+	}
+	return t.git.Run(ctx, "log", "--oneline", "--max-count", strconv.Itoa(n))
+}
+
+func (t *Git) restore(ctx context.Context, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", errors.New("the paths to restore are needed, . restores every file")
+	}
+	paths, err := t.paths(args)
+	if err != nil {
+		return "", err
+	}
+	return t.git.Run(ctx, append([]string{"restore", "--source=HEAD", "--staged", "--worktree", "--"}, paths...)...)
+}
+
+// paths checks that the paths of an operation stay in the workspace.
+func (t *Git) paths(args []string) ([]string, error) {
+	for _, p := range args {
+		if _, err := Within(t.git.Dir(), p); err != nil {
+			return nil, fmt.Errorf("invalid path %q: %w", p, err)
+		}
+	}
+	return args, nil
+}
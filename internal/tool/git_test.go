@@ -0,0 +1,75 @@
+package tool
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"flow-gpt/internal/integration"
+)
+
+func TestGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	g := integration.NewGit(dir)
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"init", "--quiet", "--initial-branch", "main"}, {"add", "."}, {"commit", "--quiet", "-m", "init"}} {
+		if _, err := g.Run(ctx, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tool := NewGit(g)
+	run := func(input string) (string, error) {
+		return tool.Run(ctx, input)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run("status"); err != nil || !strings.Contains(out, "## main") || !strings.Contains(out, "M main.go") {
+		t.Errorf("unexpected status %q: %v", out, err)
+	}
+	if out, err := run("diff main.go"); err != nil || !strings.Contains(out, "+func main() {}") {
+		t.Errorf("unexpected diff %q: %v", out, err)
+	}
+	if _, err := run("commit add main"); err == nil || !strings.Contains(err.Error(), "only made on flow-gpt/ branches") {
+		t.Errorf("expected the commit on main to be refused, got %v", err)
+	}
+	if _, err := run("diff ../other"); err == nil {
+		t.Error("expected a path outside the workspace to be refused")
+	}
+	if _, err := run("push origin main"); err == nil {
+		t.Error("expected an unknown operation to fail")
+	}
+
+	if _, err := run("branch feature"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := run("commit add main"); err != nil || !strings.Contains(out, "add main") {
+		t.Fatalf("unexpected commit %q: %v", out, err)
+	}
+	if out, err := run("log 1"); err != nil || !strings.Contains(out, "add main") {
+		t.Errorf("unexpected log %q: %v", out, err)
+	}
+	if branch, err := g.Branch(ctx); err != nil || branch != integration.BranchPrefix+"feature" {
+		t.Errorf("unexpected branch %q: %v", branch, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := run("restore main.go"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, "main.go")); err != nil || string(b) != "package main\n\nfunc main() {}\n" {
+		t.Errorf("main.go wasn't restored: %q, %v", b, err)
+	}
+}
@@ -0,0 +1,159 @@
+package tui
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"flow-gpt/internal/server"
+	"github.com/gorilla/websocket"
+)
+
+// Client talks to the API of a flow-gpt server.
+type Client struct {
+	base   *url.URL
+	http   *http.Client
+	dialer *websocket.Dialer
+	opts   ClientOptions
+}
+
+type ClientOptions struct {
+	// Token is sent as the bearer token of every request, the server needs one if it requires authentication.
+	Token string
+}
+
+// NewClient creates a client of the server at baseURL, e.g. http://localhost:8080.
+func NewClient(baseURL string, optFns ...func(o *ClientOptions)) (*Client, error) {
+	opts := ClientOptions{}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid server url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid server url %q: expected an http or https url", baseURL)
+	}
+	return &Client{
+		base:   u,
+		http:   http.DefaultClient,
+		dialer: websocket.DefaultDialer,
+		opts:   opts,
+	}, nil
+}
+
+// Latest returns the most recently started run.
+func (c *Client) Latest(ctx context.Context) (server.Info, error) {
+	var runs []server.Info
+	if err := c.do(ctx, http.MethodGet, "/api/runs", nil, &runs); err != nil {
+		return server.Info{}, err
+	}
+	if len(runs) == 0 {
+		return server.Info{}, errors.New("the server has no runs")
+	}
+	return runs[0], nil
+}
+
+// Control sends a control of the operator to a run, see server.Manager.Control.
+func (c *Client) Control(ctx context.Context, run, control, text string) error {
+	body := map[string]string{}
+	switch control {
+	case server.ControlHint:
+		body["hint"] = text
+	case server.ControlReject:
+		body["reason"] = text
+	}
+	return c.do(ctx, http.MethodPost, "/api/runs/"+url.PathEscape(run)+"/"+control, body, nil)
+}
+
+// Stream streams the entries of a run after the id. The channel is closed when the stream ends, which it does when
+// the run finishes, the connection breaks or ctx is done.
+func (c *Client) Stream(ctx context.Context, run string, after int) (<-chan server.Entry, error) {
+	u := *c.base
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	u.Path += "/ws"
+	u.RawQuery = url.Values{
+		"run":    {run},
+		"format": {server.FormatEvents},
+		"after":  {strconv.Itoa(after)},
+	}.Encode()
+	conn, _, err := c.dialer.DialContext(ctx, u.String(), c.header())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", u.Redacted(), err)
+	}
+	entries := make(chan server.Entry)
+	done := make(chan struct{})
+	go func() {
+		// unblocks the read below
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	go func() {
+		defer close(entries)
+		defer close(done)
+		defer conn.Close()
+		for {
+			var e server.Entry
+			if err := conn.ReadJSON(&e); err != nil {
+				return
+			}
+			select {
+			case entries <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return entries, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base.String()+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header = c.header()
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, res.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (c *Client) header() http.Header {
+	h := http.Header{}
+	if c.opts.Token != "" {
+		h.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	return h
+}
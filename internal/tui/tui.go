@@ -0,0 +1,269 @@
+package tui
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"flow-gpt/internal/server"
+	"golang.org/x/term"
+)
+
+// Defaults of the options.
+const (
+	ReconnectDelay = 2 * time.Second
+	ControlTimeout = 5 * time.Second
+)
+
+const help = "p pause/resume  a approve  x reject  h hint  l audit  ↑/↓ scroll  q quit"
+
+type Options struct {
+	// In is read for the keys of the operator, it is put in raw mode if it is a terminal.
+	In *os.File
+	// Out is rendered to, it should be the terminal of In.
+	Out io.Writer
+	// ReconnectDelay is the wait before the stream of a run is reconnected after it broke.
+	ReconnectDelay time.Duration
+}
+
+// input is a line typed by the operator for a control.
+type input struct {
+	prompt  string
+	control string
+	text    []rune
+}
+
+type ui struct {
+	ctx     context.Context
+	client  *Client
+	view    *View
+	opts    Options
+	expand  bool
+	scroll  int
+	input   *input
+	message string
+	width   int
+	height  int
+}
+
+// Run shows the run, the latest one if run is empty, until the operator quits or ctx is done.
+func Run(ctx context.Context, client *Client, run string, optFns ...func(o *Options)) error {
+	opts := Options{
+		In:             os.Stdin,
+		Out:            os.Stdout,
+		ReconnectDelay: ReconnectDelay,
+	}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	if run == "" {
+		info, err := client.Latest(ctx)
+		if err != nil {
+			return err
+		}
+		run = info.ID
+	}
+	entries, err := client.Stream(ctx, run, 0)
+	if err != nil {
+		return err
+	}
+
+	fd := int(opts.In.Fd())
+	if term.IsTerminal(fd) {
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("failed to put the terminal in raw mode: %w", err)
+		}
+		defer term.Restore(fd, state)
+	}
+	// alternate screen, hidden cursor and no line wrapping, lines longer than the terminal are cut
+	fmt.Fprint(opts.Out, "\x1b[?1049h\x1b[?25l\x1b[?7l")
+	defer fmt.Fprint(opts.Out, "\x1b[?7h\x1b[?25h\x1b[?1049l")
+
+	u := &ui{ctx: ctx, client: client, view: NewView(run), opts: opts}
+	keys := make(chan []byte)
+	go readKeys(opts.In, keys)
+	resize := time.NewTicker(time.Second)
+	defer resize.Stop()
+	var reconnect <-chan time.Time
+	for {
+		u.draw()
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-entries:
+			for ok {
+				u.view.Apply(e)
+				select {
+				case e, ok = <-entries:
+					continue
+				default:
+				}
+				break
+			}
+			if !ok {
+				entries = nil
+				if !u.view.Finished() {
+					u.message = "connection lost, reconnecting"
+					reconnect = time.After(u.opts.ReconnectDelay)
+				}
+			}
+		case <-reconnect:
+			reconnect = nil
+			entries, err = client.Stream(ctx, run, u.view.LastID)
+			if err != nil {
+				u.message = err.Error()
+				reconnect = time.After(u.opts.ReconnectDelay)
+			} else {
+				u.message = ""
+			}
+		case b, ok := <-keys:
+			if !ok || u.key(b) {
+				return nil
+			}
+		case <-resize.C:
+			// redrawn at the top of the loop
+		}
+	}
+}
+
+func readKeys(in io.Reader, keys chan<- []byte) {
+	defer close(keys)
+	buf := make([]byte, 64)
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			keys <- append([]byte(nil), buf[:n]...)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// key handles the keys read at once, and returns true if the operator quits.
+func (u *ui) key(b []byte) bool {
+	if u.input != nil {
+		return u.typeKey(b)
+	}
+	switch string(b) {
+	case "q", "\x03":
+		return true
+	case "p":
+		if u.view.Status == StatusPaused {
+			u.control(server.ControlResume, "")
+		} else {
+			u.control(server.ControlPause, "")
+		}
+	case "a":
+		u.control(server.ControlApprove, "")
+	case "x":
+		u.input = &input{prompt: "reject, reason: ", control: server.ControlReject}
+	case "h":
+		u.input = &input{prompt: "hint: ", control: server.ControlHint}
+	case "l":
+		u.expand = !u.expand
+	case "k", "\x1b[A":
+		u.scroll++
+	case "j", "\x1b[B":
+		if u.scroll > 0 {
+			u.scroll--
+		}
+	case "G":
+		u.scroll = 0
+	}
+	return false
+}
+
+// typeKey edits the line of the operator, Enter sends it and Esc drops it.
+func (u *ui) typeKey(b []byte) bool {
+	switch {
+	case len(b) == 1 && b[0] == 3:
+		return true
+	case len(b) == 1 && b[0] == 27:
+		u.input = nil
+	case len(b) == 1 && (b[0] == '\r' || b[0] == '\n'):
+		in := u.input
+		u.input = nil
+		u.control(in.control, string(in.text))
+	case len(b) == 1 && (b[0] == 127 || b[0] == 8):
+		if len(u.input.text) > 0 {
+			u.input.text = u.input.text[:len(u.input.text)-1]
+		}
+	case b[0] >= 32 && b[0] != 127 && utf8.Valid(b):
+		u.input.text = append(u.input.text, []rune(string(b))...)
+	}
+	return false
+}
+
+func (u *ui) control(control, text string) {
+	ctx, cancel := context.WithTimeout(u.ctx, ControlTimeout)
+	defer cancel()
+	if err := u.client.Control(ctx, u.view.Run, control, text); err != nil {
+		u.message = err.Error()
+		return
+	}
+	u.message = control + " sent"
+}
+
+func (u *ui) draw() {
+	u.width, u.height = 80, 24
+	if f, ok := u.opts.Out.(*os.File); ok {
+		if w, h, err := term.GetSize(int(f.Fd())); err == nil {
+			u.width, u.height = w, h
+		}
+	}
+
+	lines := u.view.Header(u.width)
+	lines = append(lines, dim+strings.Repeat("─", u.width)+reset)
+	var footer []string
+	if u.view.Pending != "" {
+		footer = append(footer, yellow+"an action awaits approval: a approves it, x rejects it"+reset)
+	}
+	if u.message != "" {
+		footer = append(footer, u.message)
+	}
+	if u.input != nil {
+		footer = append(footer, bold+u.input.prompt+reset+string(u.input.text)+"█")
+	} else {
+		footer = append(footer, dim+help+reset)
+	}
+
+	body := u.view.Body(u.width, u.expand)
+	rows := u.height - len(lines) - len(footer)
+	if rows < 1 {
+		rows = 1
+	}
+	if top := len(body) - rows; u.scroll > top {
+		u.scroll = top
+	}
+	if u.scroll < 0 {
+		u.scroll = 0
+	}
+	end := len(body) - u.scroll
+	start := end - rows
+	if start < 0 {
+		start = 0
+	}
+	lines = append(lines, body[start:end]...)
+	for len(lines) < u.height-len(footer) {
+		lines = append(lines, "")
+	}
+	lines = append(lines, footer...)
+
+	var sb strings.Builder
+	sb.WriteString("\x1b[H")
+	for i, l := range lines {
+		if i > 0 {
+			sb.WriteString("\r\n")
+		}
+		sb.WriteString(l)
+		sb.WriteString("\x1b[K")
+	}
+	sb.WriteString("\x1b[J")
+	fmt.Fprint(u.opts.Out, sb.String())
+}
@@ -0,0 +1,116 @@
+package tui
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	customAgent "flow-gpt/internal/agent"
+	"flow-gpt/internal/fake"
+	"flow-gpt/internal/fsm"
+	"flow-gpt/internal/server"
+	"github.com/hupe1980/golc/schema"
+	"github.com/rs/zerolog"
+)
+
+func TestView(t *testing.T) {
+	v := NewView("run-1")
+	for i, e := range []fsm.Event{
+		{Type: fsm.EventStart, Content: "list the files"},
+		{Type: fsm.EventChat, Turn: 1, Role: fsm.RoleThinker, Tokens: 3, Content: `{"type":"agent","thought":"list them","output":"Run ls."}`},
+		{Type: fsm.EventChat, Turn: 1, Role: fsm.RoleCritic, Tokens: 2, Content: `{"status":"good"}`},
+		{Type: fsm.EventCritique, Turn: 1, Subject: fsm.SubjectThought, Content: "good"},
+		{Type: fsm.EventApproval, Turn: 2, State: "AwaitApproval", Content: "Run ls."},
+	} {
+		v.Apply(server.Entry{ID: i + 1, Event: e})
+	}
+	if v.Status != StatusApproval || v.Pending != "Run ls." || v.Tokens != 5 || v.Problem != "list the files" {
+		t.Fatalf("unexpected view %+v", v)
+	}
+
+	for i, e := range []fsm.Event{
+		{Type: fsm.EventDecision, Turn: 2, Content: fsm.DecisionApproved},
+		{Type: fsm.EventAudit, Turn: 2, Audit: []customAgent.Record{{Kind: customAgent.RecordToolStart, Tool: "Terminal", Input: "ls"}}},
+		{Type: fsm.EventAudit, Turn: 2, Audit: []customAgent.Record{{Kind: customAgent.RecordLLMEnd, Tokens: &customAgent.TokenUsage{Total: 4}}}},
+		{Type: fsm.EventDiff, Turn: 2, Content: "diff --git a/a b/a\n--- a/a\n+++ b/a\n-old\n+new\n+more\n"},
+		{Type: fsm.EventFinish, Turn: 2},
+	} {
+		v.Apply(server.Entry{ID: i + 6, Event: e})
+	}
+	// entries already applied are ignored when a stream resumes
+	v.Apply(server.Entry{ID: 2, Event: fsm.Event{Type: fsm.EventChat, Role: fsm.RoleThinker, Tokens: 3}})
+	if !v.Finished() || v.Pending != "" || v.Tokens != 9 || v.LastID != 10 {
+		t.Fatalf("unexpected view %+v", v)
+	}
+
+	body := strings.Join(v.Body(80, false), "\n")
+	for _, s := range []string{"Turn 1", "list them", "Run ls.", green + "good" + reset, "Turn 2", "2 records (l to expand)", "1 files changed, +2 -1"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("expected %q in the body:\n%s", s, body)
+		}
+	}
+	if strings.Contains(body, "tool_start Terminal ls") {
+		t.Errorf("expected the audit log to be collapsed:\n%s", body)
+	}
+	if body = strings.Join(v.Body(80, true), "\n"); !strings.Contains(body, "tool_start Terminal ls") {
+		t.Errorf("expected the audit log to be expanded:\n%s", body)
+	}
+}
+
+func TestClient(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	manager := server.NewManager(ctx, func(problem string, observer fsm.Observer) (string, *fsm.FSM, error) {
+		model := fake.NewChatModel(
+			fake.Response{Match: []string{"Let's start working on the problem"}, Content: `{"resources":{},"type":"agent","thought":"list the files","output":"Run ls in the terminal."}`},
+			fake.Response{Match: []string{"critically evaluate and analyze"}, Content: `{"type":"critique","status":"good","reason":"ok"}`, Times: 2},
+			fake.Response{Match: []string{"Review the history from previous turns"}, Content: `{"resources":{},"type":"complete","thought":"nothing to do"}`},
+		)
+		f, err := fsm.New(problem, 0, func(o *fsm.Options) {
+			o.ChatModel = model
+			o.Tools = []schema.Tool{fake.NewTool("Terminal")}
+			o.RequireApproval = true
+			o.Observers = []fsm.Observer{observer}
+		})
+		return "run-1", f, err
+	})
+	srv := httptest.NewServer(server.New(manager).Handler())
+	defer srv.Close()
+	if _, err := manager.Start("list the files"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := client.Latest(ctx)
+	if err != nil || info.ID != "run-1" {
+		t.Fatalf("unexpected latest run %+v: %v", info, err)
+	}
+	entries, err := client.Stream(ctx, info.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewView(info.ID)
+	for e := range entries {
+		v.Apply(e)
+		if e.Event.Type == fsm.EventApproval {
+			if err = client.Control(ctx, info.ID, server.ControlReject, "not now"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if v.Status != server.StatusCompleted {
+		t.Fatalf("expected the run to complete after the rejection, got %+v", v)
+	}
+	if body := strings.Join(v.Body(80, false), "\n"); !strings.Contains(body, "rejected"+reset+": not now") {
+		t.Errorf("expected the rejection in the body:\n%s", body)
+	}
+	if err = client.Control(ctx, info.ID, server.ControlApprove, ""); err == nil || !strings.Contains(err.Error(), "409") {
+		t.Errorf("expected a finished run to refuse controls, got %v", err)
+	}
+}
@@ -0,0 +1,354 @@
+// Package tui shows a run of a flow-gpt server in the terminal and sends the commands of the operator to it.
+package tui
+
+import (
+	"fmt"
+	"strings"
+
+	customAgent "flow-gpt/internal/agent"
+	"flow-gpt/internal/fsm"
+	"flow-gpt/internal/server"
+	"github.com/tidwall/gjson"
+)
+
+// Statuses of a run as shown in the header.
+const (
+	StatusRunning  = "running"
+	StatusPaused   = "paused"
+	StatusApproval = "awaiting approval"
+)
+
+const (
+	itemThought  = "thought"
+	itemCritique = "critique"
+	itemAction   = "action"
+	itemAudit    = "audit"
+	itemApproval = "approval"
+	itemDecision = "decision"
+	itemHint     = "hint"
+	itemRetry    = "retry"
+	itemComplete = "complete"
+	itemDiff     = "diff"
+)
+
+type item struct {
+	kind    string
+	text    string
+	status  string
+	records []customAgent.Record
+}
+
+type turn struct {
+	n     int
+	items []*item
+}
+
+// View is the state of a run rebuilt from its events, grouped by turn.
+type View struct {
+	Run     string
+	Problem string
+	State   string
+	Turn    int
+	Tokens  int
+	Status  string
+	Error   string
+	// Pending is the action awaiting the approval of the operator.
+	Pending string
+	// LastID is the id of the last applied entry, the stream resumes after it.
+	LastID int
+	turns  []*turn
+}
+
+func NewView(run string) *View {
+	return &View{Run: run, Status: StatusRunning}
+}
+
+// Finished reports whether the run has ended.
+func (v *View) Finished() bool {
+	return v.Status == server.StatusCompleted || v.Status == server.StatusFailed
+}
+
+// Apply adds the event of an entry to the view, entries at or before LastID are ignored.
+func (v *View) Apply(entry server.Entry) {
+	if entry.ID <= v.LastID {
+		return
+	}
+	v.LastID = entry.ID
+	e := entry.Event
+	v.Turn, v.State = e.Turn, e.State
+	switch e.Type {
+	case fsm.EventStart:
+		v.Problem = e.Content
+	case fsm.EventChat:
+		v.Tokens += e.Tokens
+		if e.Role == fsm.RoleThinker {
+			v.addThought(e)
+		}
+	case fsm.EventCritique:
+		v.add(e.Turn, &item{kind: itemCritique, text: e.Subject, status: e.Content})
+	case fsm.EventAudit:
+		for _, r := range e.Audit {
+			if r.Tokens != nil {
+				v.Tokens += r.Tokens.Total
+			}
+		}
+		if last := v.last(e.Turn); last != nil && last.kind == itemAudit {
+			last.records = append(last.records, e.Audit...)
+		} else {
+			v.add(e.Turn, &item{kind: itemAudit, records: e.Audit})
+		}
+	case fsm.EventApproval:
+		v.Pending, v.Status = e.Content, StatusApproval
+		v.add(e.Turn, &item{kind: itemApproval, text: e.Content})
+	case fsm.EventDecision:
+		v.Pending, v.Status = "", StatusRunning
+		v.add(e.Turn, &item{kind: itemDecision, status: e.Content, text: e.Error})
+	case fsm.EventPause:
+		v.Status = StatusPaused
+	case fsm.EventResume:
+		v.Status = StatusRunning
+		if v.Pending != "" {
+			v.Status = StatusApproval
+		}
+	case fsm.EventHint:
+		v.add(e.Turn, &item{kind: itemHint, text: e.Content})
+	case fsm.EventRetry:
+		v.add(e.Turn, &item{kind: itemRetry, text: e.Role + ": " + e.Error})
+	case fsm.EventDiff:
+		text := diffSummary(e.Content)
+		if e.Error != "" {
+			text = "failed: " + e.Error
+		}
+		v.add(e.Turn, &item{kind: itemDiff, text: text})
+	case fsm.EventFinish:
+		v.Pending = ""
+		v.Status, v.Error = server.StatusCompleted, e.Error
+		if e.Error != "" {
+			v.Status = server.StatusFailed
+		}
+	}
+}
+
+// addThought adds the thought of a thinker response, and the action it proposes if any.
+func (v *View) addThought(e fsm.Event) {
+	if !gjson.Valid(e.Content) {
+		v.add(e.Turn, &item{kind: itemThought, text: e.Content})
+		return
+	}
+	thought := gjson.Get(e.Content, "thought").String()
+	if thought == "" {
+		thought = e.Content
+	}
+	v.add(e.Turn, &item{kind: itemThought, text: thought})
+	switch gjson.Get(e.Content, "type").String() {
+	case "agent":
+		text := gjson.Get(e.Content, "output").String()
+		for _, a := range gjson.Get(e.Content, "actions").Array() {
+			text += "\n- " + a.String()
+		}
+		v.add(e.Turn, &item{kind: itemAction, text: strings.TrimSpace(text)})
+	case "complete":
+		v.add(e.Turn, &item{kind: itemComplete})
+	}
+}
+
+func (v *View) add(n int, it *item) {
+	if len(v.turns) == 0 || v.turns[len(v.turns)-1].n != n {
+		v.turns = append(v.turns, &turn{n: n})
+	}
+	t := v.turns[len(v.turns)-1]
+	t.items = append(t.items, it)
+}
+
+func (v *View) last(n int) *item {
+	if len(v.turns) == 0 || v.turns[len(v.turns)-1].n != n {
+		return nil
+	}
+	items := v.turns[len(v.turns)-1].items
+	return items[len(items)-1]
+}
+
+// ANSI escape sequences of the rendering.
+const (
+	reset  = "\x1b[0m"
+	bold   = "\x1b[1m"
+	dim    = "\x1b[2m"
+	red    = "\x1b[31m"
+	green  = "\x1b[32m"
+	yellow = "\x1b[33m"
+	cyan   = "\x1b[36m"
+)
+
+// Header renders the status line and the problem.
+func (v *View) Header(width int) []string {
+	status := v.Status
+	switch v.Status {
+	case server.StatusCompleted:
+		status = green + status + reset
+	case server.StatusFailed:
+		status = red + status + ": " + v.Error + reset
+	case StatusPaused, StatusApproval:
+		status = yellow + status + reset
+	}
+	lines := []string{
+		fmt.Sprintf("%sflow-gpt%s run %s | %s | state %s | turn %d | tokens %d", bold, reset, v.Run, status, v.State, v.Turn, v.Tokens),
+	}
+	for _, l := range wrap("problem: "+v.Problem, width) {
+		lines = append(lines, dim+l+reset)
+	}
+	return lines
+}
+
+// Body renders the turns, with the audit records listed if expandAudit is set.
+func (v *View) Body(width int, expandAudit bool) []string {
+	var lines []string
+	for _, t := range v.turns {
+		lines = append(lines, fmt.Sprintf("%sTurn %d%s", bold, t.n, reset))
+		for _, it := range t.items {
+			lines = append(lines, renderItem(it, width, expandAudit)...)
+		}
+	}
+	return lines
+}
+
+const labelWidth = 11
+
+func renderItem(it *item, width int, expandAudit bool) []string {
+	label, color, text := it.kind, "", it.text
+	switch it.kind {
+	case itemThought:
+		color = cyan
+	case itemCritique:
+		color = statusColor(it.status)
+		text = it.text + " " + color + it.status + reset
+	case itemAction, itemApproval:
+		color = bold
+		if it.kind == itemApproval {
+			color = yellow
+			label = "approve?"
+		}
+	case itemDecision:
+		color = statusColor(it.status)
+		text = color + it.status + reset
+		if it.text != "" {
+			text += ": " + it.text
+		}
+	case itemAudit:
+		color = dim
+		text = fmt.Sprintf("%d records", len(it.records))
+		if !expandAudit {
+			text += " (l to expand)"
+		}
+	case itemRetry:
+		color = red
+	case itemComplete:
+		color = green
+		text = "the thinker considers the problem solved"
+	case itemHint:
+		color = yellow
+	case itemDiff:
+		color = green
+	}
+
+	var lines []string
+	indent := strings.Repeat(" ", labelWidth+2)
+	for i, l := range wrap(text, width-labelWidth-2) {
+		if i == 0 {
+			lines = append(lines, fmt.Sprintf("  %s%-*s%s%s", color, labelWidth, label, reset, l))
+		} else {
+			lines = append(lines, indent+l)
+		}
+	}
+	if it.kind == itemAudit && expandAudit {
+		for _, r := range it.records {
+			for _, l := range wrap(describeRecord(r), width-labelWidth-4) {
+				lines = append(lines, indent+"  "+dim+l+reset)
+			}
+		}
+	}
+	return lines
+}
+
+func statusColor(status string) string {
+	switch status {
+	case "good", fsm.DecisionApproved:
+		return green
+	case "bad", fsm.DecisionRejected:
+		return red
+	}
+	return yellow
+}
+
+// describeRecord summarizes an audit record on one line.
+func describeRecord(r customAgent.Record) string {
+	s := string(r.Kind)
+	if r.Tool != "" {
+		s += " " + r.Tool
+	}
+	for _, f := range []string{r.Input, r.Output, r.Log} {
+		if f != "" {
+			s += " " + oneLine(f, 120)
+			break
+		}
+	}
+	if r.Error != "" {
+		s += " error: " + oneLine(r.Error, 120)
+	}
+	return s
+}
+
+func oneLine(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if r := []rune(s); len(r) > max {
+		return string(r[:max-3]) + "..."
+	}
+	return s
+}
+
+// wrap breaks text into lines of at most width runes, keeping its line breaks.
+func wrap(text string, width int) []string {
+	if width < 10 {
+		width = 10
+	}
+	var lines []string
+	for _, para := range strings.Split(text, "\n") {
+		line := []rune{}
+		for _, word := range strings.Fields(para) {
+			w := []rune(word)
+			if len(line) > 0 && len(line)+1+len(w) > width {
+				lines = append(lines, string(line))
+				line = line[:0]
+			}
+			for len(w) > width {
+				lines = append(lines, string(w[:width]))
+				w = w[width:]
+			}
+			if len(line) > 0 {
+				line = append(line, ' ')
+			}
+			line = append(line, w...)
+		}
+		lines = append(lines, string(line))
+	}
+	return lines
+}
+
+// diffSummary counts the files, added and removed lines of the final diff of a run.
+func diffSummary(diff string) string {
+	files, added, removed := 0, 0, 0
+	for _, l := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(l, "diff --git "):
+			files++
+		case strings.HasPrefix(l, "+++"), strings.HasPrefix(l, "---"):
+		case strings.HasPrefix(l, "+"):
+			added++
+		case strings.HasPrefix(l, "-"):
+			removed++
+		}
+	}
+	if files == 0 {
+		return "no changes to the repository"
+	}
+	return fmt.Sprintf("%d files changed, +%d -%d", files, added, removed)
+}
@@ -0,0 +1,341 @@
+// Package webhook notifies URLs of the lifecycle of runs with HMAC signed JSON payloads, fed by the events of the FSM.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"flow-gpt/internal/fsm"
+	"github.com/cenkalti/backoff"
+	"github.com/google/uuid"
+	zLog "github.com/rs/zerolog/log"
+)
+
+// Types of the notifications.
+const (
+	TypeCompleted        = "run.completed"
+	TypeFailed           = "run.failed"
+	TypeBudgetExhausted  = "run.budget_exhausted"
+	TypeAwaitingApproval = "run.awaiting_approval"
+)
+
+// Types lists every notification type.
+var Types = []string{TypeCompleted, TypeFailed, TypeBudgetExhausted, TypeAwaitingApproval}
+
+// Headers of a delivery.
+const (
+	HeaderEvent     = "X-FlowGPT-Event"
+	HeaderDelivery  = "X-FlowGPT-Delivery"
+	HeaderSignature = "X-FlowGPT-Signature"
+)
+
+// Defaults of the options.
+const (
+	MaxRetries    = 5
+	RetryInterval = time.Second
+	Timeout       = 10 * time.Second
+	QueueSize     = 256
+)
+
+// Payload is the JSON body of a notification.
+type Payload struct {
+	// ID identifies the notification, it is the same for every attempt and URL.
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Run     string `json:"run"`
+	Problem string `json:"problem"`
+	State   string `json:"state"`
+	Turn    int    `json:"turn"`
+	Tokens  int    `json:"tokens,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Action is the action awaiting approval.
+	Action string    `json:"action,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// Delivery is an entry of the delivery log, one per attempt.
+type Delivery struct {
+	ID       string        `json:"id"`
+	Type     string        `json:"type"`
+	Run      string        `json:"run"`
+	URL      string        `json:"url"`
+	Attempt  int           `json:"attempt"`
+	Status   int           `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Time     time.Time     `json:"time"`
+}
+
+type Options struct {
+	// URLs are notified of every notification of Types.
+	URLs []string
+	// Secret signs the payloads, the signature is sent as sha256=HEX in the X-FlowGPT-Signature header. Payloads
+	// aren't signed without it.
+	Secret []byte
+	// Types are the notifications sent, all if empty.
+	Types []string
+	// MaxRetries is the number of retries of a failed delivery, with an exponential backoff from RetryInterval.
+	MaxRetries    uint64
+	RetryInterval time.Duration
+	// Timeout bounds each attempt.
+	Timeout time.Duration
+	// Log receives the delivery log as JSON Lines.
+	Log    io.Writer
+	Client *http.Client
+}
+
+type job struct {
+	payload Payload
+	url     string
+	body    []byte
+}
+
+// Notifier delivers notifications in the background, so the FSM isn't held up by slow endpoints. Each URL has its own
+// queue and worker, so a slow or failing endpoint doesn't hold up the others. Notifications which don't fit the queue
+// are dropped.
+type Notifier struct {
+	opts   Options
+	types  map[string]bool
+	queues map[string]chan job
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// mu guards closed and the sends to the queues
+	mu     sync.Mutex
+	closed bool
+	logMu  sync.Mutex
+}
+
+func New(optFns ...func(o *Options)) *Notifier {
+	opts := Options{
+		MaxRetries:    MaxRetries,
+		RetryInterval: RetryInterval,
+		Timeout:       Timeout,
+		Client:        http.DefaultClient,
+	}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	n := &Notifier{
+		opts:   opts,
+		types:  map[string]bool{},
+		queues: map[string]chan job{},
+	}
+	types := opts.Types
+	if len(types) == 0 {
+		types = Types
+	}
+	for _, t := range types {
+		n.types[t] = true
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	for _, u := range opts.URLs {
+		if _, ok := n.queues[u]; ok {
+			continue
+		}
+		queue := make(chan job, QueueSize)
+		n.queues[u] = queue
+		n.wg.Add(1)
+		go n.work(queue)
+	}
+	return n
+}
+
+// Observer returns the observer of a run which notifies its lifecycle: completing, failing, running out of budget and
+// awaiting the approval of an action.
+func (n *Notifier) Observer(run, problem string) fsm.Observer {
+	return func(e fsm.Event) {
+		p := Payload{Run: run, Problem: problem, State: e.State, Turn: e.Turn, Time: e.Time}
+		switch e.Type {
+		case fsm.EventFinish:
+			p.Type, p.Tokens, p.Error = finishType(e.Reason), e.Tokens, e.Error
+			if p.Type == "" {
+				return
+			}
+		case fsm.EventApproval:
+			p.Type, p.Action = TypeAwaitingApproval, e.Content
+		default:
+			return
+		}
+		n.Notify(p)
+	}
+}
+
+// finishType returns the type of the notification of a finished run by the reason of its finish event. Cancelled runs
+// aren't notified, the operator cancelled them.
+func finishType(reason fsm.Reason) string {
+	switch reason {
+	case fsm.ReasonCompleted:
+		return TypeCompleted
+	case fsm.ReasonFailed:
+		return TypeFailed
+	case fsm.ReasonBudgetExhausted:
+		return TypeBudgetExhausted
+	}
+	return ""
+}
+
+// Notify queues the delivery of the payload to every URL, if its type is notified.
+func (n *Notifier) Notify(p Payload) {
+	if !n.types[p.Type] {
+		return
+	}
+	if p.ID == "" {
+		p.ID = uuid.NewString()
+	}
+	if p.Time.IsZero() {
+		p.Time = time.Now()
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		zLog.Error().Err(err).Msg("failed to encode webhook payload")
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	for u, queue := range n.queues {
+		select {
+		case queue <- job{payload: p, url: u, body: body}:
+		default:
+			zLog.Warn().Str("type", p.Type).Str("url", u).Msg("webhook queue is full, dropping notification")
+		}
+	}
+}
+
+// Close delivers the queued notifications, giving up on the ones left once ctx is done.
+func (n *Notifier) Close(ctx context.Context) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return
+	}
+	n.closed = true
+	for _, queue := range n.queues {
+		close(queue)
+	}
+	n.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		n.cancel()
+		<-done
+	}
+	n.cancel()
+}
+
+// work delivers the jobs of the queue of a URL one at a time.
+func (n *Notifier) work(queue chan job) {
+	defer n.wg.Done()
+	for j := range queue {
+		n.deliver(j)
+	}
+}
+
+// deliver posts a job until it succeeds, fails permanently with a 4xx status or runs out of retries.
+func (n *Notifier) deliver(j job) {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = n.opts.RetryInterval
+	b.MaxElapsedTime = 0
+	attempt := 0
+	operation := func() error {
+		attempt++
+		start := time.Now()
+		status, err := n.post(j)
+		d := Delivery{
+			ID:       j.payload.ID,
+			Type:     j.payload.Type,
+			Run:      j.payload.Run,
+			URL:      j.url,
+			Attempt:  attempt,
+			Status:   status,
+			Duration: time.Since(start),
+			Time:     start,
+		}
+		if err != nil {
+			d.Error = err.Error()
+		}
+		n.log(d)
+		if err != nil && status >= 400 && status < 500 && status != http.StatusTooManyRequests {
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+	err := backoff.Retry(operation, backoff.WithContext(backoff.WithMaxRetries(b, n.opts.MaxRetries), n.ctx))
+	if err != nil {
+		zLog.Error().Err(err).Str("type", j.payload.Type).Str("url", j.url).Int("attempts", attempt).Msg("failed to deliver webhook")
+	}
+}
+
+func (n *Notifier) post(j job) (int, error) {
+	ctx, cancel := context.WithTimeout(n.ctx, n.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, j.url, bytes.NewReader(j.body))
+	if err != nil {
+		return 0, backoff.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "flow-gpt-webhook")
+	req.Header.Set(HeaderEvent, j.payload.Type)
+	req.Header.Set(HeaderDelivery, j.payload.ID)
+	if len(n.opts.Secret) > 0 {
+		req.Header.Set(HeaderSignature, Sign(n.opts.Secret, j.body))
+	}
+	res, err := n.opts.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+func (n *Notifier) log(d Delivery) {
+	if n.opts.Log == nil {
+		return
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	n.logMu.Lock()
+	defer n.logMu.Unlock()
+	if _, err = n.opts.Log.Write(append(b, '\n')); err != nil {
+		zLog.Error().Err(err).Msg("failed to write webhook delivery log")
+	}
+}
+
+// Sign returns the signature of a body, sha256= followed by the hex HMAC-SHA256 of the body with the secret.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a body, for receivers of the webhooks.
+func Verify(secret, body []byte, signature string) error {
+	if !hmac.Equal([]byte(Sign(secret, body)), []byte(signature)) {
+		return errors.New("webhook: invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"flow-gpt/internal/fsm"
+	"github.com/rs/zerolog"
+)
+
+// syncBuffer is a delivery log written by the worker and read by the test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) deliveries(t *testing.T) []Delivery {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ds []Delivery
+	for _, l := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		var d Delivery
+		if err := json.Unmarshal([]byte(l), &d); err != nil {
+			t.Fatalf("invalid delivery log line %q: %v", l, err)
+		}
+		ds = append(ds, d)
+	}
+	return ds
+}
+
+func TestNotifier(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	secret := []byte("webhook secret")
+	var mu sync.Mutex
+	var received []Payload
+	attempts := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := Verify(secret, body, r.Header.Get(HeaderSignature)); err != nil {
+			t.Errorf("delivery of %s: %v", r.Header.Get(HeaderEvent), err)
+		}
+		var p Payload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Errorf("invalid payload %s", body)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[p.Type]++
+		switch {
+		// the first attempt of the completion fails and is retried
+		case p.Type == TypeCompleted && attempts[p.Type] == 1:
+			w.WriteHeader(http.StatusBadGateway)
+		// a rejected failure notification isn't retried
+		case p.Type == TypeFailed:
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			received = append(received, p)
+		}
+	}))
+	defer srv.Close()
+
+	log := &syncBuffer{}
+	n := New(func(o *Options) {
+		o.URLs = []string{srv.URL}
+		o.Secret = secret
+		o.Types = []string{TypeCompleted, TypeFailed, TypeBudgetExhausted}
+		o.RetryInterval = time.Millisecond
+		o.Log = log
+	})
+	observe := n.Observer("run-1", "do nothing")
+	for _, e := range []fsm.Event{
+		{Type: fsm.EventStart, State: "Init"},
+		{Type: fsm.EventApproval, State: "AwaitApproval", Content: "rm -rf /"},
+		{Type: fsm.EventTransition, State: "Complete", Turn: 3},
+		{Type: fsm.EventFinish, State: "Complete", Turn: 3, Reason: fsm.ReasonCompleted, Tokens: 7},
+		{Type: fsm.EventFinish, State: "Complete", Reason: fsm.ReasonBudgetExhausted, Error: fmt.Errorf("%w: 5 turns", fsm.ErrMaxTurns).Error(), Tokens: 42},
+		{Type: fsm.EventFinish, State: "Next", Reason: fsm.ReasonFailed, Error: "boom"},
+		{Type: fsm.EventFinish, State: "Next", Reason: fsm.ReasonCancelled, Error: context.Canceled.Error()},
+	} {
+		observe(e)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n.Close(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[0].Type != TypeCompleted || received[0].Turn != 3 || received[0].Run != "run-1" || received[0].Tokens != 7 ||
+		received[1].Type != TypeBudgetExhausted || received[1].Tokens != 42 {
+		t.Fatalf("unexpected notifications %+v", received)
+	}
+	if attempts[TypeCompleted] != 2 || attempts[TypeFailed] != 1 || attempts[TypeAwaitingApproval] != 0 {
+		t.Errorf("unexpected attempts %v", attempts)
+	}
+	ds := log.deliveries(t)
+	if len(ds) != 4 || ds[0].Status != http.StatusBadGateway || ds[0].Error == "" || ds[1].Attempt != 2 ||
+		ds[1].ID != ds[0].ID || ds[3].Status != http.StatusBadRequest {
+		t.Errorf("unexpected delivery log %+v", ds)
+	}
+	// notifications after Close are dropped
+	n.Notify(Payload{Type: TypeCompleted})
+}
+
+func TestNotifierSlowURL(t *testing.T) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	received := make(chan string, 2)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(HeaderDelivery)
+	}))
+	defer fast.Close()
+
+	n := New(func(o *Options) {
+		o.URLs = []string{slow.URL, fast.URL}
+	})
+	n.Notify(Payload{Type: TypeCompleted, Run: "run-1"})
+	n.Notify(Payload{Type: TypeFailed, Run: "run-2"})
+	// the fast URL gets both notifications while the slow one still holds the first
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the slow URL held up the other, %d notifications received", i)
+		}
+	}
+	close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	n.Close(ctx)
+}
@@ -0,0 +1,76 @@
+package workspace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Retention bounds the output directories of runs kept in the output directory, 0 keeps them all.
+type Retention struct {
+	// MaxAge removes the runs whose manifest wasn't updated for longer.
+	MaxAge time.Duration
+	// MaxRuns keeps this many finished runs, removing the oldest ones. Runs which didn't finish are only removed by
+	// MaxAge, they may still be going on.
+	MaxRuns int
+}
+
+type runDir struct {
+	name     string
+	updated  time.Time
+	finished bool
+}
+
+// Clean removes the output directories of root which the retention policy doesn't keep and returns their names. Only
+// directories with a manifest are considered, so files of root which aren't runs are left alone.
+func Clean(root string, r Retention) ([]string, error) {
+	if r.MaxAge <= 0 && r.MaxRuns <= 0 {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list runs: %w", err)
+	}
+	var runs []runDir
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(root, e.Name(), ManifestFile))
+		if err != nil {
+			continue
+		}
+		var m Manifest
+		if err = json.Unmarshal(b, &m); err != nil {
+			continue
+		}
+		runs = append(runs, runDir{name: e.Name(), updated: m.UpdatedAt, finished: m.Finished})
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].updated.After(runs[j].updated)
+	})
+
+	var removed []string
+	finished := 0
+	for _, run := range runs {
+		expired := r.MaxAge > 0 && time.Since(run.updated) > r.MaxAge
+		if run.finished {
+			finished++
+			expired = expired || (r.MaxRuns > 0 && finished > r.MaxRuns)
+		}
+		if !expired {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(root, run.name)); err != nil {
+			return removed, fmt.Errorf("failed to remove run %s: %w", run.name, err)
+		}
+		removed = append(removed, run.name)
+	}
+	return removed, nil
+}
@@ -0,0 +1,370 @@
+// Package workspace gives each run a directory of its own which the tools work in, seeded from a template directory
+// or a git checkout. A workspace which is a git repository gets a working branch for the run. The files of the
+// workspace are tracked in a manifest next to it, and the output directories of old runs are removed by a retention
+// policy.
+package workspace
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"flow-gpt/internal/fsm"
+	"flow-gpt/internal/integration"
+	zLog "github.com/rs/zerolog/log"
+)
+
+// Dir is the workspace in the output directory of a run, next to its manifest and report.
+const Dir = "workspace"
+
+// ManifestFile is the manifest of the workspace in the output directory of a run.
+const ManifestFile = "manifest.json"
+
+// Limits of the manifest, larger files are compared by size and modification time instead of their hash and extra
+// files are left out.
+const (
+	MaxHashSize = 16 << 20
+	MaxFiles    = 10000
+)
+
+// Statuses of the files of a manifest, compared to the seed of the workspace.
+const (
+	StatusSeeded   = "seeded"
+	StatusCreated  = "created"
+	StatusModified = "modified"
+	StatusDeleted  = "deleted"
+)
+
+type Options struct {
+	// Template is a directory copied into the workspace.
+	Template string
+	// Repo is a git repository cloned into the workspace, Ref the branch, tag or commit checked out.
+	Repo string
+	Ref  string
+}
+
+// Workspace is the directory of a run.
+type Workspace struct {
+	Run string
+	// Root is the output directory of the run, Dir the workspace in it.
+	Root string
+	Dir  string
+	// Git is the repository of the workspace, nil if it isn't one. Branch is the working branch of the run in it, Base
+	// the commit it started from.
+	Git    *integration.Git
+	Branch string
+	Base   string
+	seed   string
+	// files are the files of the workspace once seeded
+	files     map[string]File
+	createdAt time.Time
+	// mu serializes the writes of the manifest
+	mu sync.Mutex
+}
+
+// File is a file of the workspace.
+type File struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Modified time.Time `json:"modified"`
+	Status   string    `json:"status"`
+}
+
+// Manifest lists the files of a workspace.
+type Manifest struct {
+	Run string `json:"run"`
+	Dir string `json:"dir"`
+	// Seed is the template or the repository the workspace was seeded from.
+	Seed      string    `json:"seed,omitempty"`
+	Branch    string    `json:"branch,omitempty"`
+	Base      string    `json:"base,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	// Finished is set once the run finished, retention only counts finished runs.
+	Finished  bool   `json:"finished"`
+	Files     []File `json:"files"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// Create creates the workspace of a run in root, its output directory, seeds it and writes its first manifest.
+func Create(ctx context.Context, run, root string, optFns ...func(o *Options)) (*Workspace, error) {
+	opts := Options{}
+	for _, fn := range optFns {
+		fn(&opts)
+	}
+	if opts.Template != "" && opts.Repo != "" {
+		return nil, errors.New("a workspace is seeded from a template or a repository, not both")
+	}
+	w := &Workspace{Run: run, Root: root, Dir: filepath.Join(root, Dir), createdAt: time.Now()}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+	switch {
+	case opts.Template != "":
+		w.seed = opts.Template
+		if err := copyDir(opts.Template, w.Dir); err != nil {
+			return nil, fmt.Errorf("failed to copy template %s: %w", opts.Template, err)
+		}
+	case opts.Repo != "":
+		w.seed = opts.Repo
+		if err := clone(ctx, opts.Repo, opts.Ref, w.Dir); err != nil {
+			return nil, err
+		}
+		if opts.Ref != "" {
+			w.seed += "@" + opts.Ref
+		}
+	default:
+		if err := os.MkdirAll(w.Dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create workspace: %w", err)
+		}
+	}
+	if integration.IsGitRepo(w.Dir) {
+		if err := w.checkoutBranch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	files, _, err := w.scan()
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan workspace: %w", err)
+	}
+	w.files = map[string]File{}
+	for _, f := range files {
+		w.files[f.Path] = f
+	}
+	if err = w.WriteManifest(false); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Manifest lists the files of the workspace with their status.
+func (w *Workspace) Manifest() (Manifest, error) {
+	m := Manifest{Run: w.Run, Dir: w.Dir, Seed: w.seed, Branch: w.Branch, Base: w.Base, CreatedAt: w.createdAt, UpdatedAt: time.Now()}
+	files, truncated, err := w.scan()
+	if err != nil {
+		return m, err
+	}
+	seen := map[string]bool{}
+	for _, f := range files {
+		seen[f.Path] = true
+		f.Status = StatusCreated
+		if s, ok := w.files[f.Path]; ok {
+			f.Status = StatusSeeded
+			if s.SHA256 != f.SHA256 || s.Size != f.Size || (f.SHA256 == "" && !s.Modified.Equal(f.Modified)) {
+				f.Status = StatusModified
+			}
+		}
+		m.Files = append(m.Files, f)
+	}
+	// deleted files aren't known once the scan is truncated
+	if !truncated {
+		for p, s := range w.files {
+			if !seen[p] {
+				s.Status = StatusDeleted
+				m.Files = append(m.Files, s)
+			}
+		}
+	}
+	sort.Slice(m.Files, func(i, j int) bool {
+		return m.Files[i].Path < m.Files[j].Path
+	})
+	m.Truncated = truncated
+	return m, nil
+}
+
+// checkoutBranch creates the working branch of the run from the commit checked out.
+func (w *Workspace) checkoutBranch(ctx context.Context) error {
+	w.Git = integration.NewGit(w.Dir)
+	var err error
+	if w.Base, err = w.Git.Head(ctx); err != nil {
+		return fmt.Errorf("failed to find the commit of the workspace: %w", err)
+	}
+	w.Branch = integration.BranchPrefix + w.Run
+	if _, err = w.Git.Run(ctx, "switch", "--quiet", "--create", w.Branch); err != nil {
+		return fmt.Errorf("failed to create working branch: %w", err)
+	}
+	return nil
+}
+
+// Diff returns the changes of the run to the repository of the workspace, committed or not, empty if the workspace
+// isn't a repository.
+func (w *Workspace) Diff(ctx context.Context) (string, error) {
+	if w.Git == nil {
+		return "", nil
+	}
+	return w.Git.Diff(ctx, w.Base)
+}
+
+// Artifacts lists the files the run created, modified or deleted.
+func (w *Workspace) Artifacts() ([]File, error) {
+	m, err := w.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	for _, f := range m.Files {
+		if f.Status != StatusSeeded {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// WriteManifest writes the manifest of the workspace to the output directory of the run.
+func (w *Workspace) WriteManifest(finished bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	m, err := w.Manifest()
+	if err != nil {
+		return fmt.Errorf("failed to scan workspace: %w", err)
+	}
+	m.Finished = finished
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(w.Root, ManifestFile), b, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// Observer returns the observer of the run which updates the manifest after every action and when the run finishes.
+func (w *Workspace) Observer() fsm.Observer {
+	return func(e fsm.Event) {
+		finished := e.Type == fsm.EventFinish
+		if !finished && e.Type != fsm.EventAudit {
+			return
+		}
+		if err := w.WriteManifest(finished); err != nil {
+			zLog.Error().Err(err).Str("run", w.Run).Msg("failed to update the manifest of the workspace")
+		}
+	}
+}
+
+// scan lists the files of the workspace but .git, at most MaxFiles of them.
+func (w *Workspace) scan() ([]File, bool, error) {
+	var files []File
+	truncated := false
+	err := filepath.WalkDir(w.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if len(files) == MaxFiles {
+			truncated = true
+			return filepath.SkipAll
+		}
+		rel, err := filepath.Rel(w.Dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f := File{Path: filepath.ToSlash(rel), Size: info.Size(), Modified: info.ModTime()}
+		if info.Size() <= MaxHashSize {
+			if f.SHA256, err = hashFile(path); err != nil {
+				return err
+			}
+		}
+		files = append(files, f)
+		return nil
+	})
+	return files, truncated, err
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyDir copies the files, directories and symlinks of src to dst.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// clone clones repo into dir and checks out ref, the default branch if empty.
+func clone(ctx context.Context, repo, ref, dir string) error {
+	if _, err := integration.NewGit("").Run(ctx, "clone", "--quiet", "--", repo, dir); err != nil {
+		return fmt.Errorf("failed to clone %s: %w", repo, err)
+	}
+	if ref == "" {
+		return nil
+	}
+	if _, err := integration.NewGit(dir).Run(ctx, "checkout", "--quiet", ref); err != nil {
+		return fmt.Errorf("failed to check out %s: %w", ref, err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package workspace
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"flow-gpt/internal/fsm"
+	"flow-gpt/internal/integration"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readManifest(t *testing.T, root string) Manifest {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(root, ManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m Manifest
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestTemplate(t *testing.T) {
+	template := t.TempDir()
+	writeFile(t, filepath.Join(template, "README.md"), "readme")
+	writeFile(t, filepath.Join(template, "src", "main.go"), "package main")
+	writeFile(t, filepath.Join(template, "old.txt"), "old")
+
+	root := filepath.Join(t.TempDir(), "run-1")
+	w, err := Create(context.Background(), "run-1", root, func(o *Options) {
+		o.Template = template
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := readManifest(t, root); len(m.Files) != 3 || m.Files[0].Status != StatusSeeded || m.Seed != template || m.Finished {
+		t.Errorf("unexpected first manifest %+v", m)
+	}
+
+	writeFile(t, filepath.Join(w.Dir, "src", "main.go"), "package main\n\nfunc main() {}")
+	writeFile(t, filepath.Join(w.Dir, "out", "result.txt"), "done")
+	if err = os.Remove(filepath.Join(w.Dir, "old.txt")); err != nil {
+		t.Fatal(err)
+	}
+	observe := w.Observer()
+	observe(fsm.Event{Type: fsm.EventFinish})
+
+	m := readManifest(t, root)
+	want := map[string]string{
+		"README.md":      StatusSeeded,
+		"old.txt":        StatusDeleted,
+		"out/result.txt": StatusCreated,
+		"src/main.go":    StatusModified,
+	}
+	if len(m.Files) != len(want) || !m.Finished {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+	for _, f := range m.Files {
+		if want[f.Path] != f.Status {
+			t.Errorf("%s is %s, want %s", f.Path, f.Status, want[f.Path])
+		}
+	}
+	artifacts, err := w.Artifacts()
+	if err != nil || len(artifacts) != 3 {
+		t.Errorf("unexpected artifacts %+v: %v", artifacts, err)
+	}
+}
+
+func TestRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	repo := t.TempDir()
+	writeFile(t, filepath.Join(repo, "main.go"), "package main")
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "init"},
+		{"tag", "v1"},
+	} {
+		if _, err := integration.NewGit(repo).Run(context.Background(), args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := filepath.Join(t.TempDir(), "run-1")
+	w, err := Create(context.Background(), "run-1", root, func(o *Options) {
+		o.Repo = repo
+		o.Ref = "v1"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := w.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// .git isn't tracked
+	if len(m.Files) != 1 || m.Files[0].Path != "main.go" || m.Seed != repo+"@v1" || m.Branch != "flow-gpt/run-1" || m.Base == "" {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+	if branch, err := w.Git.Branch(context.Background()); err != nil || branch != w.Branch {
+		t.Errorf("working branch %q isn't checked out: %v", branch, err)
+	}
+
+	writeFile(t, filepath.Join(w.Dir, "main.go"), "package main\n\nfunc main() {}\n")
+	writeFile(t, filepath.Join(w.Dir, "doc.go"), "// Package main is a test.\n")
+	if _, err = w.Git.Run(context.Background(), "commit", "--quiet", "--all", "--message", "add main"); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := w.Diff(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// committed and new files are both part of the diff
+	if !strings.Contains(diff, "+func main() {}") || !strings.Contains(diff, "+// Package main is a test.") {
+		t.Errorf("unexpected diff %s", diff)
+	}
+
+	if _, err = Create(context.Background(), "run-2", filepath.Join(t.TempDir(), "run-2"), func(o *Options) {
+		o.Repo = repo
+		o.Ref = "missing"
+	}); err == nil {
+		t.Error("expected an error checking out a missing ref")
+	}
+}
+
+func TestClean(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	for name, m := range map[string]Manifest{
+		"new":     {UpdatedAt: now, Finished: true},
+		"recent":  {UpdatedAt: now.Add(-time.Hour), Finished: true},
+		"older":   {UpdatedAt: now.Add(-2 * time.Hour), Finished: true},
+		"running": {UpdatedAt: now.Add(-3 * time.Hour)},
+		"stale":   {UpdatedAt: now.Add(-48 * time.Hour)},
+	} {
+		b, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(root, name, ManifestFile), string(b))
+	}
+	// not a run
+	writeFile(t, filepath.Join(root, "notes", "todo.txt"), "keep me")
+
+	removed, err := Clean(root, Retention{MaxAge: 24 * time.Hour, MaxRuns: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || removed[0] != "older" || removed[1] != "stale" {
+		t.Errorf("unexpected removed runs %v", removed)
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if len(names) != 4 || names[0] != "new" || names[1] != "notes" || names[2] != "recent" || names[3] != "running" {
+		t.Errorf("unexpected runs left %v", names)
+	}
+}
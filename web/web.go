@@ -0,0 +1,15 @@
+// Package web embeds the web UI, which streams the runs of the server it is served by.
+package web
+
+import (
+	"embed"
+	"net/http"
+)
+
+//go:embed index.html
+var files embed.FS
+
+// Handler serves the UI at /.
+func Handler() http.Handler {
+	return http.FileServer(http.FS(files))
+}
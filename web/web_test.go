@@ -0,0 +1,29 @@
+package web
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || !strings.Contains(string(b), "location.host") {
+		t.Fatalf("expected the UI, got %d:\n%s", res.StatusCode, b)
+	}
+	if strings.Contains(string(b), "localhost:8080") {
+		t.Error("expected the websocket url to be derived from the page")
+	}
+}